@@ -2,95 +2,175 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"log"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/melonproject/ethereum-exporter/monitor"
+	"github.com/melonproject/ethereum-exporter/monitor/ethtest"
 )
 
 func main() {
 	if err := run(os.Args); err != nil {
-		fmt.Printf("[ERR]: %v", err)
+		if status, ok := err.(exitStatus); ok {
+			os.Exit(int(status))
+		}
+		fmt.Printf("[ERR]: %v\n", err)
 		os.Exit(1)
 	}
 }
 
-func readConfigFile(path string) (*monitor.Config, error) {
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
-		return nil, err
+// exitStatus is returned by the commands that already printed their result
+// and exit with a specific status code.
+type exitStatus int
+
+func (s exitStatus) Error() string {
+	return fmt.Sprintf("exit status %d", int(s))
+}
+
+// Subcommands by name
+var commands = map[string]func(args []string) error{
+	"serve":           serve,
+	"validate-config": validateConfig,
+	"print-config":    printConfig,
+	"check":           check,
+	"top":             top,
+	"backfill":        backfill,
+	"demo-node":       demoNode,
+	"version":         printVersion,
+}
+
+// run runs the subcommand in args[1]. serve is the default so the exporter
+// can still be started with only flags.
+func run(args []string) error {
+	name := "serve"
+	args = args[1:]
+
+	if len(args) != 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
 	}
 
-	var config monitor.Config
-	err = json.Unmarshal(data, &config)
-	if err != nil {
-		return nil, err
+	command, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("Command %s not found. 'serve', 'validate-config', 'print-config', 'check', 'top', 'backfill', 'demo-node' and 'version' are the only valid options", name)
 	}
 
-	return &config, nil
+	return command(args)
 }
 
-func readConfig(args []string) (*monitor.Config, error) {
-
-	var fileConfigPath string
+// setFlags are the repeated -set key=value flags.
+type setFlags []string
 
-	config := monitor.DefaultConfig()
+func (s *setFlags) String() string {
+	return strings.Join(*s, ",")
+}
 
-	fileConfig := &monitor.Config{
-		ConsulConfig: &monitor.ConsulConfig{},
+func (s *setFlags) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return fmt.Errorf("'%s' is not a key=value pair", value)
 	}
+	*s = append(*s, value)
+	return nil
+}
+
+// Config keys of the flags
+var flagKeys = map[string]string{
+	"endpoint":  "endpoint",
+	"nodename":  "nodename",
+	"bind":      "bind",
+	"port":      "port",
+	"threshold": "sync_threshold",
+}
+
+// configSource are the config file and flags given, kept to load the
+// config again on reload.
+type configSource struct {
+	path string
+
+	// Flags given, by name
+	flags map[string]string
 
-	cliConfig := &monitor.Config{
-		ConsulConfig: &monitor.ConsulConfig{},
+	sets setFlags
+}
+
+// configFlags defines the config flags in fs.
+func configFlags(fs *flag.FlagSet) *configSource {
+	source := &configSource{
+		flags: map[string]string{},
 	}
 
-	flag.StringVar(&fileConfigPath, "config", "", "")
-	flag.StringVar(&cliConfig.Endpoint, "endpoint", "", "")
-	flag.StringVar(&cliConfig.NodeName, "nodename", "", "")
-	flag.StringVar(&cliConfig.BindAddr, "bind", "", "")
-	flag.IntVar(&cliConfig.BindPort, "port", 0, "")
-	flag.IntVar(&cliConfig.SyncThreshold, "threshold", 5, "")
+	fs.StringVar(&source.path, "config", "", "Config file (.json, .yaml, .yml or .toml)")
+	fs.String("endpoint", "", "Endpoint of the node")
+	fs.String("nodename", "", "Name of the node")
+	fs.String("bind", "", "Bind address")
+	fs.Int("port", 0, "Bind port")
+	fs.Int("threshold", 0, "Max blocks behind the reference for the node to be synced")
+	fs.Var(&source.sets, "set", "Set a config key (i.e. -set rpc.timeout=10s). Can be repeated.")
 
-	flag.Parse()
+	return source
+}
 
-	if fileConfigPath != "" {
-		var err error
+// parse parses the args and records the config flags given, the only
+// ones that override the config.
+func (s *configSource) parse(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
 
-		fileConfig, err = readConfigFile(fileConfigPath)
-		if err != nil {
-			return nil, err
+	fs.Visit(func(f *flag.Flag) {
+		if _, ok := flagKeys[f.Name]; ok {
+			s.flags[f.Name] = f.Value.String()
 		}
+	})
+
+	return nil
+}
+
+// readConfig loads the defaults, the config file (json, yaml or toml), the
+// ETH_EXPORTER_* environment variables and the flags, in that order.
+func readConfig(source *configSource) (*monitor.Config, error) {
+	loader := monitor.NewConfigLoader()
+
+	if source.path != "" {
+		loader.LoadFile(source.path)
+	}
+
+	loader.LoadEnv(os.Environ())
 
-		config.Merge(fileConfig)
+	for name, value := range source.flags {
+		loader.Set(flagKeys[name], value, "flag -"+name)
 	}
 
-	config.Merge(cliConfig)
-	return config, nil
+	for _, set := range source.sets {
+		parts := strings.SplitN(set, "=", 2)
+		loader.Set(parts[0], parts[1], "flag -set "+parts[0])
+	}
+
+	return loader.Config()
 }
 
-func run(args []string) error {
+func serve(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	source := configFlags(fs)
+	watchInterval := fs.Duration("watch-interval", 5*time.Second, "Interval to check the config file for changes. 0 disables it.")
+	source.parse(fs, args)
 
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	config, err := readConfig(args)
+	config, err := readConfig(source)
 	if err != nil {
 		return fmt.Errorf("Failed to read config: %v", err)
 	}
 
-	prettyConfig, err := json.MarshalIndent(config, "", "\t")
-	if err != nil {
-		return fmt.Errorf("Failed to prettify config: %v", err)
-	}
-
-	fmt.Println(string(prettyConfig))
-
-	// Handle interupts.
+	// Handle interupts and reloads.
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 
 	monitor, err := monitor.NewMonitor(config)
 	if err != nil {
@@ -101,10 +181,299 @@ func run(args []string) error {
 		return fmt.Errorf("Failed to start the monitor: %v", err)
 	}
 
-	for range c {
-		ctx.Done()
+	reloadCh := make(chan struct{}, 1)
+	if source.path != "" && *watchInterval > 0 {
+		go watchConfig(ctx, source.path, *watchInterval, reloadCh)
+	}
+
+	for {
+		select {
+		case sig := <-c:
+			if sig == syscall.SIGHUP {
+				reload(source, monitor)
+				continue
+			}
+			fmt.Printf("Caught signal %v. Shutting down...\n", sig)
+
+		case <-reloadCh:
+			reload(source, monitor)
+			continue
+		}
 		break
 	}
 
+	cancel()
+
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), config.ShutdownTimeout.Duration())
+	defer stopCancel()
+
+	if err := monitor.Stop(stopCtx); err != nil {
+		return fmt.Errorf("Failed to stop the monitor: %v", err)
+	}
+
+	return nil
+}
+
+// validateConfig checks the config and, with -check-endpoints, the
+// connectivity to every endpoint. It fails if any check fails.
+func validateConfig(args []string) error {
+	fs := flag.NewFlagSet("validate-config", flag.ExitOnError)
+	source := configFlags(fs)
+	checkEndpoints := fs.Bool("check-endpoints", false, "Check the connectivity to every endpoint of the node")
+	timeout := fs.Duration("timeout", 10*time.Second, "Timeout of the connectivity check of each endpoint")
+	source.parse(fs, args)
+
+	config, err := readConfig(source)
+	if err == nil {
+		err = monitor.CheckConfig(config)
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid config: %v", err)
+	}
+
+	if *checkEndpoints {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout*time.Duration(len(config.RPCEndpoints())))
+		defer cancel()
+
+		failed := 0
+		for _, status := range monitor.CheckEndpoints(ctx, config) {
+			if status.Err != nil {
+				failed++
+				fmt.Printf("Endpoint %s: FAIL: %v\n", status.Endpoint, status.Err)
+				continue
+			}
+			fmt.Printf("Endpoint %s: OK: %s, chain %s, block %s\n", status.Endpoint, status.ClientVersion, status.Chain, status.BlockNumber)
+		}
+
+		if failed != 0 {
+			return fmt.Errorf("%d of %d endpoints unreachable", failed, len(config.RPCEndpoints()))
+		}
+	}
+
+	fmt.Println("Config is valid")
+	return nil
+}
+
+// printConfig prints the merged config, without credentials.
+func printConfig(args []string) error {
+	fs := flag.NewFlagSet("print-config", flag.ExitOnError)
+	source := configFlags(fs)
+	format := fs.String("format", monitor.ConfigFormatJSON, "Output format (json, yaml or toml)")
+	source.parse(fs, args)
+
+	config, err := readConfig(source)
+	if err != nil {
+		return fmt.Errorf("Failed to read config: %v", err)
+	}
+
+	data, err := monitor.EncodeConfig(config.Redacted(), *format)
+	if err != nil {
+		return err
+	}
+
+	os.Stdout.Write(data)
+	return nil
+}
+
+// check runs one round of checks and prints the result as a nagios plugin.
+// It exits with the plugin status code, unknown for usage errors.
+func check(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	source := configFlags(fs)
+
+	options := &monitor.CheckOptions{}
+	fs.Int64Var(&options.WarnBehind, "warn-behind", 3, "Warning if more blocks behind the reference. 0 disables it.")
+	fs.Int64Var(&options.CritBehind, "crit-behind", 10, "Critical if more blocks behind the reference. 0 disables it.")
+	fs.Int64Var(&options.WarnPeers, "warn-peers", 0, "Warning if fewer peers. 0 disables it.")
+	fs.Int64Var(&options.CritPeers, "crit-peers", 1, "Critical if fewer peers. 0 disables it.")
+	fs.DurationVar(&options.WarnHeadAge, "warn-head-age", time.Minute, "Warning if the last block is older. 0 disables it.")
+	fs.DurationVar(&options.CritHeadAge, "crit-head-age", 5*time.Minute, "Critical if the last block is older. 0 disables it.")
+	fs.StringVar(&options.ReferenceURL, "reference", "", "Etherscan compatible api used as reference of the chain head. Defaults to the reference_url of the config.")
+	timeout := fs.Duration("timeout", 30*time.Second, "Timeout of the check")
+	if err := source.parse(fs, args); err != nil {
+		fmt.Printf("ETHEREUM UNKNOWN - %v\n", err)
+		return exitStatus(monitor.NagiosUnknown)
+	}
+
+	config, err := readConfig(source)
+	if err != nil {
+		fmt.Printf("ETHEREUM UNKNOWN - invalid config: %s\n", strings.Replace(err.Error(), "\n", " ", -1))
+		return exitStatus(monitor.NagiosUnknown)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	result := monitor.RunCheck(ctx, config, options)
+	cancel()
+
+	fmt.Println(result)
+	if result.Status != monitor.NagiosOK {
+		return exitStatus(result.Status)
+	}
+
+	return nil
+}
+
+// top shows a live view of the nodes given as arguments, or of the
+// endpoints of the config, until interrupted.
+func top(args []string) error {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	source := configFlags(fs)
+	interval := fs.Duration("interval", 2*time.Second, "Refresh interval")
+	reference := fs.String("reference", "", "Etherscan compatible api used as reference of the chain head. Defaults to the reference_url of the config.")
+	once := fs.Bool("once", false, "Print the table once, without escapes")
+	source.parse(fs, args)
+
+	config, err := readConfig(source)
+	if err != nil {
+		return fmt.Errorf("Failed to read config: %v", err)
+	}
+
+	endpoints := fs.Args()
+	if len(endpoints) == 0 {
+		endpoints = config.RPCEndpoints()
+	}
+
+	view, err := monitor.NewTop(config, endpoints, os.Stdout, *interval, *reference)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if *once {
+		view.Once(ctx)
+		return nil
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		cancel()
+	}()
+
+	view.Run(ctx)
 	return nil
 }
+
+// backfill writes the records of a range of blocks to the history or to a
+// csv or jsonl file. An interrupted backfill resumes from its checkpoint.
+func backfill(args []string) error {
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	source := configFlags(fs)
+
+	options := &monitor.BackfillOptions{}
+	fs.Uint64Var(&options.From, "from", 0, "First block")
+	fs.Uint64Var(&options.To, "to", 0, "Last block. Defaults to the head of the node.")
+	fs.IntVar(&options.Concurrency, "concurrency", 4, "Max concurrent block requests")
+	fs.StringVar(&options.Format, "format", monitor.BackfillHistory, "Output format (history, csv or jsonl)")
+	fs.StringVar(&options.Output, "output", "", "Output file of the csv and jsonl formats. Defaults to stdout.")
+	fs.StringVar(&options.Checkpoint, "checkpoint", "", "File with the progress, to resume an interrupted backfill. Defaults to the output file with a .checkpoint suffix, or the history database with a .backfill suffix.")
+	source.parse(fs, args)
+
+	config, err := readConfig(source)
+	if err != nil {
+		return fmt.Errorf("Failed to read config: %v", err)
+	}
+
+	if options.Checkpoint == "" {
+		switch {
+		case options.Format == monitor.BackfillHistory && config.HistoryConfig.Path != "":
+			options.Checkpoint = config.HistoryConfig.Path + ".backfill"
+		case options.Format != monitor.BackfillHistory && options.Output != "" && options.Output != "-":
+			options.Checkpoint = options.Output + ".checkpoint"
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		cancel()
+	}()
+
+	// The progress goes to stderr so it does not mix with the records on
+	// stdout
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+
+	if err := monitor.Backfill(ctx, logger, config, options); err != nil {
+		if ctx.Err() != nil && options.Checkpoint != "" {
+			return fmt.Errorf("Backfill interrupted. Run it again to resume from %s", options.Checkpoint)
+		}
+		return fmt.Errorf("Backfill failed: %v", err)
+	}
+
+	return nil
+}
+
+// demoNode runs a simulated node and etherscan api to try the exporter
+// without a real node, until interrupted.
+func demoNode(args []string) error {
+	fs := flag.NewFlagSet("demo-node", flag.ExitOnError)
+
+	config := ethtest.DefaultConfig()
+	listen := fs.String("listen", "127.0.0.1:8545", "Address of the json-rpc api")
+	etherscanListen := fs.String("etherscan-listen", "127.0.0.1:8546", "Address of the etherscan api")
+	behind := fs.Int64("behind", 0, "Blocks the node is behind the etherscan api")
+	fs.StringVar(&config.Chain, "chain", config.Chain, "Chain of the node")
+	fs.Uint64Var(&config.StartBlock, "start-block", config.StartBlock, "Head of the chain on start")
+	fs.DurationVar(&config.BlockTime, "block-time", config.BlockTime, "Interval between blocks")
+	fs.Int64Var(&config.Peers, "peers", config.Peers, "Peers of the node")
+	fs.BoolVar(&config.Archive, "archive", false, "Simulate an archive node")
+	fs.Parse(args)
+
+	node := ethtest.NewNode(config)
+	if err := node.Start(*listen); err != nil {
+		return err
+	}
+	defer node.Close()
+
+	etherscan := ethtest.NewEtherscan(node)
+	if err := etherscan.Start(*etherscanListen); err != nil {
+		return err
+	}
+	defer etherscan.Close()
+
+	etherscan.SetAhead(*behind)
+
+	fmt.Printf("Node running on %s\n", node.URL())
+	fmt.Printf("Etherscan api running on %s\n", etherscan.URL())
+	fmt.Printf("Run the exporter with -endpoint %s -set reference_url='%s'\n", node.URL(), etherscan.URL())
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	<-c
+
+	return nil
+}
+
+func printVersion(args []string) error {
+	fmt.Println(versionString())
+	return nil
+}
+
+func watchConfig(ctx context.Context, path string, interval time.Duration, reloadCh chan struct{}) {
+	monitor.WatchFile(ctx, path, interval, func() {
+		select {
+		case reloadCh <- struct{}{}:
+		default:
+		}
+	})
+}
+
+// reload loads the config again and applies it. The current config is kept
+// if it is not valid.
+func reload(source *configSource, m *monitor.Monitor) {
+	fmt.Println("Reloading config...")
+
+	err := m.Reload(func() (*monitor.Config, error) {
+		return readConfig(source)
+	})
+	if err != nil {
+		fmt.Printf("[ERR]: Failed to reload config, keeping the current one: %v\n", err)
+	}
+}
@@ -0,0 +1,168 @@
+package monitor
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// authTransport sets the custom headers and credentials of the endpoint on
+// every request.
+type authTransport struct {
+	config *RPCConfig
+	base   http.RoundTripper
+
+	// Engine api jwt secret
+	jwtSecret []byte
+}
+
+func newAuthTransport(config *RPCConfig, base http.RoundTripper) (http.RoundTripper, error) {
+	t := &authTransport{
+		config: config,
+		base:   base,
+	}
+
+	if config.JWTSecretFile != "" {
+		secret, err := readJWTSecret(config.JWTSecretFile)
+		if err != nil {
+			return nil, err
+		}
+		t.jwtSecret = secret
+	}
+
+	return t, nil
+}
+
+// CloseIdleConnections closes the idle connections of the base transport.
+func (t *authTransport) CloseIdleConnections() {
+	if base, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		base.CloseIdleConnections()
+	}
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrip must not modify the request
+	req2 := new(http.Request)
+	*req2 = *req
+	req2.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		req2.Header[k] = append([]string(nil), v...)
+	}
+
+	for k, v := range t.config.Headers {
+		req2.Header.Set(k, v)
+	}
+
+	if t.config.Username != "" || t.config.Password != "" {
+		req2.SetBasicAuth(t.config.Username, t.config.Password)
+	}
+
+	// The token file is read on every request so rotated tokens are used
+	// without a restart
+	if t.config.BearerTokenFile != "" {
+		token, err := ioutil.ReadFile(t.config.BearerTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bearer token: %v", err)
+		}
+		req2.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	if t.jwtSecret != nil {
+		token, err := newJWT(t.jwtSecret, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		req2.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return t.base.RoundTrip(req2)
+}
+
+// readJWTSecret reads a hex encoded 32 bytes secret, like the ones used by the
+// engine api.
+func readJWTSecret(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read jwt secret: %v", err)
+	}
+
+	str := strings.TrimPrefix(strings.TrimSpace(string(data)), "0x")
+
+	secret, err := hex.DecodeString(str)
+	if err != nil {
+		return nil, fmt.Errorf("jwt secret is not hex encoded: %v", err)
+	}
+
+	if len(secret) != 32 {
+		return nil, fmt.Errorf("jwt secret must be 32 bytes, found %d", len(secret))
+	}
+
+	return secret, nil
+}
+
+// newJWT returns a HS256 token with the issued-at claim, as required by the
+// engine api.
+func newJWT(secret []byte, now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := json.Marshal(map[string]int64{"iat": now.Unix()})
+	if err != nil {
+		return "", err
+	}
+
+	encoding := base64.RawURLEncoding
+	unsigned := encoding.EncodeToString(header) + "." + encoding.EncodeToString(claims)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+
+	return unsigned + "." + encoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// newTLSConfig returns the tls config for the endpoint or nil if there is
+// nothing to configure.
+func newTLSConfig(config *TLSConfig) (*tls.Config, error) {
+	if config == nil || (config.CAFile == "" && config.CertFile == "" && config.KeyFile == "" && !config.InsecureSkipVerify && config.ServerName == "") {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.InsecureSkipVerify,
+		ServerName:         config.ServerName,
+	}
+
+	if config.CAFile != "" {
+		data, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca file: %v", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in ca file %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
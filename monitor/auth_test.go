@@ -0,0 +1,175 @@
+package monitor
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// authServer keeps the Authorization header of the last request.
+type authServer struct {
+	*httptest.Server
+
+	lock          sync.Mutex
+	authorization string
+}
+
+func newAuthServer(t *testing.T) *authServer {
+	s := &authServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		s.authorization = r.Header.Get("Authorization")
+		s.lock.Unlock()
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// get sends a request with the transport and returns the Authorization
+// header received.
+func (s *authServer) get(t *testing.T, transport http.RoundTripper) string {
+	resp, err := (&http.Client{Transport: transport}).Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.authorization
+}
+
+func TestAuthTransportBearerTokenFile(t *testing.T) {
+	server := newAuthServer(t)
+	path := filepath.Join(t.TempDir(), "token")
+
+	transport, err := newAuthTransport(&RPCConfig{BearerTokenFile: path}, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The rotated token is used by the next request
+	for _, token := range []string{"token1", "token2"} {
+		if err := ioutil.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if authorization := server.get(t, transport); authorization != "Bearer "+token {
+			t.Errorf("expected the bearer token %s, got '%s'", token, authorization)
+		}
+	}
+}
+
+func TestAuthTransportJWT(t *testing.T) {
+	server := newAuthServer(t)
+
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	path := filepath.Join(t.TempDir(), "jwt.hex")
+	if err := ioutil.WriteFile(path, []byte("0x3031323334353637383961626364656630313233343536373839616263646566\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	transport, err := newAuthTransport(&RPCConfig{JWTSecretFile: path}, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authorization := server.get(t, transport)
+	parts := strings.Split(strings.TrimPrefix(authorization, "Bearer "), ".")
+	if !strings.HasPrefix(authorization, "Bearer ") || len(parts) != 3 {
+		t.Fatalf("expected a bearer jwt, got '%s'", authorization)
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if signature, err := base64.RawURLEncoding.DecodeString(parts[2]); err != nil || !hmac.Equal(signature, mac.Sum(nil)) {
+		t.Errorf("expected the token signed with the secret, got %s %v", parts[2], err)
+	}
+
+	var header map[string]string
+	var claims map[string]int64
+	for i, v := range []interface{}{&header, &claims} {
+		data, err := base64.RawURLEncoding.DecodeString(parts[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(data, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if header["alg"] != "HS256" {
+		t.Errorf("expected a HS256 token, got %v", header)
+	}
+	if iat := time.Unix(claims["iat"], 0); time.Since(iat) > time.Minute || time.Until(iat) > time.Second {
+		t.Errorf("expected the token issued now, got %s", iat)
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	// The handshakes rejected by the client are not logged
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Config.ErrorLog = testLogger
+	server.StartTLS()
+	defer server.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	invalidFile := filepath.Join(dir, "invalid.pem")
+	if err := ioutil.WriteFile(invalidFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		config  *TLSConfig
+		err     string
+		callErr string
+	}{
+		{"none", &TLSConfig{}, "", "certificate"},
+		{"ca file", &TLSConfig{CAFile: caFile}, "", ""},
+		{"insecure", &TLSConfig{InsecureSkipVerify: true}, "", ""},
+		{"invalid ca file", &TLSConfig{CAFile: invalidFile}, "no certificates found", ""},
+		{"missing key", &TLSConfig{CertFile: caFile}, "failed to load client certificate", ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tlsConfig, err := newTLSConfig(c.config)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Errorf("expected the error '%s', got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+			resp, err := client.Get(server.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if c.callErr == "" && err != nil {
+				t.Errorf("expected the server trusted, got %v", err)
+			}
+			if c.callErr != "" && (err == nil || !strings.Contains(err.Error(), c.callErr)) {
+				t.Errorf("expected the error '%s', got %v", c.callErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,441 @@
+package monitor
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Backfill output formats
+const (
+	BackfillHistory = "history"
+	BackfillCSV     = "csv"
+	BackfillJSON    = "jsonl"
+)
+
+// BackfillOptions are the blocks walked by the backfill and where the
+// records are written.
+type BackfillOptions struct {
+	// Blocks walked, both included. To defaults to the head of the node.
+	From uint64
+	To   uint64
+
+	// Max concurrent block requests
+	Concurrency int
+
+	// Output format (history, csv or jsonl) and file. The history format
+	// writes to the history database of the config. The csv and jsonl
+	// formats write to stdout if the file is empty, otherwise the file is
+	// replaced unless the backfill resumes from a checkpoint.
+	Format string
+	Output string
+
+	// File with the progress of the backfill, saved after every batch of
+	// blocks. A backfill with the same checkpoint resumes from it.
+	Checkpoint string
+}
+
+// backfillCheckpoint is the progress of a backfill.
+type backfillCheckpoint struct {
+	From uint64 `json:"from"`
+	To   uint64 `json:"to"`
+
+	// Next block to fetch
+	Next uint64 `json:"next"`
+
+	// Size of the output file when the checkpoint was saved. The records
+	// written after it are discarded on resume.
+	Offset int64 `json:"offset"`
+}
+
+// Blocks fetched per concurrent request in a batch
+const backfillBatchFactor = 10
+
+// Backfill fetches the blocks of the range and writes their records, the
+// same ones the monitor stores in the history. The checkpoint is saved after
+// every batch so an interrupted backfill resumes where it stopped.
+func Backfill(ctx context.Context, logger *log.Logger, config *Config, options *BackfillOptions) error {
+	if options.Concurrency <= 0 {
+		return fmt.Errorf("concurrency must be positive")
+	}
+
+	client, err := NewEthClient(log.New(ioutil.Discard, "", 0), config.RPCEndpoints(), config.RPCConfig, NewMetrics(config.MetricLabels(), nil), nil)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	checkpoint, err := loadBackfillCheckpoint(options.Checkpoint)
+	if err != nil {
+		return err
+	}
+
+	to := options.To
+	if checkpoint != nil {
+		if checkpoint.From != options.From || (to != 0 && checkpoint.To != to) {
+			return fmt.Errorf("checkpoint %s is for blocks %d to %d. Remove it to backfill a different range", options.Checkpoint, checkpoint.From, checkpoint.To)
+		}
+		to = checkpoint.To
+	} else {
+		if to == 0 {
+			head, err := client.BlockNumber(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to get the head of the node: %v", err)
+			}
+			to = head.Uint64()
+		}
+		if options.From > to {
+			return fmt.Errorf("from block %d after to block %d", options.From, to)
+		}
+		checkpoint = &backfillCheckpoint{From: options.From, To: to, Next: options.From}
+	}
+
+	if checkpoint.Next > to {
+		logger.Printf("Backfill of blocks %d to %d already complete", checkpoint.From, checkpoint.To)
+		return nil
+	}
+
+	writer, err := newBlockWriter(config, options, checkpoint.Offset)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	if checkpoint.Next != options.From {
+		logger.Printf("Resuming backfill from block %d", checkpoint.Next)
+	}
+
+	// The block time of the first block needs its parent
+	var parent *Block
+	if checkpoint.Next > 0 {
+		if parent, err = client.BlockByNumber(ctx, new(big.Int).SetUint64(checkpoint.Next-1)); err != nil {
+			return fmt.Errorf("failed to get block %d: %v", checkpoint.Next-1, err)
+		}
+	}
+
+	batchSize := uint64(options.Concurrency * backfillBatchFactor)
+	total := to - options.From + 1
+	start, startNext := time.Now(), checkpoint.Next
+
+	for checkpoint.Next <= to {
+		last := checkpoint.Next + batchSize - 1
+		if last > to || last < checkpoint.Next {
+			last = to
+		}
+
+		blocks, err := fetchBlocks(ctx, client, checkpoint.Next, last, options.Concurrency)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		for _, block := range blocks {
+			if err := writer.Write(NewBlockRecord(block, parent, now)); err != nil {
+				return err
+			}
+			parent = block
+		}
+
+		offset, err := writer.Flush()
+		if err != nil {
+			return err
+		}
+
+		checkpoint.Next = last + 1
+		checkpoint.Offset = offset
+		if err := saveBackfillCheckpoint(options.Checkpoint, checkpoint); err != nil {
+			return fmt.Errorf("failed to save the checkpoint: %v", err)
+		}
+
+		rate := float64(checkpoint.Next-startNext) / time.Since(start).Seconds()
+		logger.Printf("Backfilled blocks %d to %d (%d/%d, %.1f blocks/s)", checkpoint.From, last, checkpoint.Next-options.From, total, rate)
+	}
+
+	logger.Printf("Backfill of blocks %d to %d complete", checkpoint.From, checkpoint.To)
+	return nil
+}
+
+// fetchBlocks returns the blocks from first to last, in order, with at most
+// concurrency requests at the same time.
+func fetchBlocks(ctx context.Context, client *EthClient, first, last uint64, concurrency int) ([]*Block, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	blocks := make([]*Block, last-first+1)
+	numbers := make(chan uint64)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var fetchErr error
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range numbers {
+				block, err := client.BlockByNumber(ctx, new(big.Int).SetUint64(n))
+				if err != nil {
+					once.Do(func() {
+						fetchErr = fmt.Errorf("failed to get block %d: %v", n, err)
+						cancel()
+					})
+					continue
+				}
+				blocks[n-first] = block
+			}
+		}()
+	}
+
+feed:
+	for n := first; n <= last; n++ {
+		select {
+		case numbers <- n:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(numbers)
+	wg.Wait()
+
+	if fetchErr != nil {
+		return nil, fetchErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return blocks, nil
+}
+
+func loadBackfillCheckpoint(path string) (*backfillCheckpoint, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var checkpoint backfillCheckpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint %s: %v", path, err)
+	}
+
+	return &checkpoint, nil
+}
+
+// saveBackfillCheckpoint writes the checkpoint to a temporary file first so
+// a crash never leaves a partial one.
+func saveBackfillCheckpoint(path string, checkpoint *backfillCheckpoint) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return nil
+}
+
+// blockWriter writes the records of a backfill.
+type blockWriter interface {
+	Write(r *BlockRecord) error
+
+	// Flush writes the buffered records and returns the size of the
+	// output
+	Flush() (int64, error)
+
+	Close() error
+}
+
+func newBlockWriter(config *Config, options *BackfillOptions, offset int64) (blockWriter, error) {
+	switch options.Format {
+	case BackfillHistory:
+		history, err := NewHistory(config.HistoryConfig)
+		if err != nil {
+			return nil, err
+		}
+		if history == nil {
+			return nil, fmt.Errorf("history disabled. Set history.path to backfill the history")
+		}
+		return &historyWriter{history}, nil
+
+	case BackfillCSV, BackfillJSON:
+		out, err := openBackfillOutput(options.Output, offset)
+		if err != nil {
+			return nil, err
+		}
+		if options.Format == BackfillJSON {
+			return &jsonWriter{out: out, buf: bufio.NewWriter(out)}, nil
+		}
+
+		w := &csvWriter{out: out, csv: csv.NewWriter(out)}
+		if out.size == 0 {
+			if err := w.csv.Write(blockRecordColumns); err != nil {
+				return nil, err
+			}
+		}
+		return w, nil
+	}
+
+	return nil, fmt.Errorf("Format %s not found. 'history', 'csv' and 'jsonl' are the only valid options", options.Format)
+}
+
+// backfillOutput is the output file, or stdout, of the csv and jsonl
+// formats. It keeps the size written.
+type backfillOutput struct {
+	file *os.File
+	size int64
+}
+
+// openBackfillOutput opens the output file to append the records, discarding
+// the ones written after offset by an interrupted backfill.
+func openBackfillOutput(path string, offset int64) (*backfillOutput, error) {
+	if path == "" || path == "-" {
+		return &backfillOutput{file: os.Stdout}, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &backfillOutput{file: file, size: offset}, nil
+}
+
+func (o *backfillOutput) Write(p []byte) (int, error) {
+	n, err := o.file.Write(p)
+	o.size += int64(n)
+	return n, err
+}
+
+func (o *backfillOutput) Close() error {
+	if o.file == os.Stdout {
+		return nil
+	}
+	return o.file.Close()
+}
+
+type historyWriter struct {
+	history *History
+}
+
+func (w *historyWriter) Write(r *BlockRecord) error {
+	return w.history.RecordBlock(r)
+}
+
+func (w *historyWriter) Flush() (int64, error) {
+	return 0, nil
+}
+
+func (w *historyWriter) Close() error {
+	return w.history.Close()
+}
+
+type jsonWriter struct {
+	out *backfillOutput
+	buf *bufio.Writer
+}
+
+func (w *jsonWriter) Write(r *BlockRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	w.buf.Write(data)
+	return w.buf.WriteByte('\n')
+}
+
+func (w *jsonWriter) Flush() (int64, error) {
+	err := w.buf.Flush()
+	return w.out.size, err
+}
+
+func (w *jsonWriter) Close() error {
+	return w.out.Close()
+}
+
+var blockRecordColumns = []string{
+	"number", "hash", "parent_hash", "timestamp", "block_time", "transactions",
+	"gas_used", "gas_limit", "gas_used_ratio", "base_fee", "burnt_fees",
+}
+
+type csvWriter struct {
+	out *backfillOutput
+	csv *csv.Writer
+}
+
+func (w *csvWriter) Write(r *BlockRecord) error {
+	bigString := func(n *big.Int) string {
+		if n == nil {
+			return ""
+		}
+		return n.String()
+	}
+
+	return w.csv.Write([]string{
+		strconv.FormatUint(r.Number, 10),
+		r.Hash,
+		r.ParentHash,
+		r.Timestamp.UTC().Format(time.RFC3339),
+		strconv.FormatFloat(r.BlockTime, 'f', -1, 64),
+		strconv.Itoa(r.Transactions),
+		strconv.FormatUint(r.GasUsed, 10),
+		strconv.FormatUint(r.GasLimit, 10),
+		strconv.FormatFloat(r.GasUsedRatio, 'f', -1, 64),
+		bigString(r.BaseFee),
+		bigString(r.BurntFees),
+	})
+}
+
+func (w *csvWriter) Flush() (int64, error) {
+	w.csv.Flush()
+	return w.out.size, w.csv.Error()
+}
+
+func (w *csvWriter) Close() error {
+	return w.out.Close()
+}
@@ -0,0 +1,200 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// blockProxy forwards the requests to the node and fails the block requests
+// after the limit, if not zero.
+type blockProxy struct {
+	*httptest.Server
+
+	lock  sync.Mutex
+	calls int
+	limit int
+}
+
+func newBlockProxy(t *testing.T, addr string) *blockProxy {
+	target, err := url.Parse(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+
+	p := &blockProxy{}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		if strings.Contains(string(body), "eth_getBlockByNumber") {
+			p.lock.Lock()
+			p.calls++
+			failed := p.limit != 0 && p.calls > p.limit
+			p.lock.Unlock()
+
+			if failed {
+				http.Error(w, "busy", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	t.Cleanup(p.Close)
+
+	return p
+}
+
+func (p *blockProxy) setLimit(limit int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.calls, p.limit = 0, limit
+}
+
+// checkBackfillRecords fails unless the records are the blocks from..to,
+// once and in order, each one the child of the previous one.
+func checkBackfillRecords(t *testing.T, records []*BlockRecord, from, to uint64) {
+	if len(records) != int(to-from+1) {
+		t.Fatalf("expected %d records, got %d", to-from+1, len(records))
+	}
+	for i, r := range records {
+		if r.Number != from+uint64(i) {
+			t.Fatalf("record %d: expected block %d, got %d", i, from+uint64(i), r.Number)
+		}
+		if i > 0 && r.ParentHash != records[i-1].Hash {
+			t.Errorf("block %d is not the child of the previous record", r.Number)
+		}
+	}
+}
+
+func readCSVRecords(t *testing.T, path string) []*BlockRecord {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) == 0 || strings.Join(rows[0], ",") != strings.Join(blockRecordColumns, ",") {
+		t.Fatalf("expected the header first, got %v", rows)
+	}
+
+	records := []*BlockRecord{}
+	for _, row := range rows[1:] {
+		number, err := strconv.ParseUint(row[0], 10, 64)
+		if err != nil {
+			t.Fatalf("invalid row %v: %v", row, err)
+		}
+		records = append(records, &BlockRecord{Number: number, Hash: row[1], ParentHash: row[2]})
+	}
+	return records
+}
+
+func readJSONRecords(t *testing.T, path string) []*BlockRecord {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	records := []*BlockRecord{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var r BlockRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("invalid line '%s': %v", scanner.Text(), err)
+		}
+		records = append(records, &r)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestBackfillResume(t *testing.T) {
+	cases := []struct {
+		format string
+		read   func(t *testing.T, path string) []*BlockRecord
+	}{
+		{BackfillCSV, readCSVRecords},
+		{BackfillJSON, readJSONRecords},
+	}
+
+	for _, c := range cases {
+		t.Run(c.format, func(t *testing.T) {
+			node, _ := startTestNode(t)
+			proxy := newBlockProxy(t, node.URL())
+
+			config := DefaultConfig()
+			config.Endpoint = proxy.URL
+			config.RPCConfig.Retries = 0
+
+			dir := t.TempDir()
+			options := &BackfillOptions{
+				From:        960,
+				To:          1000,
+				Concurrency: 1,
+				Format:      c.format,
+				Output:      filepath.Join(dir, "blocks."+c.format),
+				Checkpoint:  filepath.Join(dir, "checkpoint.json"),
+			}
+
+			// The parent and two batches of 10 blocks, the third one fails
+			proxy.setLimit(21)
+			if err := Backfill(context.Background(), testLogger, config, options); err == nil {
+				t.Fatal("expected the backfill interrupted")
+			}
+
+			checkpoint, err := loadBackfillCheckpoint(options.Checkpoint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if checkpoint == nil || checkpoint.Next != 980 {
+				t.Fatalf("expected the checkpoint at block 980, got %+v", checkpoint)
+			}
+			checkBackfillRecords(t, c.read(t, options.Output), 960, 979)
+
+			// Records written after the checkpoint by a crash, longer than
+			// the rest of the backfill, are discarded
+			file, err := os.OpenFile(options.Output, os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := file.WriteString(strings.Repeat("980,partial\n", 1000)); err != nil {
+				t.Fatal(err)
+			}
+			file.Close()
+
+			proxy.setLimit(0)
+			if err := Backfill(context.Background(), testLogger, config, options); err != nil {
+				t.Fatal(err)
+			}
+			checkBackfillRecords(t, c.read(t, options.Output), 960, 1000)
+
+			// A complete backfill is not run again
+			if err := Backfill(context.Background(), testLogger, config, options); err != nil {
+				t.Fatal(err)
+			}
+			checkBackfillRecords(t, c.read(t, options.Output), 960, 1000)
+		})
+	}
+}
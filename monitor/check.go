@@ -0,0 +1,77 @@
+package monitor
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"math/big"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// CheckConfig runs the checks of the config that need no network: the
+// validation and the creation of the rpc clients, which reads the tls and
+// jwt secret files.
+func CheckConfig(config *Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	logger := log.New(ioutil.Discard, "", 0)
+
+	var errors error
+	for _, endpoint := range config.RPCEndpoints() {
+		if _, err := NewEthClient(logger, []string{endpoint}, config.RPCConfig, NewMetrics(config.MetricLabels(), nil), nil); err != nil {
+			errors = multierror.Append(errors, &ValidationError{Key: "rpc", Err: err})
+		}
+	}
+
+	return errors
+}
+
+// EndpointStatus is the result of the connectivity check of an endpoint.
+type EndpointStatus struct {
+	// Endpoint without credentials
+	Endpoint string
+
+	ClientVersion string
+	Chain         string
+	BlockNumber   *big.Int
+
+	Err error
+}
+
+// CheckEndpoints connects to every endpoint of the config, in order of
+// preference, and reads the client version, chain and last block.
+func CheckEndpoints(ctx context.Context, config *Config) []*EndpointStatus {
+	logger := log.New(ioutil.Discard, "", 0)
+
+	statuses := []*EndpointStatus{}
+
+	for _, endpoint := range config.RPCEndpoints() {
+		statuses = append(statuses, checkEndpoint(ctx, logger, config, endpoint))
+	}
+
+	return statuses
+}
+
+func checkEndpoint(ctx context.Context, logger *log.Logger, config *Config, endpoint string) *EndpointStatus {
+	status := &EndpointStatus{Endpoint: newRPCEndpoint(endpoint).label}
+
+	client, err := NewEthClient(logger, []string{endpoint}, config.RPCConfig, NewMetrics(config.MetricLabels(), nil), nil)
+	if err != nil {
+		status.Err = err
+		return status
+	}
+	defer client.Close()
+
+	if status.ClientVersion, status.Err = client.ClientVersion(ctx); status.Err != nil {
+		return status
+	}
+	if status.Chain, status.Err = client.Chain(ctx); status.Err != nil {
+		return status
+	}
+	status.BlockNumber, status.Err = client.BlockNumber(ctx)
+
+	return status
+}
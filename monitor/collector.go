@@ -0,0 +1,183 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// Collector gathers a group of metrics from the node. Every collector runs
+// on its own goroutine and interval.
+type Collector interface {
+	// Name of the collector, used in the config and metrics
+	Name() string
+
+	// Default interval between collections with the config
+	Interval(config *Config) time.Duration
+
+	// Collect gathers the metrics. ctx expires after the collector timeout.
+	Collect(ctx context.Context, client *EthClient) error
+}
+
+type collectorFactory func(m *Monitor) Collector
+
+var (
+	collectorFactories = map[string]collectorFactory{}
+	collectorDefaults  = map[string]bool{}
+)
+
+// registerCollector makes a collector available. Collectors enabled by
+// default run unless disabled in the config.
+func registerCollector(name string, enabledByDefault bool, factory collectorFactory) {
+	collectorFactories[name] = factory
+	collectorDefaults[name] = enabledByDefault
+}
+
+// scheduledCollector is an enabled collector with its interval and timeout.
+type scheduledCollector struct {
+	collector Collector
+	interval  time.Duration
+	timeout   time.Duration
+}
+
+func (m *Monitor) setupCollectors(config *Config, cycleTimeout time.Duration) ([]*scheduledCollector, error) {
+	for name := range config.Collectors {
+		if _, ok := collectorFactories[name]; !ok {
+			return nil, fmt.Errorf("Collector %s not found. Valid options are: %s", name, strings.Join(collectorNames(), ", "))
+		}
+	}
+
+	collectors := []*scheduledCollector{}
+
+	for _, name := range collectorNames() {
+		collectorConfig := config.Collectors[name]
+		if collectorConfig == nil {
+			collectorConfig = &CollectorConfig{}
+		}
+
+		enabled := collectorDefaults[name]
+		if collectorConfig.Enabled != nil {
+			enabled = *collectorConfig.Enabled
+		}
+		if !enabled {
+			continue
+		}
+
+		collector := collectorFactories[name](m)
+
+		scheduled := &scheduledCollector{
+			collector: collector,
+			interval:  collector.Interval(config),
+			timeout:   cycleTimeout,
+		}
+
+		var err error
+		if collectorConfig.Interval != "" {
+			if scheduled.interval, err = time.ParseDuration(collectorConfig.Interval); err != nil {
+				return nil, fmt.Errorf("invalid interval '%s' for collector %s: %v", collectorConfig.Interval, name, err)
+			}
+		}
+		if collectorConfig.Timeout != "" {
+			if scheduled.timeout, err = time.ParseDuration(collectorConfig.Timeout); err != nil {
+				return nil, fmt.Errorf("invalid timeout '%s' for collector %s: %v", collectorConfig.Timeout, name, err)
+			}
+		}
+
+		collectors = append(collectors, scheduled)
+	}
+
+	return collectors, nil
+}
+
+func collectorNames() []string {
+	names := []string{}
+	for name := range collectorFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// runCollector runs the collector every interval while the node is
+// connected.
+func (m *Monitor) runCollector(ctx context.Context, s *scheduledCollector) {
+	defer m.wg.Done()
+
+	for {
+		select {
+		case <-time.After(s.interval):
+		case <-ctx.Done():
+			return
+		}
+
+		if !m.isConnected() {
+			continue
+		}
+
+		m.collect(ctx, s)
+	}
+}
+
+// collect runs the collector once and keeps its errors. A connection error
+// of the node, after the retries and the failover, disconnects it.
+func (m *Monitor) collect(ctx context.Context, s *scheduledCollector) {
+	name := s.collector.Name()
+
+	collectCtx, cancel := context.WithTimeout(ctx, s.timeout)
+	collectCtx, span := m.tracer.Start(collectCtx, "collect "+name, SpanKindInternal)
+	span.SetAttribute("collector", name)
+
+	start := time.Now()
+	err := s.collector.Collect(collectCtx, m.client())
+	duration := time.Since(start)
+
+	span.End(err)
+	cancel()
+
+	m.metrics.observeCollector(name, duration, err)
+
+	if err != nil {
+		m.logger.Printf("Collector %s errors: %v", name, err)
+
+		if errorClass(err) == errorClassConnection || strings.Contains(err.Error(), "connection refused") {
+			m.logger.Printf("Node may be down")
+			m.setConnected(false)
+		}
+	}
+
+	m.setCollectorError(name, err)
+}
+
+func (m *Monitor) setCollectorError(name string, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err == nil {
+		delete(m.collectorErrors, name)
+	} else {
+		m.collectorErrors[name] = err
+	}
+}
+
+// lastCollectorErrors returns the errors of the last run of every collector.
+func (m *Monitor) lastCollectorErrors() error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	names := []string{}
+	for name := range m.collectorErrors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errors error
+	for _, name := range names {
+		errors = multierror.Append(errors, fmt.Errorf("%s: %v", name, m.collectorErrors[name]))
+	}
+
+	return errors
+}
@@ -0,0 +1,163 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+func init() {
+	registerCollector("peers", true, newPeersCollector)
+	registerCollector("block", true, newBlockCollector)
+	registerCollector("syncing", true, newSyncingCollector)
+}
+
+// peersCollector exports the number of peers of the node.
+type peersCollector struct {
+	m *Monitor
+}
+
+func newPeersCollector(m *Monitor) Collector {
+	return &peersCollector{m}
+}
+
+func (c *peersCollector) Name() string {
+	return "peers"
+}
+
+func (c *peersCollector) Interval(config *Config) time.Duration {
+	return config.RPCInterval.Duration()
+}
+
+func (c *peersCollector) Collect(ctx context.Context, client *EthClient) error {
+	peers, err := client.PeerCount(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.m.metrics.setGauge(c.m.metrics.peers, []string{"peers"}, float64(peers))
+	c.m.setPeers(peers)
+	return nil
+}
+
+// blockCollector exports the head of the node and the blocks behind the
+// reference (etherscan), which decides whether the node is synced.
+type blockCollector struct {
+	m *Monitor
+
+	// Last block number
+	lastBlock *Block
+}
+
+func newBlockCollector(m *Monitor) Collector {
+	return &blockCollector{m: m}
+}
+
+func (c *blockCollector) Name() string {
+	return "block"
+}
+
+func (c *blockCollector) Interval(config *Config) time.Duration {
+	return config.RPCInterval.Duration()
+}
+
+func (c *blockCollector) Collect(ctx context.Context, client *EthClient) error {
+	var errors error
+
+	m := c.m
+
+	// BlockNumber
+
+	blockNumber, err := client.BlockNumber(ctx)
+	if err != nil {
+		return err
+	}
+
+	m.metrics.setGauge(m.metrics.blockNumber, []string{"blockNumber"}, float64(blockNumber.Int64()))
+	m.setBlockNumber(blockNumber.Uint64())
+
+	// Block
+
+	// The fields that failed to parse are reported, the block is still used
+	block, err := client.BlockByNumber(ctx, blockNumber)
+	if err != nil {
+		errors = multierror.Append(errors, err)
+	}
+	if block != nil {
+		if c.lastBlock != nil && c.lastBlock.Timestamp != nil && block.Timestamp != nil {
+			blockTime := block.Timestamp.Sub(*c.lastBlock.Timestamp)
+			m.metrics.setGauge(m.metrics.blockTime, []string{"blocktime"}, blockTime.Seconds())
+		}
+		c.lastBlock = block
+
+		if block.Timestamp != nil {
+			m.setHeadTime(*block.Timestamp)
+		}
+
+		if m.history != nil {
+			if err := m.recordBlocks(ctx, client, block); err != nil {
+				errors = multierror.Append(errors, fmt.Errorf("failed to record the block history: %v", err))
+			}
+		}
+	}
+
+	// Etherscan
+
+	realBlockNumber, err := m.reference().BlockNumber(ctx)
+	if err != nil {
+		return multierror.Append(errors, err)
+	}
+
+	blocksbehind := Sub(realBlockNumber, blockNumber)
+	m.metrics.setGauge(m.metrics.blocksBehind, []string{"blocksbehind"}, float64(blocksbehind.Int64()))
+
+	synced := isSyncedWithin(blocksbehind.Int64(), m.currentConfig().SyncThreshold)
+
+	if m.setSynced(synced, blocksbehind.Int64()) {
+		m.logger.Printf("State changed. Is Synced?: %v", synced)
+	}
+
+	return errors
+}
+
+// syncingCollector exports the sync progress reported by the node.
+type syncingCollector struct {
+	m *Monitor
+}
+
+func newSyncingCollector(m *Monitor) Collector {
+	return &syncingCollector{m}
+}
+
+func (c *syncingCollector) Name() string {
+	return "syncing"
+}
+
+func (c *syncingCollector) Interval(config *Config) time.Duration {
+	return config.RPCInterval.Duration()
+}
+
+func (c *syncingCollector) Collect(ctx context.Context, client *EthClient) error {
+	sync, err := client.Syncing(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get the sync status: %v", err)
+	}
+
+	metrics := c.m.metrics
+
+	c.m.setSync(sync)
+	metrics.setBool(metrics.syncing, []string{"syncing"}, sync != nil)
+	if sync == nil {
+		return nil
+	}
+
+	metrics.setGauge(metrics.syncCurrentBlock, []string{"sync", "currentBlock"}, float64(sync.CurrentBlock.Int64()))
+	metrics.setGauge(metrics.syncHighestBlock, []string{"sync", "highestBlock"}, float64(sync.HighestBlock.Int64()))
+	metrics.setGauge(metrics.syncStartingBlock, []string{"sync", "startingBlock"}, float64(sync.StartingBlock.Int64()))
+	metrics.setGauge(metrics.warpChunksAmount, []string{"sync", "warpChunksAmount"}, float64(sync.WarpChunksAmount.Int64()))
+	metrics.setGauge(metrics.warpChunksProcessed, []string{"sync", "warpChunksProcessed"}, float64(sync.WarpChunksProcessed.Int64()))
+
+	return nil
+}
@@ -1,22 +1,139 @@
 package monitor
 
 import (
+	"encoding/json"
+	"fmt"
 	"io"
+	"net"
+	"net/url"
 	"os"
+	"strings"
 	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/prometheus/common/model"
+)
+
+// Duration is a time.Duration written as a duration string (i.e. 5s) in
+// the config files.
+type Duration time.Duration
+
+// Duration returns the duration as a time.Duration.
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("duration must be a string (i.e. 5s)")
+	}
+
+	duration, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(duration)
+	return nil
+}
+
+// Consul check modes
+const (
+	CheckModeHTTP = "http"
+	CheckModeTTL  = "ttl"
 )
 
+// ServiceConfig is the service announced by every discovery backend.
+type ServiceConfig struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+
+	// Add tags derived from the node state (synced/syncing, chain,
+	// client and archive/full) to the static tags
+	DynamicTags bool `json:"dynamic_tags"`
+
+	// Static meta, added to the node name, chain and client version
+	Meta map[string]string `json:"meta"`
+
+	// Address and port advertised for the service. If the port is not set
+	// the port of the first http endpoint is used, it is required with ipc
+	// endpoints only.
+	Address string `json:"address"`
+	Port    int    `json:"port"`
+
+	// Host used to reach the exporter api (i.e. the /synced check).
+	// Defaults to the service address or the bind address.
+	CheckAddress string `json:"check_address"`
+
+	// Interval to verify the service is still registered in the backend
+	RegisterInterval string `json:"register_interval"`
+}
+
+func DefaultServiceConfig() *ServiceConfig {
+	return &ServiceConfig{
+		Name:             "pool",
+		Tags:             []string{"pool", "parity"},
+		Meta:             map[string]string{},
+		RegisterInterval: "30s",
+	}
+}
+
+func (c *ServiceConfig) Merge(c1 *ServiceConfig) {
+	if c1.Name != "" {
+		c.Name = c1.Name
+	}
+	if len(c1.Tags) != 0 {
+		c.Tags = c1.Tags
+	}
+	if c1.DynamicTags {
+		c.DynamicTags = c1.DynamicTags
+	}
+	for name, value := range c1.Meta {
+		if c.Meta == nil {
+			c.Meta = map[string]string{}
+		}
+		c.Meta[name] = value
+	}
+	if c1.Address != "" {
+		c.Address = c1.Address
+	}
+	if c1.Port != 0 {
+		c.Port = c1.Port
+	}
+	if c1.CheckAddress != "" {
+		c.CheckAddress = c1.CheckAddress
+	}
+	if c1.RegisterInterval != "" {
+		c.RegisterInterval = c1.RegisterInterval
+	}
+}
+
 type ConsulConfig struct {
-	Address     string   `json:"address"`
-	ServiceName string   `json:"service_name"`
-	Tags        []string `json:"tags"`
+	Address string `json:"address"`
+
+	// Check mode, either 'http' (consul polls /synced) or 'ttl' (the
+	// monitor pushes its health verdict)
+	CheckMode string `json:"check_mode"`
+
+	// Check options, as consul durations (i.e. 10s)
+	CheckInterval   string `json:"check_interval"`
+	CheckTimeout    string `json:"check_timeout"`
+	CheckTTL        string `json:"check_ttl"`
+	DeregisterAfter string `json:"deregister_after"`
 }
 
 func DefaultConsulConfig() *ConsulConfig {
 	return &ConsulConfig{
-		Address:     "http://127.0.0.1:8500",
-		ServiceName: "pool",
-		Tags:        []string{"pool", "parity"},
+		Address:       "http://127.0.0.1:8500",
+		CheckMode:     CheckModeHTTP,
+		CheckInterval: "1s",
+		CheckTimeout:  "5s",
+		CheckTTL:      "30s",
 	}
 }
 
@@ -24,39 +141,623 @@ func (c *ConsulConfig) Merge(c1 *ConsulConfig) {
 	if c1.Address != "" {
 		c.Address = c1.Address
 	}
+	if c1.CheckMode != "" {
+		c.CheckMode = c1.CheckMode
+	}
+	if c1.CheckInterval != "" {
+		c.CheckInterval = c1.CheckInterval
+	}
+	if c1.CheckTimeout != "" {
+		c.CheckTimeout = c1.CheckTimeout
+	}
+	if c1.CheckTTL != "" {
+		c.CheckTTL = c1.CheckTTL
+	}
+	if c1.DeregisterAfter != "" {
+		c.DeregisterAfter = c1.DeregisterAfter
+	}
+}
+
+type RPCConfig struct {
+	// Timeout of each rpc call, as a duration (i.e. 5s)
+	Timeout string `json:"timeout"`
+
+	// Timeout of a whole collection cycle
+	CycleTimeout string `json:"cycle_timeout"`
+
+	// Retries of failed calls and base backoff between them
+	Retries      int    `json:"retries"`
+	RetryBackoff string `json:"retry_backoff"`
+
+	// Interval to probe the preferred endpoints while running on a backup
+	FailbackInterval string `json:"failback_interval"`
+
+	// Connection pool
+	MaxIdleConns    int    `json:"max_idle_conns"`
+	IdleConnTimeout string `json:"idle_conn_timeout"`
+
+	// Custom headers sent on every call
+	Headers map[string]string `json:"headers"`
+
+	// Basic auth
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	// File with a bearer token, read on every call
+	BearerTokenFile string `json:"bearer_token_file"`
+
+	// File with the hex encoded secret used to sign HS256 jwt tokens
+	// (engine api)
+	JWTSecretFile string `json:"jwt_secret_file"`
+
+	TLSConfig *TLSConfig `json:"tls"`
+
+	// Append every request and response to a fixture file (json lines)
+	RecordFile string `json:"record_file"`
+
+	// Answer the requests with the responses of a fixture file instead
+	// of calling the node
+	ReplayFile string `json:"replay_file"`
+}
+
+type TLSConfig struct {
+	CAFile             string `json:"ca_file"`
+	CertFile           string `json:"cert_file"`
+	KeyFile            string `json:"key_file"`
+	ServerName         string `json:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+func (c *TLSConfig) Merge(c1 *TLSConfig) {
+	if c1.CAFile != "" {
+		c.CAFile = c1.CAFile
+	}
+	if c1.CertFile != "" {
+		c.CertFile = c1.CertFile
+	}
+	if c1.KeyFile != "" {
+		c.KeyFile = c1.KeyFile
+	}
+	if c1.ServerName != "" {
+		c.ServerName = c1.ServerName
+	}
+	if c1.InsecureSkipVerify {
+		c.InsecureSkipVerify = c1.InsecureSkipVerify
+	}
+}
+
+func DefaultRPCConfig() *RPCConfig {
+	return &RPCConfig{
+		Timeout:          "5s",
+		CycleTimeout:     "30s",
+		Retries:          2,
+		RetryBackoff:     "200ms",
+		FailbackInterval: "1m",
+		MaxIdleConns:     10,
+		IdleConnTimeout:  "90s",
+		TLSConfig:        &TLSConfig{},
+	}
+}
+
+func (c *RPCConfig) Merge(c1 *RPCConfig) {
+	if c1.Timeout != "" {
+		c.Timeout = c1.Timeout
+	}
+	if c1.CycleTimeout != "" {
+		c.CycleTimeout = c1.CycleTimeout
+	}
+	if c1.Retries != 0 {
+		c.Retries = c1.Retries
+	}
+	if c1.RetryBackoff != "" {
+		c.RetryBackoff = c1.RetryBackoff
+	}
+	if c1.FailbackInterval != "" {
+		c.FailbackInterval = c1.FailbackInterval
+	}
+	if c1.MaxIdleConns != 0 {
+		c.MaxIdleConns = c1.MaxIdleConns
+	}
+	if c1.IdleConnTimeout != "" {
+		c.IdleConnTimeout = c1.IdleConnTimeout
+	}
+	if len(c1.Headers) != 0 {
+		c.Headers = c1.Headers
+	}
+	if c1.Username != "" {
+		c.Username = c1.Username
+	}
+	if c1.Password != "" {
+		c.Password = c1.Password
+	}
+	if c1.BearerTokenFile != "" {
+		c.BearerTokenFile = c1.BearerTokenFile
+	}
+	if c1.JWTSecretFile != "" {
+		c.JWTSecretFile = c1.JWTSecretFile
+	}
+	if c1.TLSConfig != nil {
+		c.TLSConfig.Merge(c1.TLSConfig)
+	}
+	if c1.RecordFile != "" {
+		c.RecordFile = c1.RecordFile
+	}
+	if c1.ReplayFile != "" {
+		c.ReplayFile = c1.ReplayFile
+	}
+}
+
+type CollectorConfig struct {
+	// Enable or disable the collector. Unset uses the collector default.
+	Enabled *bool `json:"enabled"`
+
+	// Interval between collections and timeout of each one, as durations
+	// (i.e. 5s)
+	Interval string `json:"interval"`
+	Timeout  string `json:"timeout"`
+}
+
+func (c *CollectorConfig) Merge(c1 *CollectorConfig) {
+	if c1.Enabled != nil {
+		c.Enabled = c1.Enabled
+	}
+	if c1.Interval != "" {
+		c.Interval = c1.Interval
+	}
+	if c1.Timeout != "" {
+		c.Timeout = c1.Timeout
+	}
+}
+
+type FileSDConfig struct {
+	// Path of the prometheus file_sd json file
+	Path string `json:"path"`
+}
+
+func DefaultFileSDConfig() *FileSDConfig {
+	return &FileSDConfig{
+		Path: "ethereum-exporter.json",
+	}
+}
+
+func (c *FileSDConfig) Merge(c1 *FileSDConfig) {
+	if c1.Path != "" {
+		c.Path = c1.Path
+	}
+}
+
+type EtcdConfig struct {
+	// Address of the etcd json gateway
+	Address string `json:"address"`
+
+	// Prefix of the service keys
+	Prefix string `json:"prefix"`
+
+	// TTL in seconds of the lease attached to the service key
+	TTL int `json:"ttl"`
+}
+
+func DefaultEtcdConfig() *EtcdConfig {
+	return &EtcdConfig{
+		Address: "http://127.0.0.1:2379",
+		Prefix:  "/services/",
+		TTL:     60,
+	}
+}
+
+func (c *EtcdConfig) Merge(c1 *EtcdConfig) {
+	if c1.Address != "" {
+		c.Address = c1.Address
+	}
+	if c1.Prefix != "" {
+		c.Prefix = c1.Prefix
+	}
+	if c1.TTL != 0 {
+		c.TTL = c1.TTL
+	}
+}
+
+type GoMetricsConfig struct {
+	// Name prefixed to the go-metrics keys
+	ServiceName string `json:"service_name"`
+
+	// Keep the metrics in memory. They are dumped to stderr on SIGUSR1.
+	Inmem bool `json:"inmem"`
+
+	// Push the metrics to statsd and dogstatsd. The labels are appended to
+	// the statsd keys and sent as dogstatsd tags.
+	StatsdConfig    *StatsdConfig `json:"statsd"`
+	DogStatsdConfig *StatsdConfig `json:"dogstatsd"`
+}
+
+func DefaultGoMetricsConfig() *GoMetricsConfig {
+	return &GoMetricsConfig{
+		ServiceName:     "ethereum-exporter",
+		StatsdConfig:    DefaultStatsdConfig(),
+		DogStatsdConfig: DefaultStatsdConfig(),
+	}
+}
+
+func (c *GoMetricsConfig) Merge(c1 *GoMetricsConfig) {
 	if c1.ServiceName != "" {
 		c.ServiceName = c1.ServiceName
 	}
-	if len(c1.Tags) != 0 {
-		c.Tags = c1.Tags
+	if c1.Inmem {
+		c.Inmem = c1.Inmem
+	}
+	if c1.StatsdConfig != nil {
+		c.StatsdConfig.Merge(c1.StatsdConfig)
+	}
+	if c1.DogStatsdConfig != nil {
+		c.DogStatsdConfig.Merge(c1.DogStatsdConfig)
+	}
+}
+
+type StatsdConfig struct {
+	// Address of the server, either host:port or udp://host:port for udp
+	// or unixgram:///path/to/socket for a unix datagram socket. The sink
+	// is disabled if empty.
+	Address string `json:"address"`
+
+	// Interval between flushes of the buffered metrics
+	FlushInterval string `json:"flush_interval"`
+
+	// Renames labels when sent as tags (i.e. node to host)
+	TagMapping map[string]string `json:"tag_mapping"`
+}
+
+func DefaultStatsdConfig() *StatsdConfig {
+	return &StatsdConfig{
+		FlushInterval: "1s",
+		TagMapping:    map[string]string{},
+	}
+}
+
+func (c *StatsdConfig) Merge(c1 *StatsdConfig) {
+	if c1.Address != "" {
+		c.Address = c1.Address
+	}
+	if c1.FlushInterval != "" {
+		c.FlushInterval = c1.FlushInterval
+	}
+	for label, tag := range c1.TagMapping {
+		if c.TagMapping == nil {
+			c.TagMapping = map[string]string{}
+		}
+		c.TagMapping[label] = tag
+	}
+}
+
+type PushConfig struct {
+	// Url where the metrics are written. The output is disabled if empty.
+	URL string `json:"url"`
+
+	// Interval between pushes and timeout of each request
+	Interval string `json:"interval"`
+	Timeout  string `json:"timeout"`
+
+	// Max samples (remote write) or lines (influxdb) per request
+	BatchSize int `json:"batch_size"`
+
+	// Retries of a failed request and base backoff between them
+	Retries      int    `json:"retries"`
+	RetryBackoff string `json:"retry_backoff"`
+
+	// Credentials and extra headers of the requests
+	Username string            `json:"username"`
+	Password string            `json:"password"`
+	Headers  map[string]string `json:"headers"`
+
+	// Directory where the batches are kept while the remote is unavailable.
+	// They are kept in memory if empty.
+	BufferDir string `json:"buffer_dir"`
+
+	// Max batches buffered. The oldest are dropped first.
+	MaxBuffered int `json:"max_buffered"`
+}
+
+func DefaultPushConfig() *PushConfig {
+	return &PushConfig{
+		Interval:     "15s",
+		Timeout:      "10s",
+		BatchSize:    500,
+		Retries:      3,
+		RetryBackoff: "1s",
+		Headers:      map[string]string{},
+		MaxBuffered:  1000,
+	}
+}
+
+func (c *PushConfig) Merge(c1 *PushConfig) {
+	if c1.URL != "" {
+		c.URL = c1.URL
+	}
+	if c1.Interval != "" {
+		c.Interval = c1.Interval
+	}
+	if c1.Timeout != "" {
+		c.Timeout = c1.Timeout
+	}
+	if c1.BatchSize != 0 {
+		c.BatchSize = c1.BatchSize
+	}
+	if c1.Retries != 0 {
+		c.Retries = c1.Retries
+	}
+	if c1.RetryBackoff != "" {
+		c.RetryBackoff = c1.RetryBackoff
+	}
+	if c1.Username != "" {
+		c.Username = c1.Username
+	}
+	if c1.Password != "" {
+		c.Password = c1.Password
+	}
+	for k, v := range c1.Headers {
+		if c.Headers == nil {
+			c.Headers = map[string]string{}
+		}
+		c.Headers[k] = v
+	}
+	if c1.BufferDir != "" {
+		c.BufferDir = c1.BufferDir
+	}
+	if c1.MaxBuffered != 0 {
+		c.MaxBuffered = c1.MaxBuffered
+	}
+}
+
+// redacted returns a copy of the config without credentials.
+func (c *PushConfig) redacted() *PushConfig {
+	c1 := *c
+
+	c1.URL = redactURL(c.URL)
+	if c1.Password != "" {
+		c1.Password = redacted
+	}
+	c1.Headers = redactHeaders(c.Headers)
+
+	return &c1
+}
+
+type OTLPConfig struct {
+	// Base url of the OTLP/HTTP collector. /v1/metrics and /v1/traces are
+	// appended unless the signal endpoints are set. The exporter is
+	// disabled if all of them are empty.
+	Endpoint        string `json:"endpoint"`
+	MetricsEndpoint string `json:"metrics_endpoint"`
+	TracesEndpoint  string `json:"traces_endpoint"`
+
+	// Headers of the export requests (i.e. api keys)
+	Headers map[string]string `json:"headers"`
+
+	// Resource of the metrics and spans
+	ServiceName        string            `json:"service_name"`
+	ResourceAttributes map[string]string `json:"resource_attributes"`
+
+	// Timeout of the export requests and interval between metric exports
+	Timeout         string `json:"timeout"`
+	MetricsInterval string `json:"metrics_interval"`
+
+	// Disable one of the signals
+	DisableMetrics bool `json:"disable_metrics"`
+	DisableTraces  bool `json:"disable_traces"`
+}
+
+func DefaultOTLPConfig() *OTLPConfig {
+	return &OTLPConfig{
+		Headers:            map[string]string{},
+		ServiceName:        "ethereum-exporter",
+		ResourceAttributes: map[string]string{},
+		Timeout:            "10s",
+		MetricsInterval:    "60s",
+	}
+}
+
+func (c *OTLPConfig) Merge(c1 *OTLPConfig) {
+	if c1.Endpoint != "" {
+		c.Endpoint = c1.Endpoint
+	}
+	if c1.MetricsEndpoint != "" {
+		c.MetricsEndpoint = c1.MetricsEndpoint
+	}
+	if c1.TracesEndpoint != "" {
+		c.TracesEndpoint = c1.TracesEndpoint
+	}
+	for k, v := range c1.Headers {
+		if c.Headers == nil {
+			c.Headers = map[string]string{}
+		}
+		c.Headers[k] = v
+	}
+	if c1.ServiceName != "" {
+		c.ServiceName = c1.ServiceName
+	}
+	for k, v := range c1.ResourceAttributes {
+		if c.ResourceAttributes == nil {
+			c.ResourceAttributes = map[string]string{}
+		}
+		c.ResourceAttributes[k] = v
+	}
+	if c1.Timeout != "" {
+		c.Timeout = c1.Timeout
+	}
+	if c1.MetricsInterval != "" {
+		c.MetricsInterval = c1.MetricsInterval
+	}
+	if c1.DisableMetrics {
+		c.DisableMetrics = c1.DisableMetrics
+	}
+	if c1.DisableTraces {
+		c.DisableTraces = c1.DisableTraces
+	}
+}
+
+type HistoryConfig struct {
+	// Path of the database with the history of the blocks and the node.
+	// The history is disabled if empty.
+	Path string `json:"path"`
+
+	// Interval between snapshots of the node state
+	SnapshotInterval string `json:"snapshot_interval"`
+
+	// Retention of the records. Older blocks and snapshots are removed and
+	// only the last max_blocks blocks are kept. Zero keeps them forever.
+	MaxAge    string `json:"max_age"`
+	MaxBlocks int    `json:"max_blocks"`
+}
+
+func DefaultHistoryConfig() *HistoryConfig {
+	return &HistoryConfig{
+		SnapshotInterval: "1m",
+		MaxAge:           "720h",
+		MaxBlocks:        1000000,
+	}
+}
+
+func (c *HistoryConfig) Merge(c1 *HistoryConfig) {
+	if c1.Path != "" {
+		c.Path = c1.Path
+	}
+	if c1.SnapshotInterval != "" {
+		c.SnapshotInterval = c1.SnapshotInterval
+	}
+	if c1.MaxAge != "" {
+		c.MaxAge = c1.MaxAge
+	}
+	if c1.MaxBlocks != 0 {
+		c.MaxBlocks = c1.MaxBlocks
+	}
+}
+
+type EtherscanConfig struct {
+	// Api key added to the requests
+	APIKey string `json:"api_key"`
+
+	// Time the head of the chain is reused, by all the nodes on the same
+	// chain
+	CacheTTL string `json:"cache_ttl"`
+
+	// Time without requests after a rate limit response, doubled on every
+	// consecutive one up to max_backoff
+	RateLimitBackoff string `json:"rate_limit_backoff"`
+	MaxBackoff       string `json:"max_backoff"`
+}
+
+func DefaultEtherscanConfig() *EtherscanConfig {
+	return &EtherscanConfig{
+		CacheTTL:         "2s",
+		RateLimitBackoff: "5s",
+		MaxBackoff:       "5m",
+	}
+}
+
+func (c *EtherscanConfig) Merge(c1 *EtherscanConfig) {
+	if c1.APIKey != "" {
+		c.APIKey = c1.APIKey
+	}
+	if c1.CacheTTL != "" {
+		c.CacheTTL = c1.CacheTTL
+	}
+	if c1.RateLimitBackoff != "" {
+		c.RateLimitBackoff = c1.RateLimitBackoff
+	}
+	if c1.MaxBackoff != "" {
+		c.MaxBackoff = c1.MaxBackoff
 	}
 }
 
 type Config struct {
-	LogOutput   io.Writer
-	BindAddr    string `json:"bind"`
-	BindPort    int    `json:"port"`
-	Endpoint    string `json:"endpoint"`
-	NodeName    string `json:"nodename"`
-	RPCInterval time.Duration
+	LogOutput io.Writer `json:"-"`
+	BindAddr  string    `json:"bind"`
+	BindPort  int       `json:"port"`
+	Endpoint  string    `json:"endpoint"`
+
+	// Endpoints of the node in order of preference (i.e. ipc and http).
+	// Endpoint is used if empty.
+	Endpoints []string `json:"endpoints"`
+
+	NodeName    string   `json:"nodename"`
+	RPCInterval Duration `json:"rpc_interval"`
+
+	// Rpc client config
+	RPCConfig *RPCConfig `json:"rpc"`
+
+	// Collectors config by name
+	Collectors map[string]*CollectorConfig `json:"collectors"`
+
+	// Constant labels added to every metric. The node label is set to the
+	// node name unless overridden.
+	Labels map[string]string `json:"labels"`
+
+	// Secondary go-metrics sinks
+	GoMetricsConfig *GoMetricsConfig `json:"go_metrics"`
+
+	// Push the metrics as influxdb line protocol or prometheus remote
+	// write requests
+	InfluxDBConfig    *PushConfig `json:"influxdb"`
+	RemoteWriteConfig *PushConfig `json:"remote_write"`
+
+	// OpenTelemetry metrics and traces. The standard OTEL_* environment
+	// variables override it.
+	OTLPConfig *OTLPConfig `json:"otlp"`
+
+	// Local history of the blocks and the node state
+	HistoryConfig *HistoryConfig `json:"history"`
+
+	// Max time to wait for the monitor to stop
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+
+	// Service discovery backend (consul, file, etcd or none)
+	Discovery string `json:"discovery"`
+
+	// Service announced by the discovery backend
+	ServiceConfig *ServiceConfig `json:"service"`
 
 	// Consul config
 	ConsulConfig *ConsulConfig `json:"consul"`
 
-	// Sync threashold
-	SyncThreshold int
+	// Prometheus file_sd config
+	FileSDConfig *FileSDConfig `json:"file_sd"`
+
+	// Etcd config
+	EtcdConfig *EtcdConfig `json:"etcd"`
+
+	// Max blocks behind the reference for the node to be synced
+	SyncThreshold int `json:"sync_threshold"`
+
+	// Etherscan compatible api used as reference of the chain head.
+	// Defaults to etherscan for the chain of the node.
+	ReferenceURL string `json:"reference_url"`
+
+	// Etherscan client config, also used with the reference url
+	EtherscanConfig *EtherscanConfig `json:"etherscan"`
 }
 
 func DefaultConfig() *Config {
 	c := &Config{
-		LogOutput:     os.Stderr,
-		BindAddr:      "127.0.0.1",
-		BindPort:      4546,
-		NodeName:      "parity",
-		Endpoint:      "http://127.0.0.1:8545",
-		ConsulConfig:  DefaultConsulConfig(),
-		RPCInterval:   time.Duration(5) * time.Second,
-		SyncThreshold: 5,
+		LogOutput:         os.Stderr,
+		BindAddr:          "127.0.0.1",
+		BindPort:          4546,
+		NodeName:          "parity",
+		Endpoint:          "http://127.0.0.1:8545",
+		Discovery:         DiscoveryConsul,
+		ServiceConfig:     DefaultServiceConfig(),
+		ConsulConfig:      DefaultConsulConfig(),
+		FileSDConfig:      DefaultFileSDConfig(),
+		EtcdConfig:        DefaultEtcdConfig(),
+		RPCInterval:       Duration(5 * time.Second),
+		RPCConfig:         DefaultRPCConfig(),
+		Collectors:        map[string]*CollectorConfig{},
+		Labels:            map[string]string{},
+		GoMetricsConfig:   DefaultGoMetricsConfig(),
+		InfluxDBConfig:    DefaultPushConfig(),
+		RemoteWriteConfig: DefaultPushConfig(),
+		OTLPConfig:        DefaultOTLPConfig(),
+		HistoryConfig:     DefaultHistoryConfig(),
+		ShutdownTimeout:   Duration(10 * time.Second),
+		SyncThreshold:     5,
+		EtherscanConfig:   DefaultEtherscanConfig(),
 	}
 
 	if hostname, err := os.Hostname(); err == nil {
@@ -79,11 +780,436 @@ func (c *Config) Merge(c1 *Config) {
 	if c1.Endpoint != "" {
 		c.Endpoint = c1.Endpoint
 	}
+	if len(c1.Endpoints) != 0 {
+		c.Endpoints = c1.Endpoints
+	}
 	if c1.SyncThreshold != 0 {
 		c.SyncThreshold = c1.SyncThreshold
 	}
+	if c1.ReferenceURL != "" {
+		c.ReferenceURL = c1.ReferenceURL
+	}
+	if c1.EtherscanConfig != nil {
+		c.EtherscanConfig.Merge(c1.EtherscanConfig)
+	}
+	if c1.RPCInterval != 0 {
+		c.RPCInterval = c1.RPCInterval
+	}
+	if c1.ShutdownTimeout != 0 {
+		c.ShutdownTimeout = c1.ShutdownTimeout
+	}
 
+	if c1.Discovery != "" {
+		c.Discovery = c1.Discovery
+	}
+
+	if c1.RPCConfig != nil {
+		c.RPCConfig.Merge(c1.RPCConfig)
+	}
+	for name, collector := range c1.Collectors {
+		if c.Collectors == nil {
+			c.Collectors = map[string]*CollectorConfig{}
+		}
+		if c.Collectors[name] == nil {
+			c.Collectors[name] = &CollectorConfig{}
+		}
+		c.Collectors[name].Merge(collector)
+	}
+	for name, value := range c1.Labels {
+		if c.Labels == nil {
+			c.Labels = map[string]string{}
+		}
+		c.Labels[name] = value
+	}
+	if c1.GoMetricsConfig != nil {
+		c.GoMetricsConfig.Merge(c1.GoMetricsConfig)
+	}
+	if c1.InfluxDBConfig != nil {
+		c.InfluxDBConfig.Merge(c1.InfluxDBConfig)
+	}
+	if c1.RemoteWriteConfig != nil {
+		c.RemoteWriteConfig.Merge(c1.RemoteWriteConfig)
+	}
+	if c1.OTLPConfig != nil {
+		c.OTLPConfig.Merge(c1.OTLPConfig)
+	}
+	if c1.HistoryConfig != nil {
+		c.HistoryConfig.Merge(c1.HistoryConfig)
+	}
+	if c1.ServiceConfig != nil {
+		c.ServiceConfig.Merge(c1.ServiceConfig)
+	}
 	if c1.ConsulConfig != nil {
 		c.ConsulConfig.Merge(c1.ConsulConfig)
 	}
+	if c1.FileSDConfig != nil {
+		c.FileSDConfig.Merge(c1.FileSDConfig)
+	}
+	if c1.EtcdConfig != nil {
+		c.EtcdConfig.Merge(c1.EtcdConfig)
+	}
+}
+
+// Validate checks the config and returns all the problems found, as
+// *ValidationError in a *multierror.Error.
+func (c *Config) Validate() error {
+	var errors error
+
+	fail := func(key string, format string, args ...interface{}) {
+		errors = multierror.Append(errors, &ValidationError{Key: key, Err: fmt.Errorf(format, args...)})
+	}
+
+	duration := func(key, str string, required bool) {
+		if str == "" {
+			if required {
+				fail(key, "missing duration")
+			}
+			return
+		}
+		if d, err := time.ParseDuration(str); err != nil {
+			fail(key, "invalid duration '%s'", str)
+		} else if d < 0 {
+			fail(key, "negative duration '%s'", str)
+		}
+	}
+
+	httpURL := func(key, str string) {
+		if str == "" {
+			return
+		}
+		u, err := url.Parse(str)
+		if err != nil {
+			fail(key, "invalid url '%s': %v", str, err)
+			return
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			fail(key, "url scheme %s not found. 'http' and 'https' are the only valid options", u.Scheme)
+		} else if u.Host == "" {
+			fail(key, "url '%s' has no host", str)
+		}
+	}
+
+	if net.ParseIP(c.BindAddr) == nil {
+		fail("bind", "invalid ip address '%s'", c.BindAddr)
+	}
+	if c.BindPort <= 0 || c.BindPort > 65535 {
+		fail("port", "port %d out of range", c.BindPort)
+	}
+	if c.NodeName == "" {
+		fail("nodename", "missing node name")
+	}
+
+	endpoints := c.RPCEndpoints()
+	for i, endpoint := range endpoints {
+		key := "endpoint"
+		if len(c.Endpoints) != 0 {
+			key = fmt.Sprintf("endpoints[%d]", i)
+		}
+		if endpoint == "" {
+			fail(key, "missing endpoint")
+			continue
+		}
+		if newRPCEndpoint(endpoint).ipc {
+			continue
+		}
+		if !strings.Contains(endpoint, "://") {
+			fail(key, "endpoint '%s' has no scheme. Use http://%s, or an absolute path or a .ipc file for the ipc socket", endpoint, endpoint)
+			continue
+		}
+		httpURL(key, endpoint)
+	}
+
+	if c.RPCInterval <= 0 {
+		fail("rpc_interval", "must be positive")
+	}
+	if c.ShutdownTimeout <= 0 {
+		fail("shutdown_timeout", "must be positive")
+	}
+	if c.SyncThreshold < 0 {
+		fail("sync_threshold", "must not be negative")
+	}
+	httpURL("reference_url", c.ReferenceURL)
+
+	if etherscan := c.EtherscanConfig; etherscan != nil {
+		duration("etherscan.cache_ttl", etherscan.CacheTTL, true)
+		duration("etherscan.rate_limit_backoff", etherscan.RateLimitBackoff, true)
+		duration("etherscan.max_backoff", etherscan.MaxBackoff, true)
+	}
+
+	if rpc := c.RPCConfig; rpc != nil {
+		duration("rpc.timeout", rpc.Timeout, true)
+		duration("rpc.cycle_timeout", rpc.CycleTimeout, true)
+		duration("rpc.retry_backoff", rpc.RetryBackoff, true)
+		duration("rpc.failback_interval", rpc.FailbackInterval, true)
+		duration("rpc.idle_conn_timeout", rpc.IdleConnTimeout, true)
+		if rpc.Retries < 0 {
+			fail("rpc.retries", "must not be negative")
+		}
+		if rpc.MaxIdleConns < 0 {
+			fail("rpc.max_idle_conns", "must not be negative")
+		}
+		if rpc.RecordFile != "" && rpc.RecordFile == rpc.ReplayFile {
+			fail("rpc.record_file", "must not be the replay file")
+		}
+	}
+
+	for name, collector := range c.Collectors {
+		if _, ok := collectorFactories[name]; !ok {
+			fail("collectors."+name, "collector %s not found. Valid options are: %s", name, strings.Join(collectorNames(), ", "))
+			continue
+		}
+		if collector == nil {
+			continue
+		}
+		duration("collectors."+name+".interval", collector.Interval, false)
+		duration("collectors."+name+".timeout", collector.Timeout, false)
+	}
+
+	for name := range c.Labels {
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__") {
+			fail("labels."+name, "invalid label name")
+		}
+	}
+
+	if gm := c.GoMetricsConfig; gm != nil {
+		for key, statsd := range map[string]*StatsdConfig{"go_metrics.statsd": gm.StatsdConfig, "go_metrics.dogstatsd": gm.DogStatsdConfig} {
+			if statsd == nil || statsd.Address == "" {
+				continue
+			}
+			if _, _, err := parseStatsdAddress(statsd.Address); err != nil {
+				fail(key+".address", "%v", err)
+			}
+			duration(key+".flush_interval", statsd.FlushInterval, true)
+		}
+	}
+
+	for key, push := range map[string]*PushConfig{"influxdb": c.InfluxDBConfig, "remote_write": c.RemoteWriteConfig} {
+		if push == nil || push.URL == "" {
+			continue
+		}
+		httpURL(key+".url", push.URL)
+		duration(key+".interval", push.Interval, true)
+		duration(key+".timeout", push.Timeout, true)
+		duration(key+".retry_backoff", push.RetryBackoff, true)
+		if push.BatchSize <= 0 {
+			fail(key+".batch_size", "must be positive")
+		}
+		if push.Retries < 0 {
+			fail(key+".retries", "must not be negative")
+		}
+	}
+
+	if otlp := c.OTLPConfig; otlp != nil {
+		httpURL("otlp.endpoint", otlp.Endpoint)
+		httpURL("otlp.metrics_endpoint", otlp.MetricsEndpoint)
+		httpURL("otlp.traces_endpoint", otlp.TracesEndpoint)
+		duration("otlp.timeout", otlp.Timeout, true)
+		duration("otlp.metrics_interval", otlp.MetricsInterval, true)
+	}
+
+	if history := c.HistoryConfig; history != nil && history.Path != "" {
+		duration("history.snapshot_interval", history.SnapshotInterval, true)
+		duration("history.max_age", history.MaxAge, false)
+		if d, err := time.ParseDuration(history.SnapshotInterval); err == nil && d == 0 {
+			fail("history.snapshot_interval", "must be positive")
+		}
+		if history.MaxBlocks < 0 {
+			fail("history.max_blocks", "must not be negative")
+		}
+	}
+
+	switch c.Discovery {
+	case DiscoveryConsul, DiscoveryFile, DiscoveryEtcd, DiscoveryNone:
+	default:
+		fail("discovery", "discovery %s not found. 'consul', 'file', 'etcd' and 'none' are the only valid options", c.Discovery)
+	}
+
+	var registerInterval time.Duration
+	if service := c.ServiceConfig; service != nil && c.Discovery != DiscoveryNone {
+		if service.Name == "" {
+			fail("service.name", "missing service name")
+		}
+		if service.Port < 0 || service.Port > 65535 {
+			fail("service.port", "port %d out of range", service.Port)
+		}
+		if service.Port == 0 && c.HTTPEndpoint() == "" {
+			fail("service.port", "missing port, the ipc endpoints have none")
+		}
+		duration("service.register_interval", service.RegisterInterval, true)
+		if d, err := time.ParseDuration(service.RegisterInterval); err == nil {
+			if d <= 0 {
+				fail("service.register_interval", "must be positive")
+			}
+			registerInterval = d
+		}
+	}
+
+	if consul := c.ConsulConfig; consul != nil && c.Discovery == DiscoveryConsul {
+		httpURL("consul.address", consul.Address)
+		switch consul.CheckMode {
+		case CheckModeHTTP, CheckModeTTL:
+		default:
+			fail("consul.check_mode", "check mode %s not found. 'http' and 'ttl' are the only valid options", consul.CheckMode)
+		}
+		duration("consul.check_interval", consul.CheckInterval, true)
+		duration("consul.check_timeout", consul.CheckTimeout, true)
+		duration("consul.check_ttl", consul.CheckTTL, consul.CheckMode == CheckModeTTL)
+		duration("consul.deregister_after", consul.DeregisterAfter, false)
+	}
+
+	if c.Discovery == DiscoveryFile && (c.FileSDConfig == nil || c.FileSDConfig.Path == "") {
+		fail("file_sd.path", "missing path")
+	}
+
+	if etcd := c.EtcdConfig; etcd != nil && c.Discovery == DiscoveryEtcd {
+		httpURL("etcd.address", etcd.Address)
+		if etcd.TTL <= 0 {
+			fail("etcd.ttl", "must be positive")
+		} else if registerInterval > 0 && time.Duration(etcd.TTL)*time.Second <= registerInterval {
+			// The lease is only refreshed on every registration
+			fail("etcd.ttl", "%ds must be longer than the register interval %s", etcd.TTL, registerInterval)
+		}
+	}
+
+	return errors
+}
+
+// RPCEndpoints returns the endpoints of the node in order of preference.
+func (c *Config) RPCEndpoints() []string {
+	if len(c.Endpoints) != 0 {
+		return c.Endpoints
+	}
+	return []string{c.Endpoint}
+}
+
+// HTTPEndpoint returns the first endpoint of the node that is not an ipc
+// socket, empty if none.
+func (c *Config) HTTPEndpoint() string {
+	for _, endpoint := range c.RPCEndpoints() {
+		if !newRPCEndpoint(endpoint).ipc {
+			return endpoint
+		}
+	}
+	return ""
+}
+
+// MetricLabels returns the constant labels of the metrics.
+func (c *Config) MetricLabels() map[string]string {
+	labels := map[string]string{
+		"node": c.NodeName,
+	}
+	for name, value := range c.Labels {
+		labels[name] = value
+	}
+	return labels
+}
+
+const redacted = "<redacted>"
+
+// Redacted returns a copy of the config safe to print, with the credentials
+// replaced.
+func (c *Config) Redacted() *Config {
+	c1 := *c
+
+	c1.Endpoint = redactURL(c.Endpoint)
+	c1.ReferenceURL = redactURL(c.ReferenceURL)
+
+	if len(c.Endpoints) != 0 {
+		c1.Endpoints = []string{}
+		for _, endpoint := range c.Endpoints {
+			c1.Endpoints = append(c1.Endpoints, redactURL(endpoint))
+		}
+	}
+
+	if c.RPCConfig != nil {
+		rpc := *c.RPCConfig
+
+		if rpc.Password != "" {
+			rpc.Password = redacted
+		}
+
+		rpc.Headers = redactHeaders(c.RPCConfig.Headers)
+
+		c1.RPCConfig = &rpc
+	}
+
+	if c.InfluxDBConfig != nil {
+		c1.InfluxDBConfig = c.InfluxDBConfig.redacted()
+	}
+	if c.RemoteWriteConfig != nil {
+		c1.RemoteWriteConfig = c.RemoteWriteConfig.redacted()
+	}
+	if c.EtherscanConfig != nil && c.EtherscanConfig.APIKey != "" {
+		etherscan := *c.EtherscanConfig
+		etherscan.APIKey = redacted
+		c1.EtherscanConfig = &etherscan
+	}
+	if c.OTLPConfig != nil {
+		otlp := *c.OTLPConfig
+		otlp.Endpoint = redactURL(c.OTLPConfig.Endpoint)
+		otlp.MetricsEndpoint = redactURL(c.OTLPConfig.MetricsEndpoint)
+		otlp.TracesEndpoint = redactURL(c.OTLPConfig.TracesEndpoint)
+		otlp.Headers = redactHeaders(c.OTLPConfig.Headers)
+		c1.OTLPConfig = &otlp
+	}
+
+	return &c1
+}
+
+func redactHeaders(headers map[string]string) map[string]string {
+	if len(headers) == 0 {
+		return headers
+	}
+
+	headers1 := map[string]string{}
+	for k, v := range headers {
+		if isSensitiveHeader(k) {
+			v = redacted
+		}
+		headers1[k] = v
+	}
+	return headers1
+}
+
+// redactURL replaces the password and the values of the query (i.e. api
+// keys) of the url.
+func redactURL(str string) string {
+	u, err := url.Parse(str)
+	if err != nil {
+		return str
+	}
+
+	changed := false
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			changed = true
+		}
+	}
+
+	if u.RawQuery != "" {
+		params := strings.Split(u.RawQuery, "&")
+		for i, param := range params {
+			if name := strings.SplitN(param, "=", 2); len(name) == 2 && name[1] != "" {
+				params[i] = name[0] + "=" + redacted
+				changed = true
+			}
+		}
+		u.RawQuery = strings.Join(params, "&")
+	}
+
+	if !changed {
+		return str
+	}
+	return u.String()
+}
+
+func isSensitiveHeader(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range []string{"authorization", "cookie", "token", "secret", "key", "password"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
 }
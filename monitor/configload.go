@@ -0,0 +1,848 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+	toml "github.com/pelletier/go-toml"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Prefix of the environment variables that override the config
+const EnvPrefix = "ETH_EXPORTER_"
+
+// ValidationError is a problem with a config key. Source is where the key
+// was set (i.e. file:line, environment variable or flag), if known.
+type ValidationError struct {
+	Key    string
+	Source string
+	Err    error
+}
+
+func (e *ValidationError) Error() string {
+	if e.Source != "" {
+		return fmt.Sprintf("%s: %s: %v", e.Source, e.Key, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.Key, e.Err)
+}
+
+// ConfigLoader builds the config from the defaults and a sequence of
+// sources (files, environment and flags). Every source only overrides the
+// keys it sets, so a key can be set to its zero value. The problems of all
+// the sources are reported at once by Config.
+type ConfigLoader struct {
+	config *Config
+
+	// Keys set by all the sources, decoded on top of the defaults
+	tree map[string]interface{}
+
+	// Source of every key set
+	sources map[string]string
+
+	errors error
+}
+
+func NewConfigLoader() *ConfigLoader {
+	return &ConfigLoader{
+		config:  DefaultConfig(),
+		tree:    map[string]interface{}{},
+		sources: map[string]string{},
+	}
+}
+
+// LoadFile loads a json, yaml or toml file, chosen by the extension.
+func (l *ConfigLoader) LoadFile(path string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		l.errors = multierror.Append(l.errors, err)
+		return
+	}
+
+	var tree map[string]interface{}
+	lines := map[string]int{}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		tree, err = parseJSONConfig(data, lines)
+	case ".yaml", ".yml":
+		tree, err = parseYAMLConfig(data, lines)
+	case ".toml":
+		tree, err = parseTOMLConfig(data, lines)
+	default:
+		err = fmt.Errorf("Config extension %s not found. '.json', '.yaml', '.yml' and '.toml' are the only valid options", ext)
+	}
+	if err != nil {
+		l.errors = multierror.Append(l.errors, fmt.Errorf("%s: %v", path, err))
+		return
+	}
+
+	sources := map[string]string{}
+	for key, line := range lines {
+		sources[key] = fmt.Sprintf("%s:%d", path, line)
+	}
+
+	l.apply(tree, sources)
+}
+
+// LoadEnv loads the ETH_EXPORTER_* variables of environ (as returned by
+// os.Environ). The variable of a key is its path in upper case with the
+// dots replaced by underscores (i.e. ETH_EXPORTER_RPC_TIMEOUT for
+// rpc.timeout).
+func (l *ConfigLoader) LoadEnv(environ []string) {
+	keys := envKeys()
+
+	tree := map[string]interface{}{}
+	sources := map[string]string{}
+
+	for _, env := range environ {
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], EnvPrefix) {
+			continue
+		}
+		name, value := parts[0], parts[1]
+
+		key, typ := lookupEnvKey(keys, name)
+		if key == "" {
+			l.errors = multierror.Append(l.errors, &ValidationError{Key: name, Err: fmt.Errorf("unknown environment variable")})
+			continue
+		}
+
+		if err := l.setPath(tree, key, typ, value); err != nil {
+			l.errors = multierror.Append(l.errors, &ValidationError{Key: key, Source: "environment variable " + name, Err: err})
+			continue
+		}
+		sources[key] = "environment variable " + name
+	}
+
+	l.apply(tree, sources)
+}
+
+// Set sets the key (i.e. rpc.timeout) from its string representation.
+// Lists are separated by commas and maps are lists of key=value pairs.
+func (l *ConfigLoader) Set(key, value, source string) {
+	typ, ok := keyType(key)
+	if !ok {
+		l.errors = multierror.Append(l.errors, &ValidationError{Key: key, Source: source, Err: fmt.Errorf("unknown key")})
+		return
+	}
+
+	tree := map[string]interface{}{}
+	if err := l.setPath(tree, key, typ, value); err != nil {
+		l.errors = multierror.Append(l.errors, &ValidationError{Key: key, Source: source, Err: err})
+		return
+	}
+
+	l.apply(tree, map[string]string{key: source})
+}
+
+// Config validates the config and returns it with all the problems found
+// while loading and validating it.
+func (l *ConfigLoader) Config() (*Config, error) {
+	errors := l.errors
+
+	if err := l.config.Validate(); err != nil {
+		for _, err := range err.(*multierror.Error).Errors {
+			if v, ok := err.(*ValidationError); ok && v.Source == "" {
+				v.Source = l.source(v.Key)
+			}
+			errors = multierror.Append(errors, err)
+		}
+	}
+
+	return l.config, errors
+}
+
+// source returns where the key, or the closest parent set, was set.
+func (l *ConfigLoader) source(key string) string {
+	for {
+		if source, ok := l.sources[key]; ok {
+			return source
+		}
+		i := strings.LastIndex(key, ".")
+		if i == -1 {
+			return ""
+		}
+		key = key[:i]
+	}
+}
+
+// apply checks the tree against the config schema and merges the valid keys
+// with the ones of the previous sources. The config is decoded from the
+// merged keys since decoding a source on top of the config would replace
+// the map values (i.e. a collector) instead of only their keys set.
+func (l *ConfigLoader) apply(tree map[string]interface{}, sources map[string]string) {
+	clean, ok := l.check(reflect.TypeOf(Config{}), tree, "", sources)
+	if !ok {
+		return
+	}
+
+	merged := mergeTrees(l.tree, clean.(map[string]interface{}))
+
+	config := DefaultConfig()
+	data, err := json.Marshal(merged)
+	if err == nil {
+		err = json.Unmarshal(data, config)
+	}
+	if err != nil {
+		l.errors = multierror.Append(l.errors, err)
+		return
+	}
+
+	l.tree = merged
+	l.config = config
+
+	for key, source := range sources {
+		l.sources[key] = source
+	}
+}
+
+// mergeTrees returns the keys of both trees, the ones of t2 take precedence.
+// Sections and maps are merged key by key, other values (including lists)
+// are replaced. The trees are not modified.
+func mergeTrees(t1, t2 map[string]interface{}) map[string]interface{} {
+	merged := map[string]interface{}{}
+	for k, v := range t1 {
+		merged[k] = v
+	}
+
+	for k, v2 := range t2 {
+		obj2, ok2 := v2.(map[string]interface{})
+		obj1, ok1 := merged[k].(map[string]interface{})
+		if ok1 && ok2 {
+			merged[k] = mergeTrees(obj1, obj2)
+		} else {
+			merged[k] = v2
+		}
+	}
+
+	return merged
+}
+
+var durationType = reflect.TypeOf(Duration(0))
+
+// check returns the value without the unknown keys and the values of the
+// wrong type, which are reported as errors.
+func (l *ConfigLoader) check(t reflect.Type, value interface{}, key string, sources map[string]string) (interface{}, bool) {
+	fail := func(err error) (interface{}, bool) {
+		l.errors = multierror.Append(l.errors, &ValidationError{Key: key, Source: sources[key], Err: err})
+		return nil, false
+	}
+
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == durationType {
+		str, ok := value.(string)
+		if !ok {
+			return fail(fmt.Errorf("expected a duration string (i.e. 5s), found %s", typeName(value)))
+		}
+		var d Duration
+		if err := d.UnmarshalJSON([]byte(strconv.Quote(str))); err != nil {
+			return fail(err)
+		}
+		return str, true
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return fail(fmt.Errorf("expected a section, found %s", typeName(value)))
+		}
+
+		fields := configFields(t)
+		clean := map[string]interface{}{}
+		for k, v := range obj {
+			subkey := joinKey(key, k)
+
+			field, ok := fields[k]
+			if !ok {
+				l.errors = multierror.Append(l.errors, &ValidationError{Key: subkey, Source: sources[subkey], Err: fmt.Errorf("unknown key")})
+				continue
+			}
+
+			// null leaves the key unset
+			if v == nil {
+				continue
+			}
+			if v, ok := l.check(field.Type, v, subkey, sources); ok {
+				clean[k] = v
+			}
+		}
+		return clean, true
+
+	case reflect.Map:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return fail(fmt.Errorf("expected a map, found %s", typeName(value)))
+		}
+
+		clean := map[string]interface{}{}
+		for k, v := range obj {
+			if v == nil {
+				continue
+			}
+			if v, ok := l.check(t.Elem(), v, joinKey(key, k), sources); ok {
+				clean[k] = v
+			}
+		}
+		return clean, true
+
+	case reflect.Slice:
+		list, ok := value.([]interface{})
+		if !ok {
+			return fail(fmt.Errorf("expected a list, found %s", typeName(value)))
+		}
+
+		clean := []interface{}{}
+		for i, v := range list {
+			v, ok := l.check(t.Elem(), v, fmt.Sprintf("%s[%d]", key, i), sources)
+			if !ok {
+				return nil, false
+			}
+			clean = append(clean, v)
+		}
+		return clean, true
+
+	case reflect.String:
+		if _, ok := value.(string); !ok {
+			return fail(fmt.Errorf("expected a string, found %s", typeName(value)))
+		}
+		return value, true
+
+	case reflect.Bool:
+		if _, ok := value.(bool); !ok {
+			return fail(fmt.Errorf("expected a boolean, found %s", typeName(value)))
+		}
+		return value, true
+
+	case reflect.Int:
+		n, ok := toInt(value)
+		if !ok {
+			return fail(fmt.Errorf("expected an integer, found %s", typeName(value)))
+		}
+		return n, true
+	}
+
+	return fail(fmt.Errorf("unsupported type %s", t))
+}
+
+func toInt(value interface{}) (int64, bool) {
+	switch n := value.(type) {
+	case int:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint64:
+		if n > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(n), true
+	case float64:
+		if n != math.Trunc(n) || math.Abs(n) > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(n), true
+	case json.Number:
+		i, err := n.Int64()
+		return i, err == nil
+	}
+	return 0, false
+}
+
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	case int, int64, uint64, float64, json.Number:
+		return "a number"
+	case []interface{}:
+		return "a list"
+	case map[string]interface{}:
+		return "a section"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// configFields returns the fields of a config section by json name.
+func configFields(t reflect.Type) map[string]reflect.StructField {
+	fields := map[string]reflect.StructField{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[name] = field
+	}
+	return fields
+}
+
+func joinKey(key, name string) string {
+	if key == "" {
+		return name
+	}
+	return key + "." + name
+}
+
+// keyType returns the type of the value of a key. Keys inside maps of
+// sections (i.e. collectors.peers.interval) are resolved too.
+func keyType(key string) (reflect.Type, bool) {
+	t := reflect.TypeOf(Config{})
+
+	parts := strings.Split(key, ".")
+	for i := 0; i < len(parts); i++ {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+
+		switch {
+		case t.Kind() == reflect.Struct && t != durationType:
+			field, ok := configFields(t)[parts[i]]
+			if !ok {
+				return nil, false
+			}
+			t = field.Type
+		case t.Kind() == reflect.Map:
+			t = t.Elem()
+		default:
+			return nil, false
+		}
+	}
+
+	return t, true
+}
+
+// envKey is a key settable from the environment. Keys inside maps of
+// sections have a wildcard (*) for the map key.
+type envKey struct {
+	key string
+	typ reflect.Type
+}
+
+func envKeys() []envKey {
+	keys := []envKey{}
+
+	var walk func(t reflect.Type, key string)
+	walk = func(t reflect.Type, key string) {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+
+		switch {
+		case t.Kind() == reflect.Struct && t != durationType:
+			for name, field := range configFields(t) {
+				walk(field.Type, joinKey(key, name))
+			}
+		case t.Kind() == reflect.Map && t.Elem().Kind() == reflect.Ptr:
+			walk(t.Elem(), key+".*")
+		default:
+			keys = append(keys, envKey{key: key, typ: t})
+		}
+	}
+	walk(reflect.TypeOf(Config{}), "")
+
+	return keys
+}
+
+func envName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+}
+
+// lookupEnvKey returns the key of an environment variable.
+func lookupEnvKey(keys []envKey, name string) (string, reflect.Type) {
+	for _, k := range keys {
+		i := strings.Index(k.key, "*")
+		if i == -1 {
+			if envName(k.key) == name {
+				return k.key, k.typ
+			}
+			continue
+		}
+
+		// i.e. ETH_EXPORTER_COLLECTORS_PEERS_INTERVAL for collectors.*.interval
+		prefix := envName(k.key[:i])
+		suffix := strings.ToUpper(strings.Replace(k.key[i+1:], ".", "_", -1))
+		if strings.HasPrefix(name, prefix) && strings.HasSuffix(name, suffix) && len(name) > len(prefix)+len(suffix) {
+			mapKey := strings.ToLower(name[len(prefix) : len(name)-len(suffix)])
+			return k.key[:i] + mapKey + k.key[i+1:], k.typ
+		}
+	}
+	return "", nil
+}
+
+// setPath parses the string value for the type and sets it in the tree.
+func (l *ConfigLoader) setPath(tree map[string]interface{}, key string, t reflect.Type, str string) error {
+	value, err := parseConfigValue(t, str)
+	if err != nil {
+		return err
+	}
+
+	parts := strings.Split(key, ".")
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := tree[part].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			tree[part] = next
+		}
+		tree = next
+	}
+	tree[parts[len(parts)-1]] = value
+
+	return nil
+}
+
+func parseConfigValue(t reflect.Type, str string) (interface{}, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == durationType {
+		return str, nil
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return str, nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(str)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not a boolean", str)
+		}
+		return b, nil
+	case reflect.Int:
+		n, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not an integer", str)
+		}
+		return n, nil
+	case reflect.Slice:
+		list := []interface{}{}
+		for _, item := range strings.Split(str, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			v, err := parseConfigValue(t.Elem(), item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case reflect.Map:
+		obj := map[string]interface{}{}
+		for _, pair := range strings.Split(str, ",") {
+			if strings.TrimSpace(pair) == "" {
+				continue
+			}
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("'%s' is not a key=value pair", pair)
+			}
+			v, err := parseConfigValue(t.Elem(), strings.TrimSpace(kv[1]))
+			if err != nil {
+				return nil, err
+			}
+			obj[strings.TrimSpace(kv[0])] = v
+		}
+		return obj, nil
+	}
+
+	return nil, fmt.Errorf("cannot be set from a string")
+}
+
+// parseJSONConfig parses a json config and records the line of every key.
+func parseJSONConfig(data []byte, lines map[string]int) (map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	line := func() int {
+		return bytes.Count(data[:dec.InputOffset()], []byte("\n")) + 1
+	}
+
+	var parse func(key string) (interface{}, error)
+	parse = func(key string) (interface{}, error) {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line(), err)
+		}
+
+		switch tok {
+		case json.Delim('{'):
+			obj := map[string]interface{}{}
+			for dec.More() {
+				tok, err := dec.Token()
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %v", line(), err)
+				}
+				name := tok.(string)
+				subkey := joinKey(key, name)
+				lines[subkey] = line()
+
+				if obj[name], err = parse(subkey); err != nil {
+					return nil, err
+				}
+			}
+			_, err := dec.Token()
+			return obj, err
+
+		case json.Delim('['):
+			list := []interface{}{}
+			for i := 0; dec.More(); i++ {
+				v, err := parse(fmt.Sprintf("%s[%d]", key, i))
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, v)
+			}
+			_, err := dec.Token()
+			return list, err
+		}
+
+		return tok, nil
+	}
+
+	value, err := parse("")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("line %d: unexpected data after the config", line())
+	}
+
+	tree, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("the config must be an object")
+	}
+	return tree, nil
+}
+
+// parseYAMLConfig parses a yaml config and records the line of every key.
+func parseYAMLConfig(data []byte, lines map[string]int) (map[string]interface{}, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	// Empty file
+	if len(doc.Content) == 0 {
+		return map[string]interface{}{}, nil
+	}
+
+	var convert func(node *yaml.Node, key string) (interface{}, error)
+	convert = func(node *yaml.Node, key string) (interface{}, error) {
+		switch node.Kind {
+		case yaml.MappingNode:
+			obj := map[string]interface{}{}
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				name := node.Content[i].Value
+				subkey := joinKey(key, name)
+				lines[subkey] = node.Content[i].Line
+
+				v, err := convert(node.Content[i+1], subkey)
+				if err != nil {
+					return nil, err
+				}
+				obj[name] = v
+			}
+			return obj, nil
+
+		case yaml.SequenceNode:
+			list := []interface{}{}
+			for i, item := range node.Content {
+				v, err := convert(item, fmt.Sprintf("%s[%d]", key, i))
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, v)
+			}
+			return list, nil
+
+		case yaml.AliasNode:
+			return convert(node.Alias, key)
+		}
+
+		var v interface{}
+		if err := node.Decode(&v); err != nil {
+			return nil, fmt.Errorf("line %d: %v", node.Line, err)
+		}
+		return v, nil
+	}
+
+	value, err := convert(doc.Content[0], "")
+	if err != nil {
+		return nil, err
+	}
+
+	tree, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("the config must be a mapping")
+	}
+	return tree, nil
+}
+
+// parseTOMLConfig parses a toml config and records the line of every key.
+func parseTOMLConfig(data []byte, lines map[string]int) (map[string]interface{}, error) {
+	tree, err := toml.LoadBytes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var convert func(value interface{}, key string) interface{}
+	convert = func(value interface{}, key string) interface{} {
+		switch v := value.(type) {
+		case *toml.Tree:
+			obj := map[string]interface{}{}
+			keys := v.Keys()
+			sort.Strings(keys)
+			for _, name := range keys {
+				subkey := joinKey(key, name)
+				lines[subkey] = v.GetPositionPath([]string{name}).Line
+				obj[name] = convert(v.GetPath([]string{name}), subkey)
+			}
+			return obj
+		case []*toml.Tree:
+			list := []interface{}{}
+			for i, item := range v {
+				list = append(list, convert(item, fmt.Sprintf("%s[%d]", key, i)))
+			}
+			return list
+		case []interface{}:
+			list := []interface{}{}
+			for i, item := range v {
+				list = append(list, convert(item, fmt.Sprintf("%s[%d]", key, i)))
+			}
+			return list
+		}
+		return value
+	}
+
+	return convert(tree, "").(map[string]interface{}), nil
+}
+
+// Formats of the config files
+const (
+	ConfigFormatJSON = "json"
+	ConfigFormatYAML = "yaml"
+	ConfigFormatTOML = "toml"
+)
+
+// EncodeConfig encodes the config in one of the formats read by LoadFile.
+// The keys left unset (null) are omitted from the yaml and toml output.
+func EncodeConfig(config *Config, format string) ([]byte, error) {
+	data, err := json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case ConfigFormatJSON:
+		return append(data, '\n'), nil
+
+	case ConfigFormatYAML:
+		// json is yaml, decoding it into a node keeps the order of the keys
+		var doc yaml.Node
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		yamlBlockStyle(&doc)
+
+		var buf bytes.Buffer
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		if err := enc.Encode(&doc); err != nil {
+			return nil, err
+		}
+		if err := enc.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+
+	case ConfigFormatTOML:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+
+		var obj map[string]interface{}
+		if err := dec.Decode(&obj); err != nil {
+			return nil, err
+		}
+
+		tree, err := toml.TreeFromMap(tomlValue(obj).(map[string]interface{}))
+		if err != nil {
+			return nil, err
+		}
+		str, err := tree.ToTomlString()
+		if err != nil {
+			return nil, err
+		}
+		return []byte(str), nil
+	}
+
+	return nil, fmt.Errorf("Config format %s not found. '%s', '%s' and '%s' are the only valid options", format, ConfigFormatJSON, ConfigFormatYAML, ConfigFormatTOML)
+}
+
+// yamlBlockStyle removes the flow style and the quotes of the json nodes,
+// and the keys set to null.
+func yamlBlockStyle(node *yaml.Node) {
+	node.Style = 0
+
+	if node.Kind == yaml.MappingNode {
+		content := []*yaml.Node{}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i+1].Tag == "!!null" {
+				continue
+			}
+			content = append(content, node.Content[i], node.Content[i+1])
+		}
+		node.Content = content
+	}
+
+	for _, child := range node.Content {
+		yamlBlockStyle(child)
+	}
+}
+
+// tomlValue converts a decoded json value to the types of go-toml, without
+// the nulls toml cannot represent.
+func tomlValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		obj := map[string]interface{}{}
+		for k, item := range v {
+			if item != nil {
+				obj[k] = tomlValue(item)
+			}
+		}
+		return obj
+	case []interface{}:
+		list := []interface{}{}
+		for _, item := range v {
+			if item != nil {
+				list = append(list, tomlValue(item))
+			}
+		}
+		return list
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return value
+}
@@ -0,0 +1,99 @@
+package monitor
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigLoaderMergesSources(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	file := `
+collectors:
+  peers:
+    interval: 1m
+    enabled: false
+labels:
+  region: eu
+`
+	if err := ioutil.WriteFile(path, []byte(file), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		load func(l *ConfigLoader)
+	}{
+		{"flag", func(l *ConfigLoader) {
+			l.Set("collectors.peers.timeout", "3s", "flag -set collectors.peers.timeout")
+			l.Set("labels.zone", "a", "flag -set labels.zone")
+		}},
+		{"environment", func(l *ConfigLoader) {
+			l.LoadEnv([]string{"ETH_EXPORTER_COLLECTORS_PEERS_TIMEOUT=3s", "ETH_EXPORTER_LABELS=zone=a"})
+		}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			l := NewConfigLoader()
+			l.LoadFile(path)
+			c.load(l)
+
+			config, err := l.Config()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			peers := config.Collectors["peers"]
+			if peers == nil {
+				t.Fatal("peers collector not found")
+			}
+			if peers.Enabled == nil || *peers.Enabled {
+				t.Errorf("expected the collector disabled by the file, got %v", peers.Enabled)
+			}
+			if peers.Interval != "1m" {
+				t.Errorf("expected the interval of the file, got '%s'", peers.Interval)
+			}
+			if peers.Timeout != "3s" {
+				t.Errorf("expected the timeout of the %s, got '%s'", c.name, peers.Timeout)
+			}
+			if config.Labels["region"] != "eu" || config.Labels["zone"] != "a" {
+				t.Errorf("expected the labels of both sources, got %v", config.Labels)
+			}
+		})
+	}
+}
+
+func TestConfigLoaderZeroValues(t *testing.T) {
+	l := NewConfigLoader()
+	l.Set("sync_threshold", "0", "flag -set sync_threshold")
+	l.Set("service.dynamic_tags", "true", "flag -set service.dynamic_tags")
+	l.Set("service.dynamic_tags", "false", "flag -set service.dynamic_tags")
+
+	config, err := l.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.SyncThreshold != 0 {
+		t.Errorf("expected sync_threshold 0, got %d", config.SyncThreshold)
+	}
+	if config.ServiceConfig.DynamicTags {
+		t.Errorf("expected dynamic_tags unset by the last source")
+	}
+	if config.ServiceConfig.Name != DefaultServiceConfig().Name {
+		t.Errorf("expected the default service name, got '%s'", config.ServiceConfig.Name)
+	}
+}
+
+func TestConfigLoaderSource(t *testing.T) {
+	l := NewConfigLoader()
+	l.Set("collectors.peers.interval", "bad", "flag -set collectors.peers.interval")
+
+	if _, err := l.Config(); err == nil {
+		t.Fatal("expected an invalid duration error")
+	}
+	if source := l.source("collectors.peers.interval"); source != "flag -set collectors.peers.interval" {
+		t.Errorf("unexpected source '%s'", source)
+	}
+}
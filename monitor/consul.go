@@ -0,0 +1,213 @@
+package monitor
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"reflect"
+	"strconv"
+	"sync"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// ConsulRegistrar registers the node as a service in the local consul agent.
+type ConsulRegistrar struct {
+	logger *log.Logger
+	config *ConsulConfig
+	client *consulapi.Client
+
+	// id of the registered service
+	serviceID string
+	lock      sync.Mutex
+
+	// check registered by this registrar. The agent does not return the
+	// check definition with the service, so a registrar that did not
+	// register the check yet always registers it.
+	check *consulapi.AgentServiceCheck
+}
+
+func NewConsulRegistrar(logger *log.Logger, config *ConsulConfig) (*ConsulRegistrar, error) {
+	switch config.CheckMode {
+	case CheckModeHTTP, CheckModeTTL:
+	default:
+		return nil, fmt.Errorf("Check mode %s not found. '%s' and '%s' are the only valid options", config.CheckMode, CheckModeHTTP, CheckModeTTL)
+	}
+
+	consulConfig := consulapi.DefaultConfig()
+	consulConfig.Address = config.Address
+
+	client, err := consulapi.NewClient(consulConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &ConsulRegistrar{
+		logger: logger,
+		config: config,
+		client: client,
+	}
+
+	return c, nil
+}
+
+// Register registers the service unless the agent already has an
+// up to date registration.
+func (c *ConsulRegistrar) Register(s *Service) error {
+	service := c.registration(s)
+
+	services, err := c.client.Agent().Services()
+	if err != nil {
+		return err
+	}
+
+	current, found := services[service.ID]
+	if found {
+		// The agent may keep the service of a previous run or registrar,
+		// the id is needed to update its health and deregister it
+		c.lock.Lock()
+		c.serviceID = service.ID
+		c.lock.Unlock()
+
+		if !registrationChanged(current, service) && reflect.DeepEqual(c.check, service.Check) {
+			return nil
+		}
+	}
+
+	if err := c.client.Agent().ServiceRegister(service); err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	c.serviceID = service.ID
+	c.check = service.Check
+	c.lock.Unlock()
+
+	if found {
+		c.logger.Printf("Service registration updated in consul")
+	} else {
+		c.logger.Printf("Service registred in consul")
+	}
+
+	return nil
+}
+
+// inherit takes the service registered by the registrar it replaces on a
+// reload, so the health updates and the deregistration keep working before
+// its first registration. The check is not taken, the first registration
+// sends the one of the new config.
+func (c *ConsulRegistrar) inherit(old *ConsulRegistrar) {
+	old.lock.Lock()
+	serviceID := old.serviceID
+	old.lock.Unlock()
+
+	c.lock.Lock()
+	c.serviceID = serviceID
+	c.lock.Unlock()
+}
+
+// UpdateHealth pushes the health status to the ttl check of the service.
+// With http checks consul polls /synced instead.
+func (c *ConsulRegistrar) UpdateHealth(status, note string) error {
+	if c.config.CheckMode != CheckModeTTL {
+		return nil
+	}
+
+	c.lock.Lock()
+	serviceID := c.serviceID
+	c.lock.Unlock()
+
+	if serviceID == "" {
+		// not registered yet
+		return nil
+	}
+
+	return c.client.Agent().UpdateTTL(consulCheckID(serviceID), note, status)
+}
+
+func (c *ConsulRegistrar) Deregister() error {
+	c.lock.Lock()
+	serviceID := c.serviceID
+	c.serviceID = ""
+	c.lock.Unlock()
+
+	if serviceID == "" {
+		return nil
+	}
+
+	if err := c.client.Agent().ServiceDeregister(serviceID); err != nil {
+		return err
+	}
+
+	c.logger.Printf("Service deregistered from consul")
+	return nil
+}
+
+func (c *ConsulRegistrar) registration(s *Service) *consulapi.AgentServiceRegistration {
+	check := &consulapi.AgentServiceCheck{
+		CheckID:                        consulCheckID(s.ID),
+		DeregisterCriticalServiceAfter: c.config.DeregisterAfter,
+	}
+
+	switch c.config.CheckMode {
+	case CheckModeHTTP:
+		check.HTTP = fmt.Sprintf("http://%s/synced", s.HealthAddr)
+		check.Interval = c.config.CheckInterval
+		check.Timeout = c.config.CheckTimeout
+	case CheckModeTTL:
+		check.TTL = c.config.CheckTTL
+	}
+
+	return &consulapi.AgentServiceRegistration{
+		ID:      s.ID,
+		Name:    s.Name,
+		Tags:    s.Tags,
+		Port:    s.Port,
+		Address: s.Address,
+		Meta:    s.Meta,
+		Check:   check,
+	}
+}
+
+func consulCheckID(serviceID string) string {
+	return "service:" + serviceID
+}
+
+// registrationChanged checks if the service registered in the agent differs
+// from the one we would register now. The check is compared by Register.
+func registrationChanged(current *consulapi.AgentService, service *consulapi.AgentServiceRegistration) bool {
+	if current.Service != service.Name || current.Port != service.Port || current.Address != service.Address {
+		return true
+	}
+
+	if len(current.Tags) != len(service.Tags) || (len(service.Tags) != 0 && !reflect.DeepEqual(current.Tags, service.Tags)) {
+		return true
+	}
+
+	if len(current.Meta) != len(service.Meta) || (len(service.Meta) != 0 && !reflect.DeepEqual(current.Meta, service.Meta)) {
+		return true
+	}
+
+	return false
+}
+
+// endpointPort returns the port of the rpc endpoint url.
+func endpointPort(endpoint string) (int, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse endpoint %s: %v", endpoint, err)
+	}
+
+	if port := u.Port(); port != "" {
+		return strconv.Atoi(port)
+	}
+
+	switch u.Scheme {
+	case "https":
+		return 443, nil
+	case "http":
+		return 80, nil
+	}
+
+	return 0, fmt.Errorf("cannot find the port of endpoint %s", endpoint)
+}
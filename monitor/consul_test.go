@@ -0,0 +1,164 @@
+package monitor
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// consulAgent is a stand-in of the consul agent api used by the registrar.
+type consulAgent struct {
+	lock sync.Mutex
+
+	services      map[string]*consulapi.AgentServiceRegistration
+	registrations int
+	ttlUpdates    []string
+	deregistered  []string
+}
+
+func newConsulAgent(t *testing.T) (*consulAgent, string) {
+	a := &consulAgent{services: map[string]*consulapi.AgentServiceRegistration{}}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/v1/agent/services":
+			services := map[string]*consulapi.AgentService{}
+			for id, s := range a.services {
+				services[id] = &consulapi.AgentService{ID: id, Service: s.Name, Tags: s.Tags, Port: s.Port, Address: s.Address, Meta: s.Meta}
+			}
+			json.NewEncoder(w).Encode(services)
+
+		case r.Method == "PUT" && r.URL.Path == "/v1/agent/service/register":
+			var s consulapi.AgentServiceRegistration
+			if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			a.services[s.ID] = &s
+			a.registrations++
+
+		case r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/v1/agent/check/update/"):
+			a.ttlUpdates = append(a.ttlUpdates, strings.TrimPrefix(r.URL.Path, "/v1/agent/check/update/"))
+
+		case r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/v1/agent/service/deregister/"):
+			id := strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/")
+			delete(a.services, id)
+			a.deregistered = append(a.deregistered, id)
+
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return a, server.URL
+}
+
+var testService = &Service{ID: "node1", Name: "pool", Tags: []string{"pool"}, Port: 8545, HealthAddr: "127.0.0.1:4546"}
+
+func TestConsulRegistrarKnownService(t *testing.T) {
+	agent, addr := newConsulAgent(t)
+
+	// A previous run registered the service
+	first, err := NewConsulRegistrar(testLogger, &ConsulConfig{Address: addr, CheckMode: CheckModeTTL, CheckTTL: "30s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Register(testService); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewConsulRegistrar(testLogger, &ConsulConfig{Address: addr, CheckMode: CheckModeTTL, CheckTTL: "30s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Register(testService); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.UpdateHealth(HealthPassing, "Node synced"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Deregister(); err != nil {
+		t.Fatal(err)
+	}
+
+	agent.lock.Lock()
+	defer agent.lock.Unlock()
+
+	if len(agent.ttlUpdates) != 1 || agent.ttlUpdates[0] != "service:node1" {
+		t.Errorf("expected the ttl of the known service updated, got %v", agent.ttlUpdates)
+	}
+	if len(agent.deregistered) != 1 || agent.deregistered[0] != "node1" {
+		t.Errorf("expected the known service deregistered, got %v", agent.deregistered)
+	}
+}
+
+func TestConsulRegistrarCheckChange(t *testing.T) {
+	agent, addr := newConsulAgent(t)
+
+	c, err := NewConsulRegistrar(testLogger, &ConsulConfig{Address: addr, CheckMode: CheckModeTTL, CheckTTL: "30s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := c.Register(testService); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if agent.registrations != 1 {
+		t.Fatalf("expected 1 registration of an unchanged service, got %d", agent.registrations)
+	}
+
+	// The agent does not return the check, the new registrar sends it
+	c, err = NewConsulRegistrar(testLogger, &ConsulConfig{Address: addr, CheckMode: CheckModeHTTP, CheckInterval: "1s", CheckTimeout: "5s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Register(testService); err != nil {
+		t.Fatal(err)
+	}
+	if agent.registrations != 2 {
+		t.Fatalf("expected the check change registered, got %d registrations", agent.registrations)
+	}
+	if check := agent.services["node1"].Check; check.HTTP != "http://127.0.0.1:4546/synced" || check.TTL != "" {
+		t.Errorf("expected the http check, got %+v", check)
+	}
+}
+
+func TestConsulRegistrarInherit(t *testing.T) {
+	agent, addr := newConsulAgent(t)
+
+	old, err := NewConsulRegistrar(testLogger, &ConsulConfig{Address: addr, CheckMode: CheckModeTTL, CheckTTL: "30s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := old.Register(testService); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reload replaces the registrar before its first registration
+	c, err := NewConsulRegistrar(testLogger, &ConsulConfig{Address: addr, CheckMode: CheckModeTTL, CheckTTL: "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.inherit(old)
+
+	if err := c.UpdateHealth(HealthCritical, "Node is not synced"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Deregister(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(agent.ttlUpdates) != 1 || len(agent.deregistered) != 1 {
+		t.Errorf("expected the inherited service updated and deregistered, got %v and %v", agent.ttlUpdates, agent.deregistered)
+	}
+}
@@ -0,0 +1,153 @@
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// rpcEndpoint is one of the urls of the node. Urls with the ipc:// scheme,
+// absolute paths and .ipc files are paths of the ipc socket.
+type rpcEndpoint struct {
+	addr  string
+	label string
+	ipc   bool
+}
+
+func newRPCEndpoint(addr string) *rpcEndpoint {
+	if isIPCPath(addr) {
+		path := strings.TrimPrefix(addr, "ipc://")
+		return &rpcEndpoint{addr: path, label: path, ipc: true}
+	}
+
+	return &rpcEndpoint{addr: addr, label: endpointLabel(addr)}
+}
+
+// isIPCPath returns true if the endpoint is the path of an ipc socket. Other
+// addresses without scheme (i.e. 127.0.0.1:8545) are not, the config
+// validation rejects them.
+func isIPCPath(addr string) bool {
+	if strings.HasPrefix(addr, "ipc://") {
+		return true
+	}
+	if strings.Contains(addr, "://") {
+		return false
+	}
+	return filepath.IsAbs(addr) || strings.HasSuffix(addr, ".ipc")
+}
+
+func (e *EthClient) activeEndpoint() *rpcEndpoint {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return e.endpoints[e.active]
+}
+
+// Endpoint returns the active endpoint without credentials.
+func (e *EthClient) Endpoint() string {
+	return e.activeEndpoint().label
+}
+
+func (e *EthClient) setActive(index int) {
+	e.active = index
+
+	for i, endpoint := range e.endpoints {
+		e.metrics.setActiveEndpoint(endpoint.label, i == index)
+	}
+}
+
+// failover moves to the endpoint after the failed one, unless another call
+// already moved away from it.
+func (e *EthClient) failover(failed *rpcEndpoint, err error) {
+	if len(e.endpoints) == 1 {
+		return
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.endpoints[e.active] != failed {
+		return
+	}
+
+	next := (e.active + 1) % len(e.endpoints)
+	e.logger.Printf("Endpoint %s failed (%v). Failing over to %s", failed.label, err, e.endpoints[next].label)
+
+	e.setActive(next)
+	e.lastFailback = time.Now()
+}
+
+// Failback probes the endpoints preferred over the active one, at most once
+// every failback interval, and moves to the first healthy one.
+func (e *EthClient) Failback(ctx context.Context) {
+	e.lock.Lock()
+	active := e.active
+	due := active != 0 && time.Since(e.lastFailback) >= e.failbackInterval
+	if due {
+		e.lastFailback = time.Now()
+	}
+	e.lock.Unlock()
+
+	if !due {
+		return
+	}
+
+	for i := 0; i < active; i++ {
+		endpoint := e.endpoints[i]
+
+		var block string
+		if err := e.rpcCallOnce(ctx, endpoint, "eth_blockNumber", nil, &block); err != nil {
+			continue
+		}
+
+		e.lock.Lock()
+		if e.active == active {
+			e.logger.Printf("Endpoint %s is healthy again. Failing back", endpoint.label)
+			e.setActive(i)
+		}
+		e.lock.Unlock()
+		return
+	}
+}
+
+// isTransportError returns true if the endpoint could not be reached.
+func isTransportError(err error) bool {
+	switch errorClass(err) {
+	case errorClassConnection, errorClassTimeout:
+		return true
+	}
+	return false
+}
+
+// ipcRequest sends the request to the ipc socket and reads one response.
+func ipcRequest(ctx context.Context, path string, reqData []byte) ([]byte, error) {
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(reqData); err != nil {
+		return nil, err
+	}
+
+	var data json.RawMessage
+	if err := json.NewDecoder(conn).Decode(&data); err != nil {
+		if netErr, ok := err.(net.Error); ok {
+			return nil, netErr
+		}
+		return nil, &DecodeError{err}
+	}
+
+	return data, nil
+}
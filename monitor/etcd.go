@@ -0,0 +1,203 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EtcdRegistrar stores the node under a key attached to an etcd v3 lease. The
+// lease is kept alive on every registration so the key expires if the
+// exporter dies. It talks to the json gateway of etcd so it does not need the
+// grpc client.
+type EtcdRegistrar struct {
+	logger *log.Logger
+	config *EtcdConfig
+	client *http.Client
+
+	lease   string
+	key     string
+	service *Service
+	status  string
+	note    string
+	lock    sync.Mutex
+}
+
+type etcdValue struct {
+	*Service
+	Status string
+	Note   string
+}
+
+func NewEtcdRegistrar(logger *log.Logger, config *EtcdConfig) (*EtcdRegistrar, error) {
+	if config.Address == "" {
+		return nil, fmt.Errorf("etcd address is empty")
+	}
+	if config.TTL <= 0 {
+		return nil, fmt.Errorf("etcd ttl must be positive: %d", config.TTL)
+	}
+
+	e := &EtcdRegistrar{
+		logger: logger,
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+		status: HealthCritical,
+	}
+
+	return e, nil
+}
+
+// Register refreshes the lease (granting a new one if it expired) and writes
+// the service under <prefix><name>/<id>.
+func (e *EtcdRegistrar) Register(service *Service) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	alive := false
+	if e.lease != "" {
+		var err error
+		if alive, err = e.keepAlive(); err != nil {
+			return err
+		}
+	}
+
+	if !alive {
+		if err := e.grant(); err != nil {
+			return err
+		}
+		e.logger.Printf("Service registred in etcd")
+	}
+
+	e.service = service
+	e.key = e.config.Prefix + service.Name + "/" + service.ID
+
+	return e.put()
+}
+
+func (e *EtcdRegistrar) UpdateHealth(status, note string) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.status == status && e.note == note {
+		return nil
+	}
+
+	e.status, e.note = status, note
+
+	if e.lease == "" || e.service == nil {
+		// not registered yet
+		return nil
+	}
+
+	return e.put()
+}
+
+// Deregister revokes the lease, which removes the key.
+func (e *EtcdRegistrar) Deregister() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.lease == "" {
+		return nil
+	}
+
+	lease := e.lease
+	e.lease = ""
+
+	if err := e.call("/v3/lease/revoke", map[string]string{"ID": lease}, nil); err != nil {
+		return err
+	}
+
+	e.logger.Printf("Service deregistered from etcd")
+	return nil
+}
+
+func (e *EtcdRegistrar) grant() error {
+	var resp struct {
+		ID  string `json:"ID"`
+		TTL string `json:"TTL"`
+	}
+
+	if err := e.call("/v3/lease/grant", map[string]interface{}{"TTL": e.config.TTL}, &resp); err != nil {
+		return err
+	}
+
+	if resp.ID == "" {
+		return fmt.Errorf("etcd did not return a lease id")
+	}
+
+	e.lease = resp.ID
+	return nil
+}
+
+// keepAlive refreshes the lease. It returns false if the lease expired.
+func (e *EtcdRegistrar) keepAlive() (bool, error) {
+	var resp struct {
+		Result struct {
+			TTL string `json:"TTL"`
+		} `json:"result"`
+	}
+
+	if err := e.call("/v3/lease/keepalive", map[string]string{"ID": e.lease}, &resp); err != nil {
+		return false, err
+	}
+
+	ttl := resp.Result.TTL
+	return ttl != "" && ttl != "0" && !strings.HasPrefix(ttl, "-"), nil
+}
+
+func (e *EtcdRegistrar) put() error {
+	value, err := json.Marshal(&etcdValue{e.service, e.status, e.note})
+	if err != nil {
+		return err
+	}
+
+	req := map[string]string{
+		"key":   base64.StdEncoding.EncodeToString([]byte(e.key)),
+		"value": base64.StdEncoding.EncodeToString(value),
+		"lease": e.lease,
+	}
+
+	return e.call("/v3/kv/put", req, nil)
+}
+
+func (e *EtcdRegistrar) call(path string, in, out interface{}) error {
+	reqData, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.client.Post(strings.TrimRight(e.config.Address, "/")+path, "application/json", bytes.NewBuffer(reqData))
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("etcd %s: status code %d different from 200: %s", path, resp.StatusCode, string(data))
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	// keepalive is a stream, only the first message is needed
+	if i := bytes.IndexByte(data, '\n'); i != -1 {
+		data = data[:i]
+	}
+
+	return json.Unmarshal(data, out)
+}
@@ -2,12 +2,18 @@ package monitor
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"math/big"
+	"math/rand"
+	"net"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/go-multierror"
@@ -22,41 +28,125 @@ func args(in ...interface{}) []interface{} {
 	return out
 }
 
-type Etherscan struct {
-	addr string
-}
+type EthClient struct {
+	logger *log.Logger
+	client *http.Client
+
+	// Endpoints in order of preference and the index of the active one
+	endpoints []*rpcEndpoint
+	active    int
+	lock      sync.Mutex
+
+	// Probe the preferred endpoints every failbackInterval while running
+	// on a backup one
+	failbackInterval time.Duration
+	lastFailback     time.Time
+
+	// Timeout of each attempt
+	timeout time.Duration
 
-func NewEtherscan(addr string) *Etherscan {
-	return &Etherscan{addr}
+	// Retries and base backoff between them
+	retries int
+	backoff time.Duration
+
+	metrics *Metrics
+	tracer  *Tracer
+
+	// Sends the requests to the endpoints
+	transport RPCTransport
 }
 
-func (e *Etherscan) BlockNumber() (*big.Int, error) {
-	resp, err := http.Get(e.addr)
+func NewEthClient(logger *log.Logger, addrs []string, config *RPCConfig, metrics *Metrics, tracer *Tracer) (*EthClient, error) {
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no rpc endpoints")
+	}
+
+	timeout, err := time.ParseDuration(config.Timeout)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("invalid rpc timeout '%s': %v", config.Timeout, err)
 	}
 
-	defer resp.Body.Close()
+	backoff, err := time.ParseDuration(config.RetryBackoff)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rpc retry backoff '%s': %v", config.RetryBackoff, err)
+	}
+
+	idleConnTimeout, err := time.ParseDuration(config.IdleConnTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rpc idle connection timeout '%s': %v", config.IdleConnTimeout, err)
+	}
+
+	failbackInterval, err := time.ParseDuration(config.FailbackInterval)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rpc failback interval '%s': %v", config.FailbackInterval, err)
+	}
 
-	data, err := ensureOk(resp)
+	tlsConfig, err := newTLSConfig(config.TLSConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	var res string
-	if err = json.Unmarshal(*data, &res); err != nil {
+	transport, err := newAuthTransport(config, NewTransport(timeout, config.MaxIdleConns, idleConnTimeout, tlsConfig))
+	if err != nil {
 		return nil, err
 	}
 
-	return hexToBigInt(res)
+	client := &http.Client{Transport: transport}
+
+	e := &EthClient{
+		logger:           logger,
+		client:           client,
+		failbackInterval: failbackInterval,
+		timeout:          timeout,
+		retries:          config.Retries,
+		backoff:          backoff,
+		metrics:          metrics,
+		tracer:           tracer,
+		transport:        &nodeTransport{client},
+	}
+
+	for _, addr := range addrs {
+		e.endpoints = append(e.endpoints, newRPCEndpoint(addr))
+	}
+
+	if config.ReplayFile != "" {
+		if e.transport, err = LoadReplayer(config.ReplayFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.RecordFile != "" {
+		if e.transport, err = openRecorder(config.RecordFile, e.transport); err != nil {
+			return nil, err
+		}
+	}
+
+	e.setActive(0)
+	return e, nil
 }
 
-type EthClient struct {
-	addr string
+// Close closes the idle connections to the node. The client is not used
+// after a reload replaced it.
+func (e *EthClient) Close() {
+	e.client.CloseIdleConnections()
 }
 
-func NewEthClient(addr string) *EthClient {
-	return &EthClient{addr}
+// NewTransport returns a transport that keeps alive and pools the
+// connections to the node.
+func NewTransport(dialTimeout time.Duration, maxIdleConns int, idleConnTimeout time.Duration, tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   dialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   maxIdleConns,
+		IdleConnTimeout:       idleConnTimeout,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   dialTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
 }
 
 type RPCRequest struct {
@@ -70,9 +160,99 @@ type RPCResult struct {
 	JsonRPC string          `json:"jsonrpc"`
 	ID      int             `json:"id"`
 	Result  json.RawMessage `json:"result"`
+	Error   *RPCError       `json:"error"`
+}
+
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
 }
 
-func (e *EthClient) rpcCall(method string, in, out interface{}) error {
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("status code %d different from 200: %s", e.StatusCode, e.Body)
+}
+
+type DecodeError struct {
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("failed to unmarshall result: %v", e.Err)
+}
+
+// rpcCall calls the method with a timeout per attempt. All the methods
+// used by the client are idempotent reads, so transport errors and timeouts
+// are retried with a jittered exponential backoff.
+func (e *EthClient) rpcCall(ctx context.Context, method string, in, out interface{}) error {
+	var err error
+
+	for attempt := 0; ; attempt++ {
+		err = e.callEndpoints(ctx, method, in, out)
+		if err == nil {
+			return nil
+		}
+
+		if attempt >= e.retries || !isRetryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		select {
+		case <-time.After(jitter(e.backoff << uint(attempt))):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// callEndpoints calls the active endpoint and fails over to the next ones
+// on transport errors.
+func (e *EthClient) callEndpoints(ctx context.Context, method string, in, out interface{}) error {
+	var err error
+
+	for i := 0; i < len(e.endpoints); i++ {
+		endpoint := e.activeEndpoint()
+
+		err = e.rpcCallOnce(ctx, endpoint, method, in, out)
+		if err == nil || !isTransportError(err) || ctx.Err() != nil {
+			return err
+		}
+
+		e.failover(endpoint, err)
+	}
+
+	return err
+}
+
+func (e *EthClient) rpcCallOnce(ctx context.Context, endpoint *rpcEndpoint, method string, in, out interface{}) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+
+	ctx, span := e.tracer.Start(ctx, method, SpanKindClient)
+	span.SetAttribute("rpc.system", "jsonrpc")
+	span.SetAttribute("rpc.method", method)
+	span.SetAttribute("rpc.endpoint", endpoint.label)
+
+	start := time.Now()
+	size := 0
+
+	defer func() {
+		e.metrics.observeRPC(method, endpoint.label, time.Since(start), size, err)
+
+		if err != nil {
+			span.SetAttribute("error.class", errorClass(err))
+		}
+		span.End(err)
+	}()
+
 	if in == nil {
 		in = []interface{}{}
 	}
@@ -84,62 +264,135 @@ func (e *EthClient) rpcCall(method string, in, out interface{}) error {
 		Params:  in,
 	}
 
-	client := &http.Client{}
-
 	reqData, err := json.Marshal(reqBody)
 	if err != nil {
 		return err
 	}
 
-	body := bytes.NewBuffer(reqData)
-
-	req, err := http.NewRequest("POST", e.addr, body)
+	data, err := e.transport.Call(ctx, endpoint.addr, reqData)
 	if err != nil {
 		return err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	size = len(data)
 
-	resp, err := client.Do(req)
+	result, err := parseResult(data)
 	if err != nil {
 		return err
 	}
 
-	defer resp.Body.Close()
+	if err := json.Unmarshal(*result, out); err != nil {
+		return &DecodeError{err}
+	}
+
+	return nil
+}
+
+// RPCTransport sends the json-rpc requests of the client. It is replaced to
+// record or replay the traffic with the node.
+type RPCTransport interface {
+	// Call sends the request to the endpoint, an http url or the path of
+	// an ipc socket, and returns the body of the response
+	Call(ctx context.Context, endpoint string, reqData []byte) ([]byte, error)
+}
+
+// SetTransport replaces the transport of the client (i.e. with a Recorder
+// wrapping the current one or a Replayer).
+func (e *EthClient) SetTransport(transport RPCTransport) {
+	e.transport = transport
+}
 
-	data, err := ensureOk(resp)
+// Transport returns the transport of the client.
+func (e *EthClient) Transport() RPCTransport {
+	return e.transport
+}
+
+// nodeTransport sends the requests to the node over http or ipc.
+type nodeTransport struct {
+	client *http.Client
+}
+
+func (t *nodeTransport) Call(ctx context.Context, endpoint string, reqData []byte) ([]byte, error) {
+	if e := newRPCEndpoint(endpoint); e.ipc {
+		return ipcRequest(ctx, e.addr, reqData)
+	}
+	return t.httpRequest(ctx, endpoint, reqData)
+}
+
+func (t *nodeTransport) httpRequest(ctx context.Context, addr string, reqData []byte) ([]byte, error) {
+	req, err := http.NewRequest("POST", addr, bytes.NewBuffer(reqData))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = json.Unmarshal(*data, out)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.client.Do(req.WithContext(ctx))
 	if err != nil {
-		return fmt.Errorf("failed to unmarshall result: %v", err)
+		return nil, err
 	}
 
-	return err
-}
+	defer resp.Body.Close()
 
-func ensureOk(resp *http.Response) (*json.RawMessage, error) {
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
 
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("status code %d different from 200: %s", resp.StatusCode, string(data))
+		return nil, &StatusError{resp.StatusCode, string(data)}
 	}
 
+	return data, nil
+}
+
+func parseResult(data []byte) (*json.RawMessage, error) {
 	var res RPCResult
 
-	err = json.Unmarshal(data, &res)
+	err := json.Unmarshal(data, &res)
 	if err != nil {
 		return nil, err
 	}
 
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
 	return &res.Result, nil
 }
 
+func isTimeout(err error) bool {
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	return false
+}
+
+// isRetryable returns true for transport errors, timeouts and server errors.
+// Errors returned by the node itself will not change on a retry.
+func isRetryable(err error) bool {
+	switch err := err.(type) {
+	case *RPCError:
+		return false
+	case *StatusError:
+		return err.StatusCode >= 500
+	case net.Error:
+		return true
+	}
+	return err == context.DeadlineExceeded
+}
+
+// jitter returns a random duration between d/2 and d.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
 func hexToBigInt(data string) (*big.Int, error) {
 	blockInt64, err := strconv.ParseInt(data, 0, 64)
 	if err != nil {
@@ -149,24 +402,44 @@ func hexToBigInt(data string) (*big.Int, error) {
 	return big.NewInt(blockInt64), nil
 }
 
-func (e *EthClient) PeerCount() (int64, error) {
+func (e *EthClient) PeerCount(ctx context.Context) (int64, error) {
 	var peers string
-	if err := e.rpcCall("net_peerCount", nil, &peers); err != nil {
+	if err := e.rpcCall(ctx, "net_peerCount", nil, &peers); err != nil {
 		return 0, err
 	}
 
 	return strconv.ParseInt(peers, 0, 64)
 }
 
-func (e *EthClient) Chain() (string, error) {
+func (e *EthClient) Chain(ctx context.Context) (string, error) {
 	var chain string
-	err := e.rpcCall("parity_chain", nil, &chain)
+	err := e.rpcCall(ctx, "parity_chain", nil, &chain)
 	return chain, err
 }
 
-func (e *EthClient) BlockNumber() (*big.Int, error) {
+func (e *EthClient) ClientVersion(ctx context.Context) (string, error) {
+	var version string
+	err := e.rpcCall(ctx, "web3_clientVersion", nil, &version)
+	return version, err
+}
+
+// IsArchive checks if the node keeps the historical state by querying a
+// balance at the first block. Pruned nodes fail to answer it.
+func (e *EthClient) IsArchive(ctx context.Context) (bool, error) {
+	var balance string
+	err := e.rpcCall(ctx, "eth_getBalance", args("0x0000000000000000000000000000000000000000", "0x1"), &balance)
+	if err == nil {
+		return true, nil
+	}
+	if _, ok := err.(*RPCError); ok {
+		return false, nil
+	}
+	return false, err
+}
+
+func (e *EthClient) BlockNumber(ctx context.Context) (*big.Int, error) {
 	var block string
-	if err := e.rpcCall("eth_blockNumber", nil, &block); err != nil {
+	if err := e.rpcCall(ctx, "eth_blockNumber", nil, &block); err != nil {
 		return nil, err
 	}
 
@@ -174,31 +447,48 @@ func (e *EthClient) BlockNumber() (*big.Int, error) {
 }
 
 type Block struct {
+	Number       *big.Int
+	Hash         string
+	ParentHash   string
 	Timestamp    *time.Time
 	Transactions int
 	GasLimit     *big.Int
+	GasUsed      *big.Int
+
+	// Base fee per gas, nil before london
+	BaseFee *big.Int
 }
 
-func (e *EthClient) BlockByNumber(num *big.Int) (*Block, error) {
+func (e *EthClient) BlockByNumber(ctx context.Context, num *big.Int) (*Block, error) {
 	hash := fmt.Sprintf("0x%x", num)
 
 	var result error
 
 	var raw map[string]interface{}
-	if err := e.rpcCall("eth_getBlockByNumber", args(hash, true), &raw); err != nil {
+	if err := e.rpcCall(ctx, "eth_getBlockByNumber", args(hash, true), &raw); err != nil {
 		return nil, err
 	}
+	if raw == nil {
+		return nil, fmt.Errorf("block %s not found", num)
+	}
 
-	block := &Block{}
+	block := &Block{Number: num}
+
+	if hash, ok := raw["hash"].(string); ok {
+		block.Hash = hash
+	}
+	if parentHash, ok := raw["parentHash"].(string); ok {
+		block.ParentHash = parentHash
+	}
 
 	if timestampHex, ok := raw["timestamp"]; ok {
-		timestamp, err := hexToBigInt(timestampHex.(string))
-		if err != nil {
-			result = multierror.Append(result, err)
+		timestampStr, _ := timestampHex.(string)
+		if timestamp, err := hexToBigInt(timestampStr); err != nil {
+			result = multierror.Append(result, fmt.Errorf("invalid timestamp '%v': %v", timestampHex, err))
+		} else {
+			tm := time.Unix(timestamp.Int64(), 0)
+			block.Timestamp = &tm
 		}
-
-		tm := time.Unix(timestamp.Int64(), 0)
-		block.Timestamp = &tm
 	} else {
 		result = multierror.Append(result, fmt.Errorf("timestamp field not found"))
 	}
@@ -214,17 +504,37 @@ func (e *EthClient) BlockByNumber(num *big.Int) (*Block, error) {
 	}
 
 	if gasLimitRaw, ok := raw["gasLimit"]; ok {
-		gasLimit, err := hexToBigInt(gasLimitRaw.(string))
+		gasLimitStr, _ := gasLimitRaw.(string)
+		if gasLimit, err := hexToBigInt(gasLimitStr); err != nil {
+			result = multierror.Append(result, fmt.Errorf("invalid gaslimit '%v': %v", gasLimitRaw, err))
+		} else {
+			block.GasLimit = gasLimit
+		}
+	} else {
+		result = multierror.Append(result, fmt.Errorf("gaslimit field not found"))
+	}
+
+	if gasUsedRaw, ok := raw["gasUsed"]; ok {
+		gasUsedStr, _ := gasUsedRaw.(string)
+		if gasUsed, err := hexToBigInt(gasUsedStr); err != nil {
+			result = multierror.Append(result, fmt.Errorf("invalid gasused '%v': %v", gasUsedRaw, err))
+		} else {
+			block.GasUsed = gasUsed
+		}
+	} else {
+		result = multierror.Append(result, fmt.Errorf("gasused field not found"))
+	}
+
+	if baseFeeRaw, ok := raw["baseFeePerGas"].(string); ok {
+		baseFee, err := hexToBigInt(baseFeeRaw)
 		if err != nil {
 			result = multierror.Append(result, err)
 		}
 
-		block.GasLimit = gasLimit
-	} else {
-		result = multierror.Append(result, fmt.Errorf("gaslimit field not found"))
+		block.BaseFee = baseFee
 	}
 
-	return block, nil
+	return block, result
 }
 
 type RpcSync struct {
@@ -235,9 +545,9 @@ type RpcSync struct {
 	WarpChunksProcessed *big.Int
 }
 
-func (e *EthClient) Syncing() (*RpcSync, error) {
+func (e *EthClient) Syncing(ctx context.Context) (*RpcSync, error) {
 	var raw interface{}
-	if err := e.rpcCall("eth_syncing", nil, &raw); err != nil {
+	if err := e.rpcCall(ctx, "eth_syncing", nil, &raw); err != nil {
 		return nil, err
 	}
 
@@ -271,14 +581,19 @@ func (e *EthClient) Syncing() (*RpcSync, error) {
 		return nil, fmt.Errorf("failed to parse starting block as big.Int: %s", res.HighestBlock)
 	}
 
-	warpChunksAmount, err := hexToBigInt(res.WarpChunksAmount)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse warpChunksAmount as big.Int: %s", res.HighestBlock)
+	// warp fields are only reported by parity while warp syncing
+	warpChunksAmount, warpChunksProcessed := big.NewInt(0), big.NewInt(0)
+
+	if res.WarpChunksAmount != "" {
+		if warpChunksAmount, err = hexToBigInt(res.WarpChunksAmount); err != nil {
+			return nil, fmt.Errorf("failed to parse warpChunksAmount as big.Int: %s", res.WarpChunksAmount)
+		}
 	}
 
-	warpChunksProcessed, err := hexToBigInt(res.WarpChunksProcessed)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse warpChunksProcessed as big.Int: %s", res.HighestBlock)
+	if res.WarpChunksProcessed != "" {
+		if warpChunksProcessed, err = hexToBigInt(res.WarpChunksProcessed); err != nil {
+			return nil, fmt.Errorf("failed to parse warpChunksProcessed as big.Int: %s", res.WarpChunksProcessed)
+		}
 	}
 
 	sync := &RpcSync{
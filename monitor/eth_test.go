@@ -0,0 +1,34 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBlockByNumberInvalidFields(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"jsonrpc":"2.0","id":1,"result":{"hash":"0x01","timestamp":"0x5f5e100","transactions":[],"gasLimit":30000000,"gasUsed":null}}`)
+	}))
+	defer server.Close()
+
+	client, err := NewEthClient(testLogger, []string{server.URL}, DefaultRPCConfig(), NewMetrics(map[string]string{}, nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	block, err := client.BlockByNumber(context.Background(), big.NewInt(1000))
+	if err == nil || !strings.Contains(err.Error(), "invalid gaslimit '3e+07'") || !strings.Contains(err.Error(), "invalid gasused '<nil>'") {
+		t.Errorf("expected the invalid gas fields reported, got %v", err)
+	}
+
+	// The valid fields are kept
+	if block == nil || block.Hash != "0x01" || block.Timestamp == nil || block.GasLimit != nil || block.GasUsed != nil {
+		t.Errorf("expected a partial block, got %+v", block)
+	}
+}
@@ -0,0 +1,265 @@
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EtherscanError is an error response of the etherscan api, with status 0
+// (i.e. {"status":"0","message":"NOTOK","result":"Max rate limit reached"}).
+type EtherscanError struct {
+	Message string
+	Result  string
+}
+
+func (e *EtherscanError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("etherscan error: %s", e.Result)
+	}
+	return fmt.Sprintf("etherscan error %s: %s", e.Message, e.Result)
+}
+
+// RateLimitError is returned while the api is rate limited, without calling
+// it until the backoff expires.
+type RateLimitError struct {
+	Err     error
+	RetryAt time.Time
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("etherscan rate limited, retrying after %s: %v", e.RetryAt.Format(time.RFC3339), e.Err)
+}
+
+// isRateLimit returns true if the error is a rate limit response, either a
+// 429 status code or an etherscan error about the rate limit.
+func isRateLimit(err error) bool {
+	switch err := err.(type) {
+	case *StatusError:
+		return err.StatusCode == http.StatusTooManyRequests
+	case *EtherscanError:
+		return strings.Contains(strings.ToLower(err.Result), "rate limit")
+	}
+	return false
+}
+
+// Etherscan reads the head of the chain from an etherscan compatible api.
+// The block number is cached for the cache ttl and the api is not called
+// while rate limited.
+type Etherscan struct {
+	addr   string
+	client *http.Client
+
+	// Added to the requests only, so it is not part of the errors
+	apiKey string
+
+	cacheTTL time.Duration
+
+	// Backoff after a rate limit response, doubled on every consecutive
+	// one up to maxBackoff
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	// Serializes the calls so the callers sharing the client wait for the
+	// call in flight and use its result
+	lock sync.Mutex
+
+	blockNumber *big.Int
+	fetched     time.Time
+
+	currentBackoff time.Duration
+	rateLimit      *RateLimitError
+}
+
+func NewEtherscan(addr string, client *http.Client, config *EtherscanConfig) (*Etherscan, error) {
+	cacheTTL, err := time.ParseDuration(config.CacheTTL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid etherscan cache ttl '%s': %v", config.CacheTTL, err)
+	}
+
+	backoff, err := time.ParseDuration(config.RateLimitBackoff)
+	if err != nil {
+		return nil, fmt.Errorf("invalid etherscan rate limit backoff '%s': %v", config.RateLimitBackoff, err)
+	}
+
+	maxBackoff, err := time.ParseDuration(config.MaxBackoff)
+	if err != nil {
+		return nil, fmt.Errorf("invalid etherscan max backoff '%s': %v", config.MaxBackoff, err)
+	}
+
+	if _, err := url.Parse(addr); err != nil {
+		return nil, fmt.Errorf("invalid etherscan url '%s': %v", addr, err)
+	}
+
+	return &Etherscan{
+		addr:       addr,
+		client:     client,
+		apiKey:     config.APIKey,
+		cacheTTL:   cacheTTL,
+		backoff:    backoff,
+		maxBackoff: maxBackoff,
+	}, nil
+}
+
+// Etherscan clients by url and config, shared by the nodes on the same
+// chain
+var (
+	etherscans     = map[string]*Etherscan{}
+	etherscansLock sync.Mutex
+)
+
+// SharedEtherscan returns the client of the api shared by every caller with
+// the same url and config, so the cache and the rate limit apply to all the
+// nodes on the same chain.
+func SharedEtherscan(addr string, timeout time.Duration, config *EtherscanConfig) (*Etherscan, error) {
+	key := fmt.Sprintf("%s %+v", addr, *config)
+
+	etherscansLock.Lock()
+	defer etherscansLock.Unlock()
+
+	if e, ok := etherscans[key]; ok {
+		return e, nil
+	}
+
+	e, err := NewEtherscan(addr, &http.Client{Timeout: timeout}, config)
+	if err != nil {
+		return nil, err
+	}
+
+	etherscans[key] = e
+	return e, nil
+}
+
+func (e *Etherscan) BlockNumber(ctx context.Context) (*big.Int, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	now := time.Now()
+
+	if e.blockNumber != nil && now.Sub(e.fetched) < e.cacheTTL {
+		return e.blockNumber, nil
+	}
+
+	if e.rateLimit != nil && now.Before(e.rateLimit.RetryAt) {
+		return nil, e.rateLimit
+	}
+
+	blockNumber, err := e.fetchBlockNumber(ctx)
+	if err != nil {
+		if !isRateLimit(err) {
+			return nil, err
+		}
+
+		e.currentBackoff *= 2
+		if e.currentBackoff == 0 {
+			e.currentBackoff = e.backoff
+		}
+		if e.currentBackoff > e.maxBackoff {
+			e.currentBackoff = e.maxBackoff
+		}
+
+		e.rateLimit = &RateLimitError{Err: err, RetryAt: now.Add(e.currentBackoff)}
+		return nil, e.rateLimit
+	}
+
+	e.currentBackoff = 0
+	e.rateLimit = nil
+
+	e.blockNumber = blockNumber
+	e.fetched = now
+
+	return blockNumber, nil
+}
+
+func (e *Etherscan) fetchBlockNumber(ctx context.Context) (*big.Int, error) {
+	req, err := http.NewRequest("GET", e.addr, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.apiKey != "" {
+		query := req.URL.Query()
+		query.Set("apikey", e.apiKey)
+		req.URL.RawQuery = query.Encode()
+	}
+
+	resp, err := e.client.Do(req.WithContext(ctx))
+	if err != nil {
+		// The url has the api key
+		if urlErr, ok := err.(*url.Error); ok {
+			return nil, urlErr.Err
+		}
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, &StatusError{resp.StatusCode, string(data)}
+	}
+
+	result, err := parseEtherscanResult(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var res string
+	if err = json.Unmarshal(result, &res); err != nil {
+		return nil, &DecodeError{err}
+	}
+
+	return hexToBigInt(res)
+}
+
+// parseEtherscanResult returns the result of a response of the api. The
+// proxy module answers like the node (jsonrpc, result and error) while the
+// errors of the api have a status, a message and the error as result. The
+// proxy module also reports some errors, like the rate limit, as a result
+// that is not a hex number.
+func parseEtherscanResult(data []byte) (json.RawMessage, error) {
+	var res struct {
+		Status  string          `json:"status"`
+		Message string          `json:"message"`
+		Result  json.RawMessage `json:"result"`
+		Error   *RPCError       `json:"error"`
+	}
+
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, &DecodeError{err}
+	}
+
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if res.Status == "0" {
+		var result string
+		if err := json.Unmarshal(res.Result, &result); err != nil {
+			result = string(res.Result)
+		}
+		return nil, &EtherscanError{Message: res.Message, Result: result}
+	}
+
+	if len(res.Result) == 0 {
+		return nil, &DecodeError{fmt.Errorf("result field not found")}
+	}
+
+	var result string
+	if err := json.Unmarshal(res.Result, &result); err == nil && !strings.HasPrefix(result, "0x") {
+		return nil, &EtherscanError{Message: res.Message, Result: result}
+	}
+
+	return res.Result, nil
+}
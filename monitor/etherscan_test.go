@@ -0,0 +1,194 @@
+package monitor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseEtherscanResult(t *testing.T) {
+	cases := []struct {
+		name      string
+		data      string
+		result    string
+		err       string
+		rateLimit bool
+	}{
+		{"proxy", `{"jsonrpc":"2.0","id":83,"result":"0x3e8"}`, `"0x3e8"`, "", false},
+		{"rate limit", `{"status":"0","message":"NOTOK","result":"Max rate limit reached"}`, "", "etherscan error NOTOK: Max rate limit reached", true},
+		{"invalid api key", `{"status":"0","message":"NOTOK","result":"Invalid API Key"}`, "", "etherscan error NOTOK: Invalid API Key", false},
+		{"proxy rate limit", `{"jsonrpc":"2.0","id":1,"result":"Max rate limit reached, please use API Key for higher rate limit"}`, "", "etherscan error: Max rate limit reached, please use API Key for higher rate limit", true},
+		{"rpc error", `{"jsonrpc":"2.0","id":83,"error":{"code":-32005,"message":"limit exceeded"}}`, "", "limit exceeded", false},
+		{"no result", `{"jsonrpc":"2.0","id":83}`, "", "result field not found", false},
+		{"invalid json", `<html>`, "", "failed to unmarshall result", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			result, err := parseEtherscanResult([]byte(c.data))
+			if c.err == "" {
+				if err != nil || string(result) != c.result {
+					t.Errorf("expected %s, got %s %v", c.result, result, err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("expected the error '%s', got %s %v", c.err, result, err)
+			}
+			if isRateLimit(err) != c.rateLimit {
+				t.Errorf("expected rate limit %v for %v", c.rateLimit, err)
+			}
+		})
+	}
+}
+
+// expireBackoff makes the next call to the api, as if the backoff expired.
+func expireBackoff(e *Etherscan) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.rateLimit != nil {
+		e.rateLimit.RetryAt = time.Time{}
+	}
+}
+
+func TestEtherscanBackoff(t *testing.T) {
+	_, etherscan := startTestNode(t)
+	etherscan.SetRateLimited(true)
+
+	e, err := NewEtherscan(etherscan.URL(), http.DefaultClient, &EtherscanConfig{CacheTTL: "0s", RateLimitBackoff: "1m", MaxBackoff: "3m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// Doubled on every rate limit up to the max backoff
+	for i, backoff := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		start := time.Now()
+		_, err := e.BlockNumber(ctx)
+
+		rateLimit, ok := err.(*RateLimitError)
+		if !ok {
+			t.Fatalf("call %d: expected a rate limit error, got %v", i, err)
+		}
+		if retry := rateLimit.RetryAt.Sub(start); retry < backoff || retry > backoff+time.Second {
+			t.Errorf("call %d: expected a backoff of %s, got %s", i, backoff, retry)
+		}
+
+		// The api is not called while backed off
+		if _, err := e.BlockNumber(ctx); err != rateLimit {
+			t.Errorf("call %d: expected the same rate limit error while backed off, got %v", i, err)
+		}
+		if etherscan.Calls() != i+1 {
+			t.Errorf("call %d: expected %d calls to the api, got %d", i, i+1, etherscan.Calls())
+		}
+
+		expireBackoff(e)
+	}
+
+	// A response resets the backoff
+	etherscan.SetRateLimited(false)
+	if _, err := e.BlockNumber(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	etherscan.SetRateLimited(true)
+	_, err = e.BlockNumber(ctx)
+	if rateLimit, ok := err.(*RateLimitError); !ok || time.Until(rateLimit.RetryAt) > time.Minute {
+		t.Errorf("expected the backoff reset to 1m, got %v", err)
+	}
+}
+
+func TestEtherscanOtherErrorsNotBackedOff(t *testing.T) {
+	_, etherscan := startTestNode(t)
+	etherscan.SetHTTPStatus(500)
+
+	e, err := NewEtherscan(etherscan.URL(), http.DefaultClient, &EtherscanConfig{CacheTTL: "0s", RateLimitBackoff: "1m", MaxBackoff: "3m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := e.BlockNumber(context.Background()); err == nil || isRateLimit(err) {
+			t.Errorf("expected a status error, got %v", err)
+		}
+	}
+	if etherscan.Calls() != 2 {
+		t.Errorf("expected every call sent, got %d", etherscan.Calls())
+	}
+}
+
+func TestEtherscanSharedCache(t *testing.T) {
+	node, etherscan := startTestNode(t)
+
+	// Two nodes of the same chain
+	monitors := []*Monitor{}
+	for i := 0; i < 2; i++ {
+		config := testConfig(node, etherscan)
+		config.EtherscanConfig.CacheTTL = "1m"
+		m, _ := newTestMonitor(t, config)
+		runTestCycle(m)
+		monitors = append(monitors, m)
+	}
+
+	if monitors[0].reference() != monitors[1].reference() {
+		t.Errorf("expected the etherscan client shared")
+	}
+	if etherscan.Calls() != 1 {
+		t.Errorf("expected 1 call to the api, got %d", etherscan.Calls())
+	}
+	for _, m := range monitors {
+		if !m.isSynced() {
+			t.Errorf("expected the nodes synced with the cached head")
+		}
+	}
+}
+
+func TestEtherscanAPIKey(t *testing.T) {
+	_, etherscan := startTestNode(t)
+	etherscan.SetAPIKey("secret")
+
+	e, err := NewEtherscan(etherscan.URL(), http.DefaultClient, &EtherscanConfig{CacheTTL: "0s", RateLimitBackoff: "1m", MaxBackoff: "3m", APIKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.BlockNumber(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(e.addr, "secret") {
+		t.Errorf("expected the api key out of the url, got %s", e.addr)
+	}
+
+	e, err = NewEtherscan(etherscan.URL(), http.DefaultClient, &EtherscanConfig{CacheTTL: "0s", RateLimitBackoff: "1m", MaxBackoff: "3m", APIKey: "wrong"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.BlockNumber(context.Background()); err == nil || !strings.Contains(err.Error(), "Invalid API Key") || isRateLimit(err) {
+		t.Errorf("expected the invalid api key error, got %v", err)
+	}
+}
+
+func TestEtherscanErrorsWithoutAPIKey(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	addr := server.URL + "/api?module=proxy&action=eth_blockNumber"
+	server.Close()
+
+	e, err := NewEtherscan(addr, http.DefaultClient, &EtherscanConfig{CacheTTL: "0s", RateLimitBackoff: "1m", MaxBackoff: "3m", APIKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = e.BlockNumber(context.Background())
+	if err == nil {
+		t.Fatal("expected the api unreachable")
+	}
+	if strings.Contains(err.Error(), "secret") || strings.Contains(err.Error(), "apikey") {
+		t.Errorf("expected the error without the api key, got %v", err)
+	}
+	if errorClass(err) != errorClassConnection {
+		t.Errorf("expected a connection error, got %s %v", errorClass(err), err)
+	}
+}
@@ -0,0 +1,135 @@
+package ethtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// Etherscan is a stand-in of the etherscan proxy api (eth_blockNumber). It
+// reports the head of a node, plus the blocks set with SetAhead, as the head
+// of the chain.
+type Etherscan struct {
+	node *Node
+
+	lock        sync.Mutex
+	ahead       int64
+	httpStatus  int
+	rateLimited bool
+	apiKey      string
+	calls       int
+
+	server *server
+}
+
+func NewEtherscan(node *Node) *Etherscan {
+	return &Etherscan{node: node}
+}
+
+// Start serves the api on addr (i.e. 127.0.0.1:0 for a random port).
+func (e *Etherscan) Start(addr string) error {
+	server, err := startServer(addr, http.HandlerFunc(e.serveHTTP))
+	if err != nil {
+		return err
+	}
+
+	e.server = server
+	return nil
+}
+
+// URL returns the url of the eth_blockNumber api, the reference url of the
+// exporter.
+func (e *Etherscan) URL() string {
+	return e.server.url() + "/api?module=proxy&action=eth_blockNumber"
+}
+
+// Close stops the api.
+func (e *Etherscan) Close() error {
+	return e.server.close()
+}
+
+// SetAhead makes the chain head the given blocks ahead of the node, so the
+// node is behind. Negative values put the node ahead.
+func (e *Etherscan) SetAhead(blocks int64) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.ahead = blocks
+}
+
+// SetHTTPStatus makes every request fail with the http status code. Zero
+// restores the responses.
+func (e *Etherscan) SetHTTPStatus(status int) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.httpStatus = status
+}
+
+// SetRateLimited makes every request fail with the rate limit error of the
+// api.
+func (e *Etherscan) SetRateLimited(rateLimited bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.rateLimited = rateLimited
+}
+
+// SetAPIKey makes the requests without the api key fail. Empty accepts every
+// request.
+func (e *Etherscan) SetAPIKey(apiKey string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.apiKey = apiKey
+}
+
+// Calls returns the number of requests to the api.
+func (e *Etherscan) Calls() int {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return e.calls
+}
+
+// apiError is an error response of the api, outside of the proxy module
+// format.
+type apiError struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Result  string `json:"result"`
+}
+
+func (e *Etherscan) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	e.lock.Lock()
+	e.calls++
+	ahead, status, rateLimited, apiKey := e.ahead, e.httpStatus, e.rateLimited, e.apiKey
+	e.lock.Unlock()
+
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if apiKey != "" && r.URL.Query().Get("apikey") != apiKey {
+		json.NewEncoder(w).Encode(&apiError{"0", "NOTOK", "Invalid API Key"})
+		return
+	}
+	if rateLimited {
+		json.NewEncoder(w).Encode(&apiError{"0", "NOTOK", "Max rate limit reached"})
+		return
+	}
+
+	head := int64(e.node.Head()) + ahead
+	if head < 0 {
+		head = 0
+	}
+
+	json.NewEncoder(w).Encode(&response{
+		JsonRPC: "2.0",
+		ID:      json.RawMessage("83"),
+		Result:  hexUint(uint64(head)),
+	})
+}
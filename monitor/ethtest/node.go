@@ -0,0 +1,497 @@
+// Package ethtest provides an in-process ethereum node and etherscan api to
+// test and demo the exporter without a real node. The chain and the
+// behaviour of both are changed while they run (block production, reorgs,
+// sync, peers, latency and errors).
+package ethtest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Config is the initial state of the node.
+type Config struct {
+	// Reported by parity_chain and web3_clientVersion
+	Chain         string
+	ClientVersion string
+
+	// Head of the chain on start. The previous blocks are generated one
+	// block time apart.
+	StartBlock uint64
+
+	// Interval between blocks. Zero only produces blocks with Mine.
+	BlockTime time.Duration
+
+	Peers int64
+
+	// Gas limit of the blocks and base fee per gas (zero for blocks
+	// before london)
+	GasLimit uint64
+	BaseFee  uint64
+
+	// Archive nodes answer state queries of old blocks
+	Archive bool
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Chain:         "foundation",
+		ClientVersion: "Parity//v1.10.0-stable/x86_64-linux-gnu/rustc1.24.1",
+		StartBlock:    1000,
+		BlockTime:     2 * time.Second,
+		Peers:         5,
+		GasLimit:      30000000,
+		BaseFee:       7000000000,
+	}
+}
+
+// Error is a json-rpc error returned by the node.
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// block is a block of the simulated chain.
+type block struct {
+	number       uint64
+	hash         string
+	parentHash   string
+	timestamp    time.Time
+	transactions int
+	gasUsed      uint64
+}
+
+// Node is the simulated node, serving the json-rpc methods used by the
+// exporter over http.
+type Node struct {
+	config *Config
+
+	lock sync.Mutex
+
+	head   uint64
+	blocks map[uint64]*block
+
+	// Number of reorgs of each height, part of the hash of the blocks
+	forks map[uint64]int
+
+	// Time of the start block, the previous ones are generated from it
+	startTime time.Time
+
+	// Highest block of the sync, zero if synced
+	syncHighest uint64
+
+	blockTime  time.Duration
+	peers      int64
+	latency    time.Duration
+	httpStatus int
+	down       bool
+
+	// Errors returned by method, '*' for every method
+	errors map[string]*Error
+
+	// Calls by method
+	calls map[string]int
+
+	// Wakes the block producer when the block time changes
+	wakeCh chan struct{}
+
+	server *server
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewNode creates the node with the chain of the config. It does not serve
+// requests until started.
+func NewNode(config *Config) *Node {
+	n := &Node{
+		config:    config,
+		head:      config.StartBlock,
+		blocks:    map[uint64]*block{},
+		forks:     map[uint64]int{},
+		startTime: time.Now(),
+		blockTime: config.BlockTime,
+		peers:     config.Peers,
+		errors:    map[string]*Error{},
+		calls:     map[string]int{},
+		wakeCh:    make(chan struct{}, 1),
+	}
+
+	return n
+}
+
+// Start serves the json-rpc api on addr (i.e. 127.0.0.1:0 for a random
+// port) and starts producing blocks.
+func (n *Node) Start(addr string) error {
+	server, err := startServer(addr, http.HandlerFunc(n.serveHTTP))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	n.server = server
+	n.cancel = cancel
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		n.produce(ctx)
+	}()
+
+	return nil
+}
+
+// URL returns the url of the json-rpc api.
+func (n *Node) URL() string {
+	return n.server.url()
+}
+
+// Close stops the node.
+func (n *Node) Close() error {
+	n.cancel()
+	n.wg.Wait()
+	return n.server.close()
+}
+
+// produce mines a block every block time.
+func (n *Node) produce(ctx context.Context) {
+	for {
+		n.lock.Lock()
+		blockTime := n.blockTime
+		n.lock.Unlock()
+
+		var tick <-chan time.Time
+		if blockTime > 0 {
+			tick = time.After(blockTime)
+		}
+
+		select {
+		case <-tick:
+			n.Mine(1)
+		case <-n.wakeCh:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Mine produces count blocks now.
+func (n *Node) Mine(count int) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	for i := 0; i < count; i++ {
+		n.head++
+		n.blocks[n.head] = n.newBlock(n.head, time.Now())
+	}
+}
+
+// Reorg replaces the last depth blocks with blocks of a different fork.
+func (n *Node) Reorg(depth int) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if uint64(depth) > n.head {
+		depth = int(n.head)
+	}
+
+	for number := n.head - uint64(depth) + 1; number <= n.head; number++ {
+		timestamp := n.block(number).timestamp
+
+		n.forks[number]++
+		n.blocks[number] = n.newBlock(number, timestamp)
+	}
+}
+
+// SetBlockTime changes the interval between blocks. Zero stops the block
+// production (a stalled node).
+func (n *Node) SetBlockTime(blockTime time.Duration) {
+	n.lock.Lock()
+	n.blockTime = blockTime
+	n.lock.Unlock()
+
+	select {
+	case n.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// SetSyncing makes the node report a sync up to the highest block. Zero
+// makes the node synced.
+func (n *Node) SetSyncing(highest uint64) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.syncHighest = highest
+}
+
+// SetPeers changes the peers of the node.
+func (n *Node) SetPeers(peers int64) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.peers = peers
+}
+
+// SetLatency delays every response.
+func (n *Node) SetLatency(latency time.Duration) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.latency = latency
+}
+
+// SetError makes the method, or every method with '*', return the json-rpc
+// error. A nil error removes it.
+func (n *Node) SetError(method string, err *Error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if err == nil {
+		delete(n.errors, method)
+	} else {
+		n.errors[method] = err
+	}
+}
+
+// SetHTTPStatus makes every request fail with the http status code. Zero
+// restores the responses.
+func (n *Node) SetHTTPStatus(status int) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.httpStatus = status
+}
+
+// SetDown makes the node close the connections without a response, as if
+// it was unreachable.
+func (n *Node) SetDown(down bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.down = down
+}
+
+// Head returns the number of the last block.
+func (n *Node) Head() uint64 {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return n.head
+}
+
+// Hash returns the hash of the block, empty if it does not exist.
+func (n *Node) Hash(number uint64) string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if number > n.head {
+		return ""
+	}
+	return n.block(number).hash
+}
+
+// Calls returns the number of calls to the method.
+func (n *Node) Calls(method string) int {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return n.calls[method]
+}
+
+// block returns the block with the number, generating the blocks before the
+// start block on every call so they take no memory. The number must not be
+// after the head.
+func (n *Node) block(number uint64) *block {
+	if b, ok := n.blocks[number]; ok {
+		return b
+	}
+
+	interval := n.config.BlockTime
+	if interval == 0 {
+		interval = 15 * time.Second
+	}
+
+	var timestamp time.Time
+	if number <= n.config.StartBlock {
+		timestamp = n.startTime.Add(-time.Duration(n.config.StartBlock-number) * interval)
+	}
+
+	return n.newBlock(number, timestamp)
+}
+
+func (n *Node) newBlock(number uint64, timestamp time.Time) *block {
+	b := &block{
+		number:       number,
+		hash:         blockHash(number, n.forks[number]),
+		timestamp:    timestamp,
+		transactions: int(number % 100),
+		gasUsed:      n.config.GasLimit / 100 * (number % 100),
+	}
+	if number > 0 {
+		b.parentHash = blockHash(number-1, n.forks[number-1])
+	} else {
+		b.parentHash = blockHash(0, -1)
+	}
+	return b
+}
+
+// blockHash returns a hash unique to the height and fork.
+func blockHash(number uint64, fork int) string {
+	return fmt.Sprintf("0x%x", sha256.Sum256([]byte(fmt.Sprintf("%d/%d", number, fork))))
+}
+
+type request struct {
+	ID     json.RawMessage   `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+type response struct {
+	JsonRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+func (n *Node) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	n.lock.Lock()
+	latency, status, down := n.latency, n.httpStatus, n.down
+	n.lock.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if down {
+		if hijacker, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hijacker.Hijack(); err == nil {
+				conn.Close()
+				return
+			}
+		}
+	}
+
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := &response{JsonRPC: "2.0", ID: req.ID}
+	resp.Result, resp.Error = n.call(req.Method, req.Params)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func hexUint(n uint64) string {
+	return "0x" + strconv.FormatUint(n, 16)
+}
+
+// call runs the method. The result is nil for unknown blocks.
+func (n *Node) call(method string, params []json.RawMessage) (interface{}, *Error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.calls[method]++
+
+	if err, ok := n.errors[method]; ok {
+		return nil, err
+	}
+	if err, ok := n.errors["*"]; ok {
+		return nil, err
+	}
+
+	switch method {
+	case "web3_clientVersion":
+		return n.config.ClientVersion, nil
+	case "parity_chain":
+		return n.config.Chain, nil
+	case "net_peerCount":
+		return hexUint(uint64(n.peers)), nil
+	case "eth_blockNumber":
+		return hexUint(n.head), nil
+
+	case "eth_syncing":
+		if n.syncHighest == 0 {
+			return false, nil
+		}
+		return map[string]string{
+			"startingBlock": hexUint(n.config.StartBlock),
+			"currentBlock":  hexUint(n.head),
+			"highestBlock":  hexUint(n.syncHighest),
+		}, nil
+
+	case "eth_getBalance":
+		if !n.config.Archive {
+			return nil, &Error{-32000, "missing trie node"}
+		}
+		return "0x0", nil
+
+	case "eth_getBlockByNumber":
+		if len(params) == 0 {
+			return nil, &Error{-32602, "missing block number"}
+		}
+
+		var tag string
+		if err := json.Unmarshal(params[0], &tag); err != nil {
+			return nil, &Error{-32602, fmt.Sprintf("invalid block number: %v", err)}
+		}
+
+		number := n.head
+		if tag != "latest" {
+			parsed, err := strconv.ParseUint(tag, 0, 64)
+			if err != nil {
+				return nil, &Error{-32602, fmt.Sprintf("invalid block number '%s'", tag)}
+			}
+			number = parsed
+		}
+		if number > n.head {
+			return nil, nil
+		}
+
+		return n.blockResult(n.block(number)), nil
+	}
+
+	return nil, &Error{-32601, fmt.Sprintf("the method %s does not exist/is not available", method)}
+}
+
+func (n *Node) blockResult(b *block) map[string]interface{} {
+	transactions := []interface{}{}
+	for i := 0; i < b.transactions; i++ {
+		transactions = append(transactions, map[string]string{
+			"hash": blockHash(b.number, 1000+i),
+		})
+	}
+
+	result := map[string]interface{}{
+		"number":       hexUint(b.number),
+		"hash":         b.hash,
+		"parentHash":   b.parentHash,
+		"timestamp":    hexUint(uint64(b.timestamp.Unix())),
+		"transactions": transactions,
+		"gasLimit":     hexUint(n.config.GasLimit),
+		"gasUsed":      hexUint(b.gasUsed),
+	}
+	if n.config.BaseFee != 0 {
+		result["baseFeePerGas"] = hexUint(n.config.BaseFee)
+	}
+
+	return result
+}
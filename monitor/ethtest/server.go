@@ -0,0 +1,37 @@
+package ethtest
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// server is the http server of the node and the etherscan api.
+type server struct {
+	server   *http.Server
+	listener net.Listener
+}
+
+func startServer(addr string, handler http.Handler) (*server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start listener on %s: %v", addr, err)
+	}
+
+	s := &server{
+		server:   &http.Server{Handler: handler},
+		listener: l,
+	}
+
+	go s.server.Serve(l)
+
+	return s, nil
+}
+
+func (s *server) url() string {
+	return "http://" + s.listener.Addr().String()
+}
+
+func (s *server) close() error {
+	return s.server.Close()
+}
@@ -0,0 +1,291 @@
+package monitor
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Formats of the /metrics endpoint
+const (
+	FormatPrometheus  = "prometheus"
+	FormatOpenMetrics = "openmetrics"
+	FormatJSON        = "json"
+)
+
+const openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// Formats of the media types of the Accept header
+var acceptFormats = map[string]string{
+	"application/openmetrics-text": FormatOpenMetrics,
+	"application/json":             FormatJSON,
+	"text/plain":                   FormatPrometheus,
+}
+
+// metricsFormat returns the format requested with the format query
+// parameter or, if missing, negotiated with the Accept header. The media
+// type with the highest quality is used, the first one for equal
+// qualities.
+func metricsFormat(req *http.Request) (string, error) {
+	if format := req.URL.Query().Get("format"); format != "" {
+		switch format {
+		case FormatPrometheus, FormatOpenMetrics, FormatJSON:
+			return format, nil
+		}
+		return "", badRequest("Format %s not found. '%s', '%s' and '%s' are the only valid options", format, FormatPrometheus, FormatOpenMetrics, FormatJSON)
+	}
+
+	format, quality := FormatPrometheus, 0.0
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+
+		f, ok := acceptFormats[mediaType]
+		if !ok {
+			continue
+		}
+
+		q := 1.0
+		if str, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(str, 64); err != nil {
+				continue
+			}
+		}
+		if q > quality {
+			format, quality = f, q
+		}
+	}
+
+	return format, nil
+}
+
+// MetricsSnapshot is the json view of the metrics.
+type MetricsSnapshot struct {
+	Timestamp time.Time       `json:"timestamp"`
+	Metrics   []*MetricFamily `json:"metrics"`
+}
+
+type MetricFamily struct {
+	Name    string          `json:"name"`
+	Help    string          `json:"help,omitempty"`
+	Type    string          `json:"type"`
+	Samples []*MetricSample `json:"samples"`
+}
+
+// MetricSample is a metric with its labels. Gauges, counters and untyped
+// metrics have a value, histograms and summaries a count, sum and their
+// buckets or quantiles keyed by the bound as a string, since it may be +Inf.
+type MetricSample struct {
+	Labels    map[string]string `json:"labels"`
+	Timestamp time.Time         `json:"timestamp"`
+
+	Value *float64 `json:"value,omitempty"`
+
+	Count     *uint64            `json:"count,omitempty"`
+	Sum       *float64           `json:"sum,omitempty"`
+	Buckets   map[string]uint64  `json:"buckets,omitempty"`
+	Quantiles map[string]float64 `json:"quantiles,omitempty"`
+}
+
+// newMetricsSnapshot converts the gathered metrics. Metrics without an
+// explicit timestamp are stamped with the time they were gathered.
+func newMetricsSnapshot(families []*dto.MetricFamily, now time.Time) *MetricsSnapshot {
+	snapshot := &MetricsSnapshot{
+		Timestamp: now,
+		Metrics:   []*MetricFamily{},
+	}
+
+	for _, family := range families {
+		f := &MetricFamily{
+			Name:    family.GetName(),
+			Help:    family.GetHelp(),
+			Type:    metricType(family.GetType()),
+			Samples: []*MetricSample{},
+		}
+
+		for _, metric := range family.GetMetric() {
+			sample := &MetricSample{
+				Labels:    map[string]string{},
+				Timestamp: now,
+			}
+			if metric.TimestampMs != nil {
+				sample.Timestamp = time.Unix(0, metric.GetTimestampMs()*int64(time.Millisecond))
+			}
+			for _, label := range metric.GetLabel() {
+				sample.Labels[label.GetName()] = label.GetValue()
+			}
+
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				sample.Value = jsonFloat(metric.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				sample.Value = jsonFloat(metric.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				sample.Value = jsonFloat(metric.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := metric.GetHistogram()
+				count := h.GetSampleCount()
+				sample.Count = &count
+				sample.Sum = jsonFloat(h.GetSampleSum())
+				sample.Buckets = map[string]uint64{}
+				for _, b := range h.GetBucket() {
+					sample.Buckets[formatFloat(b.GetUpperBound())] = b.GetCumulativeCount()
+				}
+			case dto.MetricType_SUMMARY:
+				s := metric.GetSummary()
+				count := s.GetSampleCount()
+				sample.Count = &count
+				sample.Sum = jsonFloat(s.GetSampleSum())
+				sample.Quantiles = map[string]float64{}
+				for _, q := range s.GetQuantile() {
+					if v := jsonFloat(q.GetValue()); v != nil {
+						sample.Quantiles[formatFloat(q.GetQuantile())] = *v
+					}
+				}
+			}
+
+			f.Samples = append(f.Samples, sample)
+		}
+
+		snapshot.Metrics = append(snapshot.Metrics, f)
+	}
+
+	return snapshot
+}
+
+// jsonFloat returns nil for the values json cannot encode (NaN and Inf).
+func jsonFloat(v float64) *float64 {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil
+	}
+	return &v
+}
+
+func metricType(t dto.MetricType) string {
+	switch t {
+	case dto.MetricType_COUNTER:
+		return "counter"
+	case dto.MetricType_GAUGE:
+		return "gauge"
+	case dto.MetricType_HISTOGRAM:
+		return "histogram"
+	case dto.MetricType_SUMMARY:
+		return "summary"
+	}
+	return "unknown"
+}
+
+// writeOpenMetrics writes the metrics in the OpenMetrics text format.
+func writeOpenMetrics(w io.Writer, families []*dto.MetricFamily) error {
+	b := bufio.NewWriter(w)
+
+	for _, family := range families {
+		name := family.GetName()
+		typ := family.GetType()
+
+		// Counter families are named without the _total suffix
+		if typ == dto.MetricType_COUNTER {
+			name = strings.TrimSuffix(name, "_total")
+		}
+
+		fmt.Fprintf(b, "# TYPE %s %s\n", name, metricType(typ))
+		if help := family.GetHelp(); help != "" {
+			fmt.Fprintf(b, "# HELP %s %s\n", name, escapeOpenMetrics(help))
+		}
+
+		for _, metric := range family.GetMetric() {
+			labels := metric.GetLabel()
+
+			switch typ {
+			case dto.MetricType_COUNTER:
+				writeOpenMetricsSample(b, name+"_total", labels, "", "", metric.GetCounter().GetValue(), metric)
+			case dto.MetricType_GAUGE:
+				writeOpenMetricsSample(b, name, labels, "", "", metric.GetGauge().GetValue(), metric)
+			case dto.MetricType_UNTYPED:
+				writeOpenMetricsSample(b, name, labels, "", "", metric.GetUntyped().GetValue(), metric)
+			case dto.MetricType_HISTOGRAM:
+				h := metric.GetHistogram()
+				infSeen := false
+				for _, bucket := range h.GetBucket() {
+					if math.IsInf(bucket.GetUpperBound(), +1) {
+						infSeen = true
+					}
+					writeOpenMetricsSample(b, name+"_bucket", labels, "le", formatFloat(bucket.GetUpperBound()), float64(bucket.GetCumulativeCount()), metric)
+				}
+				if !infSeen {
+					writeOpenMetricsSample(b, name+"_bucket", labels, "le", "+Inf", float64(h.GetSampleCount()), metric)
+				}
+				writeOpenMetricsSample(b, name+"_count", labels, "", "", float64(h.GetSampleCount()), metric)
+				writeOpenMetricsSample(b, name+"_sum", labels, "", "", h.GetSampleSum(), metric)
+			case dto.MetricType_SUMMARY:
+				s := metric.GetSummary()
+				for _, q := range s.GetQuantile() {
+					writeOpenMetricsSample(b, name, labels, "quantile", formatFloat(q.GetQuantile()), q.GetValue(), metric)
+				}
+				writeOpenMetricsSample(b, name+"_count", labels, "", "", float64(s.GetSampleCount()), metric)
+				writeOpenMetricsSample(b, name+"_sum", labels, "", "", s.GetSampleSum(), metric)
+			}
+		}
+	}
+
+	b.WriteString("# EOF\n")
+
+	return b.Flush()
+}
+
+// writeOpenMetricsSample writes a sample line. extraName and extraValue are
+// an additional label (le or quantile) if extraName is not empty.
+func writeOpenMetricsSample(b *bufio.Writer, name string, labels []*dto.LabelPair, extraName, extraValue string, value float64, metric *dto.Metric) {
+	b.WriteString(name)
+
+	pairs := []string{}
+	for _, label := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", label.GetName(), escapeOpenMetrics(label.GetValue())))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extraName, extraValue))
+	}
+	sort.Strings(pairs)
+
+	if len(pairs) != 0 {
+		b.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+
+	b.WriteString(" " + formatFloat(value))
+
+	if metric.TimestampMs != nil {
+		// OpenMetrics timestamps are in seconds
+		b.WriteString(" " + strconv.FormatFloat(float64(metric.GetTimestampMs())/1000, 'f', -1, 64))
+	}
+
+	b.WriteString("\n")
+}
+
+var openMetricsEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeOpenMetrics(s string) string {
+	return openMetricsEscaper.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, +1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
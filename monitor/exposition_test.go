@@ -0,0 +1,42 @@
+package monitor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	cases := []struct {
+		query  string
+		accept string
+		format string
+	}{
+		{"", "", FormatPrometheus},
+		{"", "application/json", FormatJSON},
+		{"", "application/openmetrics-text; version=1.0.0, text/plain; version=0.0.4; q=0.5", FormatOpenMetrics},
+		{"", "application/json;q=0.1, text/plain", FormatPrometheus},
+		{"", "text/plain;q=0.2, application/json;q=0.8", FormatJSON},
+		{"", "application/json;q=0, text/html", FormatPrometheus},
+		{"", "application/json;q=abc, application/openmetrics-text;q=0.3", FormatOpenMetrics},
+		{"", "*/*", FormatPrometheus},
+		{"?format=json", "text/plain", FormatJSON},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/metrics"+c.query, nil)
+		if c.accept != "" {
+			req.Header.Set("Accept", c.accept)
+		}
+
+		format, err := metricsFormat(req)
+		if err != nil || format != c.format {
+			t.Errorf("metricsFormat(%s '%s'): expected %s, got %s %v", c.query, c.accept, c.format, format, err)
+		}
+	}
+
+	_, err := metricsFormat(httptest.NewRequest("GET", "/metrics?format=xml", nil))
+	if httpErr, ok := err.(*HTTPError); !ok || httpErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a bad request for an unknown format, got %v", err)
+	}
+}
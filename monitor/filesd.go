@@ -0,0 +1,148 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// FileRegistrar writes the node as a prometheus file_sd target group. The
+// target is the exporter api and the labels describe the node and its health.
+type FileRegistrar struct {
+	logger *log.Logger
+	config *FileSDConfig
+
+	service *Service
+	status  string
+	note    string
+	lock    sync.Mutex
+}
+
+type fileSDGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+func NewFileRegistrar(logger *log.Logger, config *FileSDConfig) (*FileRegistrar, error) {
+	if config.Path == "" {
+		return nil, fmt.Errorf("file_sd path is empty")
+	}
+
+	f := &FileRegistrar{
+		logger: logger,
+		config: config,
+		status: HealthCritical,
+	}
+
+	return f, nil
+}
+
+func (f *FileRegistrar) Register(service *Service) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.service = service
+	return f.write()
+}
+
+func (f *FileRegistrar) UpdateHealth(status, note string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.status == status && f.note == note {
+		return nil
+	}
+
+	f.status, f.note = status, note
+
+	if f.service == nil {
+		// not registered yet
+		return nil
+	}
+
+	return f.write()
+}
+
+func (f *FileRegistrar) Deregister() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.service == nil {
+		return nil
+	}
+
+	f.service = nil
+
+	if err := os.Remove(f.config.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	f.logger.Printf("Service removed from %s", f.config.Path)
+	return nil
+}
+
+func (f *FileRegistrar) write() error {
+	labels := map[string]string{
+		"service": f.service.Name,
+		"node":    f.service.ID,
+		"tags":    strings.Join(f.service.Tags, ","),
+		"health":  f.status,
+		"port":    fmt.Sprintf("%d", f.service.Port),
+	}
+	if f.service.Address != "" {
+		labels["address"] = f.service.Address
+	}
+	for k, v := range f.service.Meta {
+		labels[k] = v
+	}
+
+	groups := []fileSDGroup{
+		{
+			Targets: []string{f.service.HealthAddr},
+			Labels:  labels,
+		},
+	}
+
+	data, err := json.MarshalIndent(groups, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so prometheus never reads a
+	// partial file.
+	tmp, err := ioutil.TempFile(filepath.Dir(f.config.Path), filepath.Base(f.config.Path))
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// TempFile creates the file readable only by the exporter user,
+	// prometheus usually runs as another one
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), f.config.Path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,166 @@
+package monitor
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/melonproject/ethereum-exporter/monitor/ethtest"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var testLogger = log.New(ioutil.Discard, "", 0)
+
+// startTestNode starts a simulated node without block production and its
+// etherscan api, stopped at the end of the test.
+func startTestNode(t *testing.T) (*ethtest.Node, *ethtest.Etherscan) {
+	config := ethtest.DefaultConfig()
+	config.BlockTime = 0
+
+	node := ethtest.NewNode(config)
+	if err := node.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { node.Close() })
+
+	etherscan := ethtest.NewEtherscan(node)
+	if err := etherscan.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { etherscan.Close() })
+
+	return node, etherscan
+}
+
+// testConfig is the config of a monitor of the simulated node, without
+// retries and cache.
+func testConfig(node *ethtest.Node, etherscan *ethtest.Etherscan) *Config {
+	config := DefaultConfig()
+	config.LogOutput = ioutil.Discard
+	config.Endpoint = node.URL()
+	config.ReferenceURL = etherscan.URL()
+	config.RPCConfig.Retries = 0
+	config.EtherscanConfig.CacheTTL = "0s"
+	return config
+}
+
+// healthReports is a registrar keeping the last health reported.
+type healthReports struct {
+	lock         sync.Mutex
+	status       string
+	note         string
+	deregistered bool
+}
+
+func (h *healthReports) Register(service *Service) error { return nil }
+
+func (h *healthReports) Deregister() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.deregistered = true
+	return nil
+}
+
+func (h *healthReports) UpdateHealth(status, note string) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.status, h.note = status, note
+	return nil
+}
+
+func (h *healthReports) last() (string, string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.status, h.note
+}
+
+// newTestMonitor creates a monitor reporting its health to the
+// healthReports, not started. The cycles and collections are run by the
+// test.
+func newTestMonitor(t *testing.T, config *Config) (*Monitor, *healthReports) {
+	m, err := NewMonitor(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reports := &healthReports{}
+	m.registrar = reports
+
+	return m, reports
+}
+
+// runTestCycle connects to the node if needed, runs every collector once
+// and reports the health with their errors, like the goroutines of the
+// monitor.
+func runTestCycle(m *Monitor) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	m.runCycle(ctx)
+	if m.isConnected() {
+		for _, s := range m.collectors {
+			m.collect(ctx, s)
+		}
+	}
+	m.runCycle(ctx)
+}
+
+// newTestClient creates a client of the simulated node without retries,
+// closed at the end of the test.
+func newTestClient(t *testing.T, node *ethtest.Node) *EthClient {
+	config := DefaultRPCConfig()
+	config.Retries = 0
+
+	client, err := NewEthClient(testLogger, []string{node.URL()}, config, NewMetrics(map[string]string{}, nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+// gatherValue returns the value of the gauge or counter of the registry
+// with the labels.
+func gatherValue(t *testing.T, m *Monitor, name string, labels map[string]string) float64 {
+	families, err := m.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.Metric {
+			if matchLabels(metric, labels) {
+				if metric.Gauge != nil {
+					return metric.Gauge.GetValue()
+				}
+				return metric.Counter.GetValue()
+			}
+		}
+	}
+
+	t.Fatalf("metric %s %v not found", name, labels)
+	return 0
+}
+
+func matchLabels(metric *dto.Metric, labels map[string]string) bool {
+	found := 0
+	for _, pair := range metric.Label {
+		if value, ok := labels[pair.GetName()]; ok {
+			if value != pair.GetValue() {
+				return false
+			}
+			found++
+		}
+	}
+	return found == len(labels)
+}
@@ -0,0 +1,504 @@
+package monitor
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets of the history database
+var (
+	blocksBucket    = []byte("blocks")
+	snapshotsBucket = []byte("snapshots")
+)
+
+// BlockRecord is the observation of a block of the chain.
+type BlockRecord struct {
+	Number     uint64    `json:"number"`
+	Hash       string    `json:"hash"`
+	ParentHash string    `json:"parent_hash"`
+	Timestamp  time.Time `json:"timestamp"`
+
+	// Time the monitor first saw the block
+	ObservedAt time.Time `json:"observed_at"`
+
+	// Seconds since the parent block, zero if the parent is unknown
+	BlockTime float64 `json:"block_time"`
+
+	Transactions int    `json:"transactions"`
+	GasUsed      uint64 `json:"gas_used"`
+	GasLimit     uint64 `json:"gas_limit"`
+
+	// Fullness of the block, gas used over gas limit
+	GasUsedRatio float64 `json:"gas_used_ratio"`
+
+	// Base fee per gas and fees burnt (base fee times gas used) in wei,
+	// nil before london
+	BaseFee   *big.Int `json:"base_fee,omitempty"`
+	BurntFees *big.Int `json:"burnt_fees,omitempty"`
+}
+
+// NewBlockRecord returns the record of the block. parent may be nil if it
+// is not known.
+func NewBlockRecord(block *Block, parent *Block, observedAt time.Time) *BlockRecord {
+	r := &BlockRecord{
+		Number:       block.Number.Uint64(),
+		Hash:         block.Hash,
+		ParentHash:   block.ParentHash,
+		ObservedAt:   observedAt,
+		Transactions: block.Transactions,
+	}
+
+	if block.Timestamp != nil {
+		r.Timestamp = *block.Timestamp
+		if parent != nil && parent.Timestamp != nil {
+			r.BlockTime = block.Timestamp.Sub(*parent.Timestamp).Seconds()
+		}
+	}
+	if block.GasUsed != nil {
+		r.GasUsed = block.GasUsed.Uint64()
+	}
+	if block.GasLimit != nil {
+		r.GasLimit = block.GasLimit.Uint64()
+	}
+	if r.GasLimit != 0 {
+		r.GasUsedRatio = float64(r.GasUsed) / float64(r.GasLimit)
+	}
+	if block.BaseFee != nil {
+		r.BaseFee = block.BaseFee
+		if block.GasUsed != nil {
+			r.BurntFees = new(big.Int).Mul(block.BaseFee, block.GasUsed)
+		}
+	}
+
+	return r
+}
+
+// Snapshot is the state of the node at a point in time.
+type Snapshot struct {
+	Time time.Time `json:"time"`
+
+	// Active endpoint, without credentials
+	Endpoint string `json:"endpoint"`
+
+	Chain         string `json:"chain"`
+	ClientVersion string `json:"client_version"`
+
+	Connected    bool   `json:"connected"`
+	Synced       bool   `json:"synced"`
+	BlockNumber  uint64 `json:"block_number"`
+	BlocksBehind int64  `json:"blocks_behind"`
+	Peers        int64  `json:"peers"`
+
+	Health     string `json:"health"`
+	HealthNote string `json:"health_note"`
+}
+
+// History is a local database with the blocks seen by the monitor and
+// periodic snapshots of the node.
+type History struct {
+	db *bolt.DB
+
+	// Retention, zero disables it
+	maxAge    time.Duration
+	maxBlocks int
+}
+
+// OpenHistory opens the history database in path, creating it if it does
+// not exist.
+func OpenHistory(path string, maxAge time.Duration, maxBlocks int) (*History, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("history database %s is in use by another process", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the history database %s: %v", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{blocksBucket, snapshotsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &History{db: db, maxAge: maxAge, maxBlocks: maxBlocks}, nil
+}
+
+// NewHistory opens the history of the config, nil if it is disabled.
+func NewHistory(config *HistoryConfig) (*History, error) {
+	if config == nil || config.Path == "" {
+		return nil, nil
+	}
+
+	var maxAge time.Duration
+	if config.MaxAge != "" {
+		var err error
+		if maxAge, err = time.ParseDuration(config.MaxAge); err != nil {
+			return nil, fmt.Errorf("invalid history max age '%s': %v", config.MaxAge, err)
+		}
+	}
+
+	return OpenHistory(config.Path, maxAge, config.MaxBlocks)
+}
+
+// Close closes the database.
+func (h *History) Close() error {
+	return h.db.Close()
+}
+
+func uint64Key(n uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, n)
+	return key
+}
+
+func timeKey(t time.Time) []byte {
+	return uint64Key(uint64(t.UnixNano()))
+}
+
+// RecordBlock stores the block. A block with the same number replaces the
+// stored one (i.e. after a reorg), keeping the time it was first observed if
+// the hash is the same.
+func (h *History) RecordBlock(r *BlockRecord) error {
+	return h.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(blocksBucket)
+		key := uint64Key(r.Number)
+
+		if data := b.Get(key); data != nil {
+			var old BlockRecord
+			if err := json.Unmarshal(data, &old); err == nil && old.Hash == r.Hash {
+				r.ObservedAt = old.ObservedAt
+			}
+		}
+
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, data)
+	})
+}
+
+// Block returns the stored block with the number, nil if there is none.
+func (h *History) Block(number uint64) (*BlockRecord, error) {
+	var r *BlockRecord
+
+	err := h.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(blocksBucket).Get(uint64Key(number))
+		if data == nil {
+			return nil
+		}
+		r = &BlockRecord{}
+		return json.Unmarshal(data, r)
+	})
+
+	return r, err
+}
+
+// LastBlock returns the stored block with the highest number, nil if there
+// is none.
+func (h *History) LastBlock() (*BlockRecord, error) {
+	var r *BlockRecord
+
+	err := h.db.View(func(tx *bolt.Tx) error {
+		_, data := tx.Bucket(blocksBucket).Cursor().Last()
+		if data == nil {
+			return nil
+		}
+		r = &BlockRecord{}
+		return json.Unmarshal(data, r)
+	})
+
+	return r, err
+}
+
+// Blocks returns up to limit stored blocks between from and to, both
+// included, in ascending order. A zero limit returns all of them.
+func (h *History) Blocks(from, to uint64, limit int) ([]*BlockRecord, error) {
+	records := []*BlockRecord{}
+
+	err := h.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(blocksBucket).Cursor()
+
+		end := uint64Key(to)
+		for k, v := c.Seek(uint64Key(from)); k != nil && string(k) <= string(end); k, v = c.Next() {
+			if limit != 0 && len(records) >= limit {
+				break
+			}
+
+			r := &BlockRecord{}
+			if err := json.Unmarshal(v, r); err != nil {
+				return err
+			}
+			records = append(records, r)
+		}
+		return nil
+	})
+
+	return records, err
+}
+
+// DeleteBlocksAfter removes the stored blocks above the number and returns
+// how many were removed.
+func (h *History) DeleteBlocksAfter(number uint64) (int, error) {
+	removed := 0
+
+	err := h.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(blocksBucket).Cursor()
+		key := uint64Key(number)
+		for k, _ := c.Last(); k != nil && string(k) > string(key); k, _ = c.Last() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+
+	return removed, err
+}
+
+// RecordSnapshot stores the snapshot of the node.
+func (h *History) RecordSnapshot(s *Snapshot) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	return h.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(snapshotsBucket).Put(timeKey(s.Time), data)
+	})
+}
+
+// Snapshots returns up to limit snapshots taken between from and to, both
+// included, in ascending order. A zero limit returns all of them.
+func (h *History) Snapshots(from, to time.Time, limit int) ([]*Snapshot, error) {
+	snapshots := []*Snapshot{}
+
+	err := h.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(snapshotsBucket).Cursor()
+
+		end := timeKey(to)
+		for k, v := c.Seek(timeKey(from)); k != nil && string(k) <= string(end); k, v = c.Next() {
+			if limit != 0 && len(snapshots) >= limit {
+				break
+			}
+
+			s := &Snapshot{}
+			if err := json.Unmarshal(v, s); err != nil {
+				return err
+			}
+			snapshots = append(snapshots, s)
+		}
+		return nil
+	})
+
+	return snapshots, err
+}
+
+// Prune removes the records out of the retention. It returns the number of
+// blocks and snapshots removed.
+func (h *History) Prune(now time.Time) (int, int, error) {
+	var blocks, snapshots int
+
+	err := h.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(blocksBucket)
+
+		// The oldest blocks are the first ones so both limits remove
+		// from the start
+		excess := 0
+		if h.maxBlocks != 0 {
+			excess = b.Stats().KeyN - h.maxBlocks
+		}
+
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.First() {
+			if excess <= 0 {
+				if h.maxAge == 0 {
+					break
+				}
+				var r BlockRecord
+				if err := json.Unmarshal(v, &r); err != nil {
+					return err
+				}
+				if now.Sub(r.ObservedAt) <= h.maxAge {
+					break
+				}
+			}
+
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			excess--
+			blocks++
+		}
+
+		if h.maxAge == 0 {
+			return nil
+		}
+
+		c = tx.Bucket(snapshotsBucket).Cursor()
+		cutoff := timeKey(now.Add(-h.maxAge))
+		for k, _ := c.First(); k != nil && string(k) < string(cutoff); k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			snapshots++
+		}
+
+		return nil
+	})
+
+	return blocks, snapshots, err
+}
+
+// maxHistoryGap is the max number of blocks fetched in a collection to fill
+// the blocks produced between two collections.
+const maxHistoryGap = 32
+
+// recordBlocks stores the head of the node and the blocks produced since the
+// last one stored, up to maxHistoryGap. The stored blocks replaced by a
+// reorg are recorded again and the ones above a lower head are removed.
+func (m *Monitor) recordBlocks(ctx context.Context, client *EthClient, head *Block) error {
+	last, err := m.history.LastBlock()
+	if err != nil {
+		return err
+	}
+
+	number := head.Number.Uint64()
+
+	if last != nil && last.Number == number && last.Hash == head.Hash {
+		return nil
+	}
+
+	// The node moved to a shorter chain
+	if last != nil && last.Number > number {
+		removed, err := m.history.DeleteBlocksAfter(number)
+		if err != nil {
+			return err
+		}
+		m.logger.Printf("Head moved back from block %d to %d: %d blocks removed", last.Number, number, removed)
+	}
+
+	// Walk back from the head while its parent is not stored, either
+	// produced since the last collection or replaced by a reorg. Only the
+	// head is stored if the last block is too old.
+	blocks := []*Block{head}
+	if last != nil && (number <= last.Number || number-last.Number <= maxHistoryGap) {
+		for len(blocks) <= maxHistoryGap {
+			oldest := blocks[len(blocks)-1]
+			n := oldest.Number.Uint64()
+			if n == 0 {
+				break
+			}
+
+			stored, err := m.history.Block(n - 1)
+			if err != nil {
+				return err
+			}
+			if n-1 <= last.Number && (stored == nil || stored.Hash == oldest.ParentHash) {
+				break
+			}
+
+			block, err := client.BlockByNumber(ctx, new(big.Int).SetUint64(n-1))
+			if err != nil {
+				return err
+			}
+			blocks = append(blocks, block)
+		}
+	}
+
+	now := time.Now()
+
+	// The block time of the first block needs its parent
+	var parent *Block
+	if first := blocks[len(blocks)-1]; first.Number.Uint64() > 0 {
+		n := first.Number.Uint64() - 1
+		if stored, err := m.history.Block(n); err == nil && stored != nil && stored.Hash == first.ParentHash {
+			parent = &Block{Timestamp: &stored.Timestamp}
+		} else if p, err := client.BlockByNumber(ctx, new(big.Int).SetUint64(n)); err == nil {
+			parent = p
+		}
+	}
+
+	for i := len(blocks) - 1; i >= 0; i-- {
+		block := blocks[i]
+
+		stored, err := m.history.Block(block.Number.Uint64())
+		if err != nil {
+			return err
+		}
+		if stored != nil && stored.Hash != block.Hash {
+			m.logger.Printf("Block %d replaced by a reorg: %s -> %s", stored.Number, stored.Hash, block.Hash)
+		}
+
+		if err := m.history.RecordBlock(NewBlockRecord(block, parent, now)); err != nil {
+			return err
+		}
+		parent = block
+	}
+
+	return nil
+}
+
+// runHistory takes a snapshot of the node every snapshot interval and
+// removes the records out of the retention.
+func (m *Monitor) runHistory(ctx context.Context, interval time.Duration) {
+	defer m.wg.Done()
+
+	for {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+
+		if err := m.history.RecordSnapshot(m.snapshot()); err != nil {
+			m.logger.Printf("Failed to record the node snapshot: %v", err)
+		}
+
+		blocks, snapshots, err := m.history.Prune(time.Now())
+		if err != nil {
+			m.logger.Printf("Failed to prune the history: %v", err)
+		} else if blocks != 0 || snapshots != 0 {
+			m.logger.Printf("History pruned: %d blocks and %d snapshots removed", blocks, snapshots)
+		}
+	}
+}
+
+// snapshot returns the current state of the node.
+func (m *Monitor) snapshot() *Snapshot {
+	health, note := m.evaluateHealth(m.lastCollectorErrors())
+
+	s := &Snapshot{
+		Time:       time.Now(),
+		Endpoint:   m.client().activeEndpoint().label,
+		Health:     health,
+		HealthNote: note,
+	}
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	s.Chain = m.chain
+	s.ClientVersion = m.clientVersion
+	s.Connected = m.connected
+	s.Synced = m.synced
+	s.BlockNumber = m.blockNumber
+	s.BlocksBehind = m.blocksBehind
+	s.Peers = m.peers
+
+	return s
+}
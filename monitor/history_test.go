@@ -0,0 +1,133 @@
+package monitor
+
+import (
+	"context"
+	"math/big"
+	"path/filepath"
+	"testing"
+
+	"github.com/melonproject/ethereum-exporter/monitor/ethtest"
+)
+
+func newTestHistoryMonitor(t *testing.T) (*Monitor, *ethtest.Node, *EthClient) {
+	node, _ := startTestNode(t)
+
+	client := newTestClient(t, node)
+
+	history, err := OpenHistory(filepath.Join(t.TempDir(), "history.db"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { history.Close() })
+
+	return &Monitor{logger: testLogger, history: history}, node, client
+}
+
+// recordHead records the block of the node with the number, the head if
+// zero.
+func recordHead(t *testing.T, m *Monitor, client *EthClient, number uint64) {
+	ctx := context.Background()
+
+	n := new(big.Int).SetUint64(number)
+	if number == 0 {
+		var err error
+		if n, err = client.BlockNumber(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	head, err := client.BlockByNumber(ctx, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.recordBlocks(ctx, client, head); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkChain fails unless the stored blocks are from..to, linked by their
+// parent hashes and equal to the blocks of the node.
+func checkChain(t *testing.T, m *Monitor, client *EthClient, from, to uint64) {
+	records, err := m.history.Blocks(0, ^uint64(0), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != int(to-from+1) || records[0].Number != from || records[len(records)-1].Number != to {
+		numbers := []uint64{}
+		for _, r := range records {
+			numbers = append(numbers, r.Number)
+		}
+		t.Fatalf("expected the blocks %d to %d, got %v", from, to, numbers)
+	}
+
+	for i, r := range records {
+		block, err := client.BlockByNumber(context.Background(), new(big.Int).SetUint64(r.Number))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Hash != block.Hash {
+			t.Errorf("block %d: expected hash %s, got %s", r.Number, block.Hash, r.Hash)
+		}
+		if i > 0 && r.ParentHash != records[i-1].Hash {
+			t.Errorf("block %d is not the child of the stored block %d", r.Number, records[i-1].Number)
+		}
+	}
+}
+
+func TestRecordBlocksFillsTheGap(t *testing.T) {
+	m, node, client := newTestHistoryMonitor(t)
+
+	recordHead(t, m, client, 0)
+	node.Mine(3)
+	recordHead(t, m, client, 0)
+
+	checkChain(t, m, client, 1000, 1003)
+}
+
+func TestRecordBlocksReorg(t *testing.T) {
+	m, node, client := newTestHistoryMonitor(t)
+
+	recordHead(t, m, client, 0)
+	node.Mine(5)
+	recordHead(t, m, client, 0)
+
+	// The head and the blocks below it are replaced
+	node.Reorg(3)
+	recordHead(t, m, client, 0)
+	checkChain(t, m, client, 1000, 1005)
+
+	// A reorg of a new head
+	node.Reorg(2)
+	node.Mine(1)
+	recordHead(t, m, client, 0)
+	checkChain(t, m, client, 1000, 1006)
+}
+
+func TestRecordBlocksLowerHead(t *testing.T) {
+	m, node, client := newTestHistoryMonitor(t)
+
+	recordHead(t, m, client, 0)
+	node.Mine(5)
+	recordHead(t, m, client, 0)
+
+	// The node moved to a shorter fork
+	node.Reorg(4)
+	recordHead(t, m, client, 1003)
+	checkChain(t, m, client, 1000, 1003)
+}
+
+func TestRecordBlocksOldHead(t *testing.T) {
+	m, node, client := newTestHistoryMonitor(t)
+
+	recordHead(t, m, client, 0)
+	node.Mine(maxHistoryGap + 1)
+	recordHead(t, m, client, 0)
+
+	records, err := m.history.Blocks(0, ^uint64(0), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Errorf("expected only the head stored after a gap too long, got %d blocks", len(records))
+	}
+}
@@ -7,6 +7,9 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -17,6 +20,7 @@ type HttpServer struct {
 	HTTPAddr net.Addr
 	mux      *http.ServeMux
 	listener net.Listener
+	server   *http.Server
 }
 
 func NewHttpServer(logger *log.Logger, monitor *Monitor, HTTPAddr net.Addr) *HttpServer {
@@ -34,32 +38,66 @@ func (h *HttpServer) Start(ctx context.Context) error {
 		return fmt.Errorf("failed to start listner on %s: %v", h.HTTPAddr.String(), err)
 	}
 
-	go func() {
-		<-ctx.Done()
-		h.logger.Printf("Shutting down http server")
-
-		if err := l.Close(); err != nil {
-			h.logger.Printf("Failed to close http server: %v", err)
-		}
-	}()
-
 	h.listener = l
 
 	h.mux = http.NewServeMux()
 	h.mux.Handle("/metrics", h.wrap(h.MetricsRequest))
 	h.mux.Handle("/synced", h.wrap(h.SyncedRequest))
+	h.mux.Handle("/history/blocks", h.wrap(h.HistoryBlocksRequest))
+	h.mux.Handle("/history/blocks/", h.wrap(h.HistoryBlockRequest))
+	h.mux.Handle("/history/snapshots", h.wrap(h.HistorySnapshotsRequest))
 
-	go http.Serve(l, h.mux)
+	h.server = &http.Server{Handler: h.mux}
+
+	go func() {
+		if err := h.server.Serve(l); err != nil && err != http.ErrServerClosed {
+			h.logger.Printf("Http server stopped: %v", err)
+		}
+	}()
 
 	h.logger.Printf("Http api running on %s", h.HTTPAddr.String())
 
 	return nil
 }
 
+// Shutdown stops accepting new connections and waits for the active
+// requests to finish or for ctx to expire.
+func (h *HttpServer) Shutdown(ctx context.Context) error {
+	if h.server == nil {
+		return nil
+	}
+
+	h.logger.Printf("Shutting down http server")
+	return h.server.Shutdown(ctx)
+}
+
+// HTTPError is an error of a request with its status code. Other errors
+// are returned as internal errors.
+type HTTPError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *HTTPError) Error() string {
+	return e.Err.Error()
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &HTTPError{http.StatusBadRequest, fmt.Errorf(format, args...)}
+}
+
+func notFound(format string, args ...interface{}) error {
+	return &HTTPError{http.StatusNotFound, fmt.Errorf(format, args...)}
+}
+
 func (h *HttpServer) wrap(handler func(resp http.ResponseWriter, req *http.Request) (interface{}, error)) http.HandlerFunc {
 	return func(resp http.ResponseWriter, req *http.Request) {
 		handleErr := func(err error) {
-			resp.WriteHeader(http.StatusInternalServerError)
+			code := http.StatusInternalServerError
+			if httpErr, ok := err.(*HTTPError); ok {
+				code = httpErr.StatusCode
+			}
+			resp.WriteHeader(code)
 			resp.Write([]byte(err.Error()))
 		}
 
@@ -89,11 +127,11 @@ func (h *HttpServer) SyncedRequest(resp http.ResponseWriter, req *http.Request)
 		return nil, fmt.Errorf("Incorrect method. Found %s, only GET available", req.Method)
 	}
 
-	if !h.monitor.connected {
+	if !h.monitor.isConnected() {
 		return nil, fmt.Errorf("Parity host unreachable")
 	}
 
-	if h.monitor.synced {
+	if h.monitor.isSynced() {
 		return true, nil
 	}
 
@@ -105,11 +143,190 @@ func (h *HttpServer) MetricsRequest(resp http.ResponseWriter, req *http.Request)
 		return nil, fmt.Errorf("Incorrect method. Found %s, only GET available", req.Method)
 	}
 
-	//if format := req.URL.Query().Get("format"); format == "prometheus" {
-	handler := promhttp.Handler()
+	format, err := metricsFormat(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case FormatJSON:
+		families, err := h.monitor.registry.Gather()
+		if err != nil {
+			return nil, err
+		}
+		return newMetricsSnapshot(families, time.Now()), nil
+
+	case FormatOpenMetrics:
+		families, err := h.monitor.registry.Gather()
+		if err != nil {
+			return nil, err
+		}
+		resp.Header().Set("Content-Type", openMetricsContentType)
+		return nil, writeOpenMetrics(resp, families)
+	}
+
+	handler := promhttp.HandlerFor(h.monitor.registry, promhttp.HandlerOpts{})
 	handler.ServeHTTP(resp, req)
 	return nil, nil
-	//}
+}
+
+// Default and max number of records returned by the history api
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 10000
+)
+
+func (h *HttpServer) history(req *http.Request) (*History, error) {
+	if req.Method != "GET" {
+		return nil, fmt.Errorf("Incorrect method. Found %s, only GET available", req.Method)
+	}
+	if h.monitor.history == nil {
+		return nil, notFound("History disabled. Set history.path to enable it")
+	}
+	return h.monitor.history, nil
+}
+
+// historyLimit returns the limit query parameter of a history request.
+func historyLimit(req *http.Request) (int, error) {
+	str := req.URL.Query().Get("limit")
+	if str == "" {
+		return defaultHistoryLimit, nil
+	}
+
+	limit, err := strconv.Atoi(str)
+	if err != nil || limit <= 0 {
+		return 0, badRequest("invalid limit '%s'", str)
+	}
+	if limit > maxHistoryLimit {
+		limit = maxHistoryLimit
+	}
+	return limit, nil
+}
+
+// HistoryBlocksRequest returns the stored blocks between the from and to
+// block numbers, both included. Without to it returns the last blocks.
+func (h *HttpServer) HistoryBlocksRequest(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	history, err := h.history(req)
+	if err != nil {
+		return nil, err
+	}
+
+	limit, err := historyLimit(req)
+	if err != nil {
+		return nil, err
+	}
 
-	return h.monitor.InmemSink.DisplayMetrics(resp, req)
+	query := req.URL.Query()
+
+	number := func(key string, value uint64) (uint64, error) {
+		str := query.Get(key)
+		if str == "" {
+			return value, nil
+		}
+		n, err := strconv.ParseUint(str, 0, 64)
+		if err != nil {
+			return 0, badRequest("invalid %s block '%s'", key, str)
+		}
+		return n, nil
+	}
+
+	var last uint64
+	if query.Get("to") == "" {
+		block, err := history.LastBlock()
+		if err != nil {
+			return nil, err
+		}
+		if block != nil {
+			last = block.Number
+		}
+	}
+
+	to, err := number("to", last)
+	if err != nil {
+		return nil, err
+	}
+
+	first := uint64(0)
+	if to >= uint64(limit) {
+		first = to - uint64(limit) + 1
+	}
+
+	from, err := number("from", first)
+	if err != nil {
+		return nil, err
+	}
+	if from > to {
+		return nil, badRequest("from block %d after to block %d", from, to)
+	}
+
+	return history.Blocks(from, to, limit)
+}
+
+// HistoryBlockRequest returns the stored block with the number in the path
+// (/history/blocks/<number>).
+func (h *HttpServer) HistoryBlockRequest(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	history, err := h.history(req)
+	if err != nil {
+		return nil, err
+	}
+
+	str := strings.TrimPrefix(req.URL.Path, "/history/blocks/")
+	number, err := strconv.ParseUint(str, 0, 64)
+	if err != nil {
+		return nil, badRequest("invalid block '%s'", str)
+	}
+
+	block, err := history.Block(number)
+	if err != nil {
+		return nil, err
+	}
+	if block == nil {
+		return nil, notFound("block %d not found", number)
+	}
+
+	return block, nil
+}
+
+// HistorySnapshotsRequest returns the snapshots of the node taken between
+// the from and to times, both included, as RFC 3339 times or unix
+// timestamps. Without from it returns the snapshots of the last hour.
+func (h *HttpServer) HistorySnapshotsRequest(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	history, err := h.history(req)
+	if err != nil {
+		return nil, err
+	}
+
+	limit, err := historyLimit(req)
+	if err != nil {
+		return nil, err
+	}
+
+	query := req.URL.Query()
+	now := time.Now()
+
+	to, err := parseHistoryTime(query.Get("to"), now)
+	if err != nil {
+		return nil, badRequest("invalid to time: %v", err)
+	}
+	from, err := parseHistoryTime(query.Get("from"), to.Add(-time.Hour))
+	if err != nil {
+		return nil, badRequest("invalid from time: %v", err)
+	}
+	if from.After(to) {
+		return nil, badRequest("from time %s after to time %s", from.Format(time.RFC3339), to.Format(time.RFC3339))
+	}
+
+	return history.Snapshots(from, to, limit)
+}
+
+// parseHistoryTime parses a RFC 3339 time or a unix timestamp, value if
+// empty.
+func parseHistoryTime(str string, value time.Time) (time.Time, error) {
+	if str == "" {
+		return value, nil
+	}
+	if seconds, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, str)
 }
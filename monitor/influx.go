@@ -0,0 +1,123 @@
+package monitor
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// influxEncoder encodes the metrics in the influxdb line protocol. Every
+// metric is a line whose measurement is the metric name and tags are the
+// labels. Gauges and counters have a value field, histograms and summaries
+// count and sum fields plus a field per bucket or quantile.
+type influxEncoder struct{}
+
+func (e *influxEncoder) SetHeaders(header http.Header) {
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+}
+
+func (e *influxEncoder) Encode(families []*dto.MetricFamily, now time.Time, batchSize int) ([][]byte, error) {
+	batches := [][]byte{}
+
+	buf := bytes.NewBuffer(nil)
+	lines := 0
+
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			fields := influxFields(family.GetType(), metric)
+			if len(fields) == 0 {
+				continue
+			}
+
+			timestamp := now
+			if metric.TimestampMs != nil {
+				timestamp = time.Unix(0, metric.GetTimestampMs()*int64(time.Millisecond))
+			}
+
+			buf.WriteString(influxEscape(family.GetName(), ", "))
+
+			// The gathered labels are sorted by name
+			for _, label := range metric.GetLabel() {
+				if label.GetValue() == "" {
+					continue
+				}
+				buf.WriteString("," + influxEscape(label.GetName(), ",= ") + "=" + influxEscape(label.GetValue(), ",= "))
+			}
+
+			buf.WriteString(" " + strings.Join(fields, ","))
+			buf.WriteString(" " + strconv.FormatInt(timestamp.UnixNano(), 10) + "\n")
+
+			lines++
+			if lines == batchSize {
+				batches = append(batches, buf.Bytes())
+				buf = bytes.NewBuffer(nil)
+				lines = 0
+			}
+		}
+	}
+
+	if lines != 0 {
+		batches = append(batches, buf.Bytes())
+	}
+
+	return batches, nil
+}
+
+// influxFields returns the fields of the metric. NaN and Inf values are
+// skipped since influxdb cannot store them.
+func influxFields(typ dto.MetricType, metric *dto.Metric) []string {
+	fields := []string{}
+
+	add := func(name string, value float64) {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return
+		}
+		fields = append(fields, influxEscape(name, ",= ")+"="+strconv.FormatFloat(value, 'g', -1, 64))
+	}
+
+	switch typ {
+	case dto.MetricType_COUNTER:
+		add("value", metric.GetCounter().GetValue())
+	case dto.MetricType_GAUGE:
+		add("value", metric.GetGauge().GetValue())
+	case dto.MetricType_UNTYPED:
+		add("value", metric.GetUntyped().GetValue())
+	case dto.MetricType_HISTOGRAM:
+		h := metric.GetHistogram()
+		add("count", float64(h.GetSampleCount()))
+		add("sum", h.GetSampleSum())
+		for _, b := range h.GetBucket() {
+			add(formatFloat(b.GetUpperBound()), float64(b.GetCumulativeCount()))
+		}
+	case dto.MetricType_SUMMARY:
+		s := metric.GetSummary()
+		add("count", float64(s.GetSampleCount()))
+		add("sum", s.GetSampleSum())
+		for _, q := range s.GetQuantile() {
+			add(formatFloat(q.GetQuantile()), q.GetValue())
+		}
+	}
+
+	return fields
+}
+
+// influxEscape escapes the special characters of the line protocol.
+func influxEscape(str string, special string) string {
+	var b bytes.Buffer
+	for _, r := range str {
+		if r == '\n' {
+			b.WriteString(`\n`)
+			continue
+		}
+		if r == '\\' || strings.ContainsRune(special, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
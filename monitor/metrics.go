@@ -0,0 +1,304 @@
+package monitor
+
+import (
+	"sort"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const namespace = "ethereum"
+
+// Metrics are the prometheus metrics of the monitor. They are registered in
+// the registry owned by the monitor and, if configured, mirrored to the
+// go-metrics sinks.
+type Metrics struct {
+	// Node
+	up                  prometheus.Gauge
+	peers               prometheus.Gauge
+	blockNumber         prometheus.Gauge
+	blockTime           prometheus.Gauge
+	blocksBehind        prometheus.Gauge
+	synced              prometheus.Gauge
+	syncing             prometheus.Gauge
+	syncCurrentBlock    prometheus.Gauge
+	syncHighestBlock    prometheus.Gauge
+	syncStartingBlock   prometheus.Gauge
+	warpChunksAmount    prometheus.Gauge
+	warpChunksProcessed prometheus.Gauge
+
+	// Collectors
+	collectorDuration *prometheus.GaugeVec
+	collectorSuccess  *prometheus.GaugeVec
+
+	// Rpc
+	rpcDuration       *prometheus.HistogramVec
+	rpcRequests       *prometheus.CounterVec
+	rpcErrors         *prometheus.CounterVec
+	rpcResponseSize   *prometheus.SummaryVec
+	rpcEndpointActive *prometheus.GaugeVec
+
+	// Config
+	configReloadSuccess prometheus.Gauge
+	configReloadTime    prometheus.Gauge
+
+	// Optional go-metrics sink and the labels sent with every metric
+	sink       *metrics.Metrics
+	sinkLabels []metrics.Label
+}
+
+// NewMetrics creates the metrics with the constant labels. sink may be nil.
+func NewMetrics(labels map[string]string, sink *metrics.Metrics) *Metrics {
+	constLabels := prometheus.Labels(labels)
+
+	gauge := func(subsystem, name, help string) prometheus.Gauge {
+		return prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			Name:        name,
+			Help:        help,
+			ConstLabels: constLabels,
+		})
+	}
+
+	m := &Metrics{
+		up:                  gauge("", "up", "Whether the node is reachable."),
+		peers:               gauge("", "peers", "Number of peers of the node."),
+		blockNumber:         gauge("", "block_number", "Number of the last block of the node."),
+		blockTime:           gauge("", "block_time_seconds", "Time between the last two blocks seen by the node."),
+		blocksBehind:        gauge("", "blocks_behind", "Blocks between the node and the reference chain head."),
+		synced:              gauge("", "synced", "Whether the node is within the sync threshold of the reference."),
+		syncing:             gauge("", "syncing", "Whether the node reports it is syncing."),
+		syncCurrentBlock:    gauge("sync", "current_block", "Current block of the sync."),
+		syncHighestBlock:    gauge("sync", "highest_block", "Highest block known by the sync."),
+		syncStartingBlock:   gauge("sync", "starting_block", "Block where the sync started."),
+		warpChunksAmount:    gauge("sync", "warp_chunks_amount", "Warp chunks to process (parity)."),
+		warpChunksProcessed: gauge("sync", "warp_chunks_processed", "Warp chunks processed (parity)."),
+
+		collectorDuration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   "collector",
+			Name:        "duration_seconds",
+			Help:        "Duration of the last collection.",
+			ConstLabels: constLabels,
+		}, []string{"collector"}),
+
+		collectorSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   "collector",
+			Name:        "success",
+			Help:        "Whether the last collection succeeded.",
+			ConstLabels: constLabels,
+		}, []string{"collector"}),
+
+		rpcDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   namespace,
+			Subsystem:   "rpc",
+			Name:        "request_duration_seconds",
+			Help:        "Latency of the json-rpc calls to the node.",
+			Buckets:     prometheus.DefBuckets,
+			ConstLabels: constLabels,
+		}, []string{"method", "endpoint"}),
+
+		rpcRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "rpc",
+			Name:        "requests_total",
+			Help:        "Json-rpc calls to the node by result (success or error).",
+			ConstLabels: constLabels,
+		}, []string{"method", "endpoint", "result"}),
+
+		rpcErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "rpc",
+			Name:        "errors_total",
+			Help:        "Failed json-rpc calls to the node by error class.",
+			ConstLabels: constLabels,
+		}, []string{"method", "endpoint", "class"}),
+
+		rpcResponseSize: prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Namespace:   namespace,
+			Subsystem:   "rpc",
+			Name:        "response_size_bytes",
+			Help:        "Size of the json-rpc responses.",
+			Objectives:  map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+			ConstLabels: constLabels,
+		}, []string{"method", "endpoint"}),
+
+		rpcEndpointActive: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   "rpc",
+			Name:        "endpoint_active",
+			Help:        "1 for the rpc endpoint in use, 0 for the backup ones.",
+			ConstLabels: constLabels,
+		}, []string{"endpoint"}),
+
+		configReloadSuccess: gauge("config", "reload_success", "Whether the last config reload succeeded."),
+		configReloadTime:    gauge("config", "last_reload_success_timestamp_seconds", "Time of the last successful config reload."),
+
+		sink: sink,
+	}
+
+	names := []string{}
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		m.sinkLabels = append(m.sinkLabels, metrics.Label{Name: name, Value: labels[name]})
+	}
+
+	return m
+}
+
+// Register registers all the metrics.
+func (m *Metrics) Register(r prometheus.Registerer) error {
+	collectors := []prometheus.Collector{
+		m.up, m.peers, m.blockNumber, m.blockTime, m.blocksBehind, m.synced,
+		m.syncing, m.syncCurrentBlock, m.syncHighestBlock, m.syncStartingBlock,
+		m.warpChunksAmount, m.warpChunksProcessed,
+		m.collectorDuration, m.collectorSuccess,
+		m.rpcDuration, m.rpcRequests, m.rpcErrors, m.rpcResponseSize, m.rpcEndpointActive,
+		m.configReloadSuccess, m.configReloadTime,
+	}
+
+	for _, c := range collectors {
+		if err := r.Register(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setGauge sets the gauge and mirrors it to the go-metrics sink under key.
+func (m *Metrics) setGauge(g prometheus.Gauge, key []string, value float64) {
+	g.Set(value)
+
+	if m.sink != nil {
+		m.sink.SetGaugeWithLabels(key, float32(value), m.sinkLabels)
+	}
+}
+
+func (m *Metrics) setBool(g prometheus.Gauge, key []string, value bool) {
+	if value {
+		m.setGauge(g, key, 1)
+	} else {
+		m.setGauge(g, key, 0)
+	}
+}
+
+func (m *Metrics) observeCollector(name string, duration time.Duration, err error) {
+	m.collectorDuration.WithLabelValues(name).Set(duration.Seconds())
+
+	success := 0.0
+	if err == nil {
+		success = 1
+	}
+	m.collectorSuccess.WithLabelValues(name).Set(success)
+
+	if m.sink != nil {
+		labels := append([]metrics.Label{{Name: "collector", Value: name}}, m.sinkLabels...)
+		m.sink.SetGaugeWithLabels([]string{"collector", "duration"}, float32(duration.Seconds()), labels)
+		m.sink.SetGaugeWithLabels([]string{"collector", "success"}, float32(success), labels)
+	}
+}
+
+// rpcDurationTotals returns the sum and the count of the durations of the
+// rpc calls, of every method and endpoint.
+func (m *Metrics) rpcDurationTotals() (float64, uint64) {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		m.rpcDuration.Collect(ch)
+		close(ch)
+	}()
+
+	var sum float64
+	var count uint64
+	for metric := range ch {
+		var pb dto.Metric
+		if err := metric.Write(&pb); err != nil || pb.Histogram == nil {
+			continue
+		}
+		sum += pb.Histogram.GetSampleSum()
+		count += pb.Histogram.GetSampleCount()
+	}
+
+	return sum, count
+}
+
+func (m *Metrics) observeRPC(method, endpoint string, duration time.Duration, size int, err error) {
+	m.rpcDuration.WithLabelValues(method, endpoint).Observe(duration.Seconds())
+
+	if err != nil {
+		m.rpcRequests.WithLabelValues(method, endpoint, "error").Inc()
+		m.rpcErrors.WithLabelValues(method, endpoint, errorClass(err)).Inc()
+	} else {
+		m.rpcRequests.WithLabelValues(method, endpoint, "success").Inc()
+		m.rpcResponseSize.WithLabelValues(method, endpoint).Observe(float64(size))
+	}
+
+	if m.sink != nil {
+		labels := append([]metrics.Label{{Name: "method", Value: method}}, m.sinkLabels...)
+		m.sink.AddSampleWithLabels([]string{"rpc", "latency"}, float32(duration.Seconds()*1000), labels)
+		if err != nil {
+			m.sink.IncrCounterWithLabels([]string{"rpc", "errors"}, 1, labels)
+		}
+	}
+}
+
+func (m *Metrics) setActiveEndpoint(endpoint string, active bool) {
+	value := 0.0
+	if active {
+		value = 1
+	}
+	m.rpcEndpointActive.WithLabelValues(endpoint).Set(value)
+}
+
+// resetEndpoints removes the series of the endpoints, before they are
+// replaced.
+func (m *Metrics) resetEndpoints() {
+	m.rpcEndpointActive.Reset()
+}
+
+// setupGoMetrics creates the go-metrics instance with the configured sinks.
+// It returns nil if there are none.
+func (m *Monitor) setupGoMetrics() (*metrics.Metrics, error) {
+	config := m.config.GoMetricsConfig
+
+	var sinks metrics.FanoutSink
+
+	if config.Inmem {
+		m.InmemSink = metrics.NewInmemSink(10*time.Second, time.Minute)
+		metrics.DefaultInmemSignal(m.InmemSink)
+		sinks = append(sinks, m.InmemSink)
+	}
+
+	statsdConfigs := []*StatsdConfig{config.StatsdConfig, config.DogStatsdConfig}
+	for i, statsdConfig := range statsdConfigs {
+		if statsdConfig == nil || statsdConfig.Address == "" {
+			continue
+		}
+
+		sink, err := NewStatsdSink(m.logger, statsdConfig, i == 1)
+		if err != nil {
+			return nil, err
+		}
+
+		m.statsdSinks = append(m.statsdSinks, sink)
+		sinks = append(sinks, sink)
+	}
+
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+
+	metricsConf := metrics.DefaultConfig(config.ServiceName)
+	metricsConf.EnableHostname = false
+	metricsConf.EnableRuntimeMetrics = false
+
+	return metrics.New(metricsConf, sinks)
+}
@@ -6,13 +6,13 @@ import (
 	"log"
 	"math/big"
 	"net"
-	"strings"
+	"os"
+	"sync"
 	"time"
 
 	metrics "github.com/armon/go-metrics"
-	"github.com/armon/go-metrics/prometheus"
-	consulapi "github.com/hashicorp/consul/api"
 	"github.com/hashicorp/go-multierror"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type Monitor struct {
@@ -20,8 +20,39 @@ type Monitor struct {
 	logger    *log.Logger
 	InmemSink *metrics.InmemSink
 
-	// ethereum chain
-	chain string
+	// Protects the config and the components replaced on reload (the eth
+	// client, the registrar and the cycle timeout)
+	configLock sync.RWMutex
+
+	// Serializes the reloads
+	reloadLock sync.Mutex
+
+	// ethereum chain and client version reported by the node
+	chain         string
+	clientVersion string
+	archive       bool
+
+	// Prometheus registry with the metrics of the exporter
+	registry *prometheus.Registry
+	metrics  *Metrics
+
+	// Push sinks, flushed on Stop
+	statsdSinks []*StatsdSink
+
+	// Influxdb, remote write and otlp outputs
+	pushers []*Pusher
+
+	// Spans of the collections and rpc calls, nil if disabled
+	tracer *Tracer
+
+	// Tags derived from the node state
+	dynamicTags []string
+
+	// Errors of the last run of each collector
+	collectorErrors map[string]error
+
+	// Protects the node info and state
+	lock sync.RWMutex
 
 	// Etherscan
 	etherscan *Etherscan
@@ -29,23 +60,53 @@ type Monitor struct {
 	// Ethereum client
 	ethClient *EthClient
 
+	// Max duration of a collection cycle
+	cycleTimeout time.Duration
+
+	// Enabled collectors and the goroutines running them
+	collectors     []*scheduledCollector
+	collectorGroup *collectorGroup
+
+	// Context passed to Start, used to start the components replaced on
+	// reload
+	runCtx context.Context
+
 	// Http server
 	http *HttpServer
 
-	// Last block number
-	lastBlock *Block
-
 	connected bool
 	synced    bool
 
-	baseLabels []metrics.Label
+	// Blocks behind the reference (etherscan) in the last check
+	blocksBehind int64
+
+	// Last head, peers and sync progress of the node. sync is nil if the
+	// node is not syncing.
+	blockNumber uint64
+	headTime    time.Time
+	peers       int64
+	sync        *RpcSync
+
+	// Local history of the blocks and the node, nil if disabled
+	history *History
+
+	// Service discovery
+	registrar Registrar
+
+	// Triggers a registration sync
+	registerCh chan struct{}
+
+	// Background goroutines started by Start
+	wg sync.WaitGroup
 }
 
 func NewMonitor(config *Config) (*Monitor, error) {
 	m := &Monitor{
-		config:    config,
-		connected: false,
-		synced:    false,
+		config:          config,
+		connected:       false,
+		synced:          false,
+		collectorErrors: map[string]error{},
+		registerCh:      make(chan struct{}, 1),
 	}
 
 	m.logger = log.New(config.LogOutput, "", log.LstdFlags)
@@ -59,132 +120,131 @@ func NewMonitor(config *Config) (*Monitor, error) {
 
 	m.http = NewHttpServer(m.logger, m, addr)
 
-	go m.setupConsul()
-
 	var err error
 
-	m.InmemSink, err = m.setupTelemetry()
-	if err != nil {
+	if err = m.setupTelemetry(); err != nil {
 		return nil, err
 	}
 
-	return m, nil
-}
+	// The initial config counts as a successful load
+	m.metrics.setBool(m.metrics.configReloadSuccess, []string{"config", "reload_success"}, true)
+	m.metrics.setGauge(m.metrics.configReloadTime, []string{"config", "last_reload_success_timestamp"}, float64(time.Now().Unix()))
 
-func (m *Monitor) setBaseLabels() {
-	m.baseLabels = []metrics.Label{}
+	m.pushers, err = m.setupPushers()
+	if err != nil {
+		return nil, err
+	}
 
-	m.baseLabels = append(m.baseLabels, metrics.Label{
-		Name:  "node",
-		Value: m.config.NodeName,
-	})
-}
+	if err = m.setupOTLP(); err != nil {
+		return nil, err
+	}
 
-func (m *Monitor) setupApis() error {
+	m.registrar, err = m.setupRegistrar(config)
+	if err != nil {
+		return nil, err
+	}
 
-	// api
-	m.ethClient = NewEthClient(m.config.Endpoint)
+	m.ethClient, err = NewEthClient(m.logger, config.RPCEndpoints(), config.RPCConfig, m.metrics, m.tracer)
+	if err != nil {
+		return nil, err
+	}
 
-	chain, err := m.ethClient.Chain()
+	m.cycleTimeout, err = time.ParseDuration(config.RPCConfig.CycleTimeout)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("invalid rpc cycle timeout '%s': %v", config.RPCConfig.CycleTimeout, err)
 	}
 
-	// etherscan
-	var url string
-	switch chain {
-	case "kovan":
-		url = "https://kovan.etherscan.io/api?module=proxy&action=eth_blockNumber"
-	case "foundation":
-		url = "https://api.etherscan.io/api?module=proxy&action=eth_blockNumber"
-	default:
-		return fmt.Errorf("Chain %s not found. 'kovan' and 'foundation' are the only valid options", chain)
+	m.collectors, err = m.setupCollectors(config, m.cycleTimeout)
+	if err != nil {
+		return nil, err
 	}
 
-	m.logger.Printf("Using chain %s", chain)
-	m.etherscan = NewEtherscan(url)
+	m.history, err = NewHistory(config.HistoryConfig)
+	if err != nil {
+		return nil, err
+	}
 
-	return nil
+	return m, nil
 }
 
-func (m *Monitor) setupTelemetry() (*metrics.InmemSink, error) {
-	// Prepare metrics
-
-	memSink := metrics.NewInmemSink(10*time.Second, time.Minute)
-	metrics.DefaultInmemSignal(memSink)
-
-	metricsConf := metrics.DefaultConfig("parity-pool")
-	metricsConf.EnableHostnameLabel = true
+func (m *Monitor) setupApis(ctx context.Context) error {
 
-	var sinks metrics.FanoutSink
+	ethClient := m.client()
 
-	prom, err := prometheus.NewPrometheusSink()
+	chain, err := ethClient.Chain(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	sinks = append(sinks, prom)
-
-	if len(sinks) > 0 {
-		sinks = append(sinks, memSink)
-		metrics.NewGlobal(metricsConf, sinks)
-	} else {
-		metricsConf.EnableHostname = false
-		metrics.NewGlobal(metricsConf, memSink)
+	url := m.currentConfig().ReferenceURL
+	if url == "" {
+		if url, err = referenceURL(chain); err != nil {
+			return err
+		}
 	}
 
-	return memSink, nil
-}
+	clientVersion, err := ethClient.ClientVersion(ctx)
+	if err != nil {
+		return err
+	}
 
-func (m *Monitor) setupConsul() {
-	retries := 5
-	sleepDuration := 1 * time.Minute
+	archive, err := ethClient.IsArchive(ctx)
+	if err != nil {
+		return err
+	}
 
-	for i := 0; i < retries; i++ {
-		err := m.setupConsulImpl()
-		if err == nil {
-			m.logger.Printf("Service registred in consul")
-			return
-		}
+	m.logger.Printf("Using chain %s", chain)
 
-		m.logger.Printf("Failed to connect to consul: %v", err)
-		time.Sleep(sleepDuration)
+	etherscan, err := SharedEtherscan(url, ethClient.timeout, m.currentConfig().EtherscanConfig)
+	if err != nil {
+		return err
 	}
 
-	m.logger.Printf("Stop trying to register on consul")
-}
-
-func (m *Monitor) setupConsulImpl() error {
-	serviceID := fmt.Sprintf(m.config.NodeName)
+	m.lock.Lock()
+	m.etherscan = etherscan
+	m.chain = chain
+	m.clientVersion = clientVersion
+	m.archive = archive
+	m.lock.Unlock()
 
-	// address
-	healthAddr := fmt.Sprintf("%s:%d", m.config.BindAddr, m.config.BindPort)
+	return nil
+}
 
-	service := &consulapi.AgentServiceRegistration{
-		ID:   serviceID,
-		Name: m.config.ConsulConfig.ServiceName,
-		Tags: m.config.ConsulConfig.Tags,
-		Port: 8545,
-		Check: &consulapi.AgentServiceCheck{
-			HTTP:     fmt.Sprintf("http://%s/synced", healthAddr),
-			Interval: "1s",
-			Timeout:  "5s",
-		},
+// referenceURL returns the etherscan api of the chain, used as reference of
+// the chain head.
+func referenceURL(chain string) (string, error) {
+	switch chain {
+	case "kovan":
+		return "https://kovan.etherscan.io/api?module=proxy&action=eth_blockNumber", nil
+	case "foundation":
+		return "https://api.etherscan.io/api?module=proxy&action=eth_blockNumber", nil
 	}
+	return "", fmt.Errorf("Chain %s not found. 'kovan' and 'foundation' are the only valid options", chain)
+}
 
-	consulConfig := consulapi.DefaultConfig()
-	consulConfig.Address = m.config.ConsulConfig.Address
-
-	client, err := consulapi.NewClient(consulConfig)
+// setupTelemetry creates the registry of the exporter with the go runtime
+// and process metrics and the go-metrics sinks, if any.
+func (m *Monitor) setupTelemetry() error {
+	sink, err := m.setupGoMetrics()
 	if err != nil {
 		return err
 	}
 
-	if err := client.Agent().ServiceRegister(service); err != nil {
-		return err
+	m.metrics = NewMetrics(m.config.MetricLabels(), sink)
+
+	m.registry = prometheus.NewRegistry()
+
+	collectors := []prometheus.Collector{
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(os.Getpid(), ""),
+	}
+	for _, c := range collectors {
+		if err := m.registry.Register(c); err != nil {
+			return err
+		}
 	}
 
-	return nil
+	return m.metrics.Register(m.registry)
 }
 
 func Abs(x *big.Int) *big.Int {
@@ -202,103 +262,306 @@ func (m *Monitor) Start(ctx context.Context) error {
 		return err
 	}
 
+	m.configLock.Lock()
+	m.runCtx = ctx
+	m.collectorGroup = m.startCollectors(ctx, m.collectors)
+	m.configLock.Unlock()
+
+	// Always running, a reload may enable the discovery
+	m.wg.Add(1)
+	go m.runRegistrar(ctx)
+
+	m.wg.Add(1)
 	go m.start(ctx)
+
+	for _, pusher := range m.pushers {
+		m.wg.Add(1)
+		go func(p *Pusher) {
+			defer m.wg.Done()
+			p.Run(ctx)
+		}(pusher)
+	}
+
+	if m.tracer != nil {
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			m.tracer.Run(ctx)
+		}()
+	}
+
+	if m.history != nil {
+		interval, err := time.ParseDuration(m.config.HistoryConfig.SnapshotInterval)
+		if err != nil {
+			return fmt.Errorf("invalid history snapshot interval '%s': %v", m.config.HistoryConfig.SnapshotInterval, err)
+		}
+
+		m.wg.Add(1)
+		go m.runHistory(ctx, interval)
+	}
+
 	return nil
 }
 
+// Stop waits for the background goroutines to exit after the context passed
+// to Start is cancelled, drains the http server, deregisters the service
+// from the discovery backend and flushes the statsd sinks and the spans. ctx
+// bounds the time spent waiting and draining, the deregistration has its own
+// deadline so that the service is removed even if the loops did not exit.
+func (m *Monitor) Stop(ctx context.Context) error {
+	var errors error
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+
+	exited := true
+	select {
+	case <-done:
+	case <-ctx.Done():
+		exited = false
+		errors = multierror.Append(errors, fmt.Errorf("timeout waiting for the monitor loop to exit"))
+	}
+
+	if err := m.http.Shutdown(ctx); err != nil {
+		errors = multierror.Append(errors, fmt.Errorf("failed to shutdown http server: %v", err))
+	}
+
+	deregisterCtx, cancel := context.WithTimeout(context.Background(), deregisterTimeout)
+	defer cancel()
+
+	if err := m.deregister(deregisterCtx); err != nil {
+		errors = multierror.Append(errors, fmt.Errorf("failed to deregister the service: %v", err))
+	}
+
+	for _, sink := range m.statsdSinks {
+		sink.Shutdown()
+	}
+
+	// The tracer goroutine may still be flushing the same queue
+	if m.tracer != nil && exited {
+		if err := m.tracer.Flush(ctx); err != nil {
+			errors = multierror.Append(errors, fmt.Errorf("failed to export the spans: %v", err))
+		}
+	}
+
+	if m.history != nil {
+		if err := m.history.Close(); err != nil {
+			errors = multierror.Append(errors, fmt.Errorf("failed to close the history: %v", err))
+		}
+	}
+
+	return errors
+}
+
 func (m *Monitor) start(ctx context.Context) {
+	defer m.wg.Done()
 
 	// gather metrics
 	for {
 		select {
-		case <-time.After(m.config.RPCInterval):
-
-			if m.connected {
-				previousState := m.synced
-
-				// RPC calls
-				if err := m.gatherMetrics(); err != nil {
-					m.logger.Printf("Export errors: %v", err)
-
-					if strings.Contains(err.Error(), "connection refused") { // TODO. Add fallback strategy
-						m.logger.Printf("Node may be down")
-						m.connected = false
-					}
-
-					if previousState != m.synced {
-						fmt.Printf("State changed. Is Synced?: %v\n", m.synced)
-					}
-				}
-
-			} else {
-
-				// setup APIS
-				if err := m.setupApis(); err != nil {
-					m.logger.Printf("Failed to connect to node: %v", err)
-				} else {
-					m.logger.Printf("Chain connected. Gathering metrics...")
-					m.connected = true
-				}
-			}
+		case <-time.After(m.currentConfig().RPCInterval.Duration()):
+			m.runCycle(ctx)
 		case <-ctx.Done():
 			m.logger.Println("Monitor shutting down")
+			return
 		}
 	}
 }
 
-func (m *Monitor) gatherMetrics() error {
-	var errors error
+// runCycle connects to the node if it is not connected and reports its
+// health with the errors of the collectors. It returns the errors the
+// health was evaluated with.
+func (m *Monitor) runCycle(ctx context.Context) error {
+	var err error
 
-	// Peers
+	m.configLock.RLock()
+	cycleTimeout := m.cycleTimeout
+	m.configLock.RUnlock()
 
-	peers, err := m.ethClient.PeerCount()
-	if err != nil {
-		errors = multierror.Append(errors, err)
+	cycleCtx, cancel := context.WithTimeout(ctx, cycleTimeout)
+	cycleCtx, span := m.tracer.Start(cycleCtx, "monitor cycle", SpanKindInternal)
+
+	if m.isConnected() {
+		m.client().Failback(cycleCtx)
+
+		// errors of the collectors
+		err = m.lastCollectorErrors()
 	} else {
-		metrics.SetGaugeWithLabels([]string{"peers"}, float32(peers), m.baseLabels)
+
+		// setup APIS
+		if err = m.setupApis(cycleCtx); err != nil {
+			m.logger.Printf("Failed to connect to node: %v", err)
+		} else {
+			m.logger.Printf("Chain connected. Gathering metrics...")
+			m.setConnected(true)
+		}
 	}
 
-	// BlockNumber
+	span.End(err)
+	cancel()
 
-	blockNumber, err := m.ethClient.BlockNumber()
-	if err != nil {
-		errors = multierror.Append(errors, err)
-	} else {
-		metrics.SetGaugeWithLabels([]string{"blockNumber"}, float32(blockNumber.Int64()), m.baseLabels)
+	m.reportHealth(m.evaluateHealth(err))
+	m.updateDynamicTags()
+
+	return err
+}
+
+// Health verdicts. They match the consul check status names.
+const (
+	HealthPassing  = "passing"
+	HealthWarning  = "warning"
+	HealthCritical = "critical"
+)
+
+// healthVerdict returns the health status of a node and a note explaining
+// it. connected is whether the node answers, synced and behind the last
+// comparison with the reference and err the errors of the last checks. It
+// is the verdict of the monitor, top and check.
+func healthVerdict(connected, synced bool, behind int64, threshold int, err error) (string, string) {
+	if !connected {
+		if err != nil {
+			return HealthCritical, fmt.Sprintf("Node unreachable: %v", err)
+		}
+		return HealthCritical, "Node unreachable"
 	}
 
-	// Block
+	if !synced {
+		// The errors may be the reason, i.e. the reference is unavailable
+		if err != nil {
+			return HealthCritical, fmt.Sprintf("Node is not synced: %d blocks behind (threshold %d) with errors: %v", behind, threshold, err)
+		}
+		return HealthCritical, fmt.Sprintf("Node is not synced: %d blocks behind (threshold %d)", behind, threshold)
+	}
 
-	block, err := m.ethClient.BlockByNumber(blockNumber)
 	if err != nil {
-		errors = multierror.Append(errors, err)
-	} else {
-		if m.lastBlock != nil {
-			blockTime := block.Timestamp.Sub(*m.lastBlock.Timestamp)
-			metrics.SetGaugeWithLabels([]string{"blocktime"}, float32(blockTime.Seconds()), m.baseLabels)
-		}
-		m.lastBlock = block
+		return HealthWarning, fmt.Sprintf("Node synced (%d blocks behind) with errors: %v", behind, err)
 	}
 
-	// Etherscan
+	return HealthPassing, fmt.Sprintf("Node synced: %d blocks behind", behind)
+}
 
-	if blockNumber != nil {
-		realBlockNumber, err := m.etherscan.BlockNumber()
-		if err != nil {
-			errors = multierror.Append(errors, err)
-		} else {
-			blocksbehind := Sub(realBlockNumber, blockNumber)
-			metrics.SetGaugeWithLabels([]string{"blocksbehind"}, float32(blocksbehind.Int64()), m.baseLabels)
+// isSyncedWithin returns true if the node is at most threshold blocks away
+// from the reference.
+func isSyncedWithin(behind int64, threshold int) bool {
+	if behind < 0 {
+		behind = -behind
+	}
+	return behind <= int64(threshold)
+}
 
-			blocksDiff := int(Abs(blocksbehind).Int64())
-			if blocksDiff <= m.config.SyncThreshold {
-				m.synced = true
-			} else {
-				m.synced = false
-			}
+// evaluateHealth returns the health status of the node and a note explaining
+// it, given the error of the last round of checks.
+func (m *Monitor) evaluateHealth(err error) (string, string) {
+	threshold := m.currentConfig().SyncThreshold
 
-		}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return healthVerdict(m.connected, m.synced, m.blocksBehind, threshold, err)
+}
+
+// currentConfig returns the config in use. It is replaced, never modified,
+// on reload.
+func (m *Monitor) currentConfig() *Config {
+	m.configLock.RLock()
+	defer m.configLock.RUnlock()
+
+	return m.config
+}
+
+// client returns the eth client of the current endpoints.
+func (m *Monitor) client() *EthClient {
+	m.configLock.RLock()
+	defer m.configLock.RUnlock()
+
+	return m.ethClient
+}
+
+func (m *Monitor) isConnected() bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.connected
+}
+
+// setConnected updates the connection state. The sync state of a node
+// disconnected is unknown, it is reset until the next collection.
+func (m *Monitor) setConnected(connected bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.connected = connected
+	m.metrics.setBool(m.metrics.up, []string{"up"}, connected)
+
+	if !connected {
+		m.synced = false
+		m.blocksBehind = 0
+		m.metrics.setBool(m.metrics.synced, []string{"synced"}, false)
+		m.metrics.setGauge(m.metrics.blocksBehind, []string{"blocksbehind"}, 0)
 	}
+}
 
-	return errors
+func (m *Monitor) isSynced() bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.synced
+}
+
+// setSynced updates the sync state. It returns true if the node changed
+// from synced to not synced or the other way around.
+func (m *Monitor) setSynced(synced bool, blocksBehind int64) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	changed := m.synced != synced
+	m.synced = synced
+	m.blocksBehind = blocksBehind
+	m.metrics.setBool(m.metrics.synced, []string{"synced"}, synced)
+
+	return changed
+}
+
+// setBlockNumber records the last head of the node, kept for the snapshots
+// of the history.
+func (m *Monitor) setBlockNumber(blockNumber uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.blockNumber = blockNumber
+}
+
+// setHeadTime records the timestamp of the last head of the node.
+func (m *Monitor) setHeadTime(headTime time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.headTime = headTime
+}
+
+// setSync records the sync progress of the node, nil if not syncing.
+func (m *Monitor) setSync(sync *RpcSync) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.sync = sync
+}
+
+// setPeers records the last number of peers of the node.
+func (m *Monitor) setPeers(peers int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.peers = peers
+}
+
+// reference returns the api used as a reference of the chain head.
+func (m *Monitor) reference() *Etherscan {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.etherscan
 }
@@ -0,0 +1,144 @@
+package monitor
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/melonproject/ethereum-exporter/monitor/ethtest"
+)
+
+func TestMonitorHealth(t *testing.T) {
+	cases := []struct {
+		name      string
+		script    func(node *ethtest.Node, etherscan *ethtest.Etherscan)
+		health    string
+		note      string
+		connected bool
+		synced    bool
+		behind    int64
+	}{
+		{"synced", func(node *ethtest.Node, etherscan *ethtest.Etherscan) {
+			node.Mine(2)
+		}, HealthPassing, "Node synced: 0 blocks behind", true, true, 0},
+		{"stalled", func(node *ethtest.Node, etherscan *ethtest.Etherscan) {
+			// The chain goes on without the node
+			node.SetBlockTime(0)
+			etherscan.SetAhead(20)
+		}, HealthCritical, "Node is not synced: 20 blocks behind (threshold 5)", true, false, 20},
+		{"within the threshold", func(node *ethtest.Node, etherscan *ethtest.Etherscan) {
+			etherscan.SetAhead(5)
+		}, HealthPassing, "Node synced: 5 blocks behind", true, true, 5},
+		{"reorg", func(node *ethtest.Node, etherscan *ethtest.Etherscan) {
+			node.Reorg(3)
+		}, HealthPassing, "Node synced: 0 blocks behind", true, true, 0},
+		{"no peers", func(node *ethtest.Node, etherscan *ethtest.Etherscan) {
+			node.SetPeers(0)
+		}, HealthPassing, "Node synced: 0 blocks behind", true, true, 0},
+		{"syncing", func(node *ethtest.Node, etherscan *ethtest.Etherscan) {
+			node.SetSyncing(2000)
+		}, HealthPassing, "Node synced: 0 blocks behind", true, true, 0},
+		{"method error", func(node *ethtest.Node, etherscan *ethtest.Etherscan) {
+			node.SetError("net_peerCount", &ethtest.Error{Code: -32601, Message: "the method net_peerCount does not exist"})
+		}, HealthWarning, "Node synced (0 blocks behind) with errors", true, true, 0},
+		{"node http status", func(node *ethtest.Node, etherscan *ethtest.Etherscan) {
+			node.SetHTTPStatus(502)
+		}, HealthWarning, "Node synced (0 blocks behind) with errors", true, true, 0},
+		{"reference http status", func(node *ethtest.Node, etherscan *ethtest.Etherscan) {
+			etherscan.SetHTTPStatus(500)
+		}, HealthWarning, "Node synced (0 blocks behind) with errors", true, true, 0},
+		{"down", func(node *ethtest.Node, etherscan *ethtest.Etherscan) {
+			node.SetDown(true)
+		}, HealthCritical, "Node unreachable", false, false, 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			node, etherscan := startTestNode(t)
+			m, reports := newTestMonitor(t, testConfig(node, etherscan))
+
+			// Connected and synced before the change
+			runTestCycle(m)
+			if health, note := reports.last(); health != HealthPassing {
+				t.Fatalf("expected the node passing before the change, got %s '%s'", health, note)
+			}
+
+			c.script(node, etherscan)
+			runTestCycle(m)
+
+			health, note := reports.last()
+			if health != c.health || !strings.HasPrefix(note, c.note) {
+				t.Errorf("expected %s '%s', got %s '%s'", c.health, c.note, health, note)
+			}
+
+			m.lock.RLock()
+			connected, synced, behind := m.connected, m.synced, m.blocksBehind
+			m.lock.RUnlock()
+
+			if connected != c.connected || synced != c.synced || behind != c.behind {
+				t.Errorf("expected connected %v, synced %v and %d blocks behind, got %v, %v and %d", c.connected, c.synced, c.behind, connected, synced, behind)
+			}
+
+			expected := map[string]float64{"ethereum_synced": 0, "ethereum_blocks_behind": float64(c.behind), "ethereum_up": 0}
+			if c.synced {
+				expected["ethereum_synced"] = 1
+			}
+			if c.connected {
+				expected["ethereum_up"] = 1
+			}
+			for name, value := range expected {
+				if got := gatherValue(t, m, name, nil); got != value {
+					t.Errorf("expected %s %v, got %v", name, value, got)
+				}
+			}
+		})
+	}
+}
+
+func TestMonitorNodeMetrics(t *testing.T) {
+	node, etherscan := startTestNode(t)
+	m, _ := newTestMonitor(t, testConfig(node, etherscan))
+
+	node.SetPeers(0)
+	node.SetSyncing(2000)
+	runTestCycle(m)
+
+	for name, value := range map[string]float64{
+		"ethereum_peers":              0,
+		"ethereum_syncing":            1,
+		"ethereum_sync_highest_block": 2000,
+		"ethereum_block_number":       1000,
+	} {
+		if got := gatherValue(t, m, name, nil); got != value {
+			t.Errorf("expected %s %v, got %v", name, value, got)
+		}
+	}
+}
+
+func TestMonitorStopTimeout(t *testing.T) {
+	node, etherscan := startTestNode(t)
+	m, reports := newTestMonitor(t, testConfig(node, etherscan))
+
+	// A loop that does not exit
+	m.wg.Add(1)
+	defer m.wg.Done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := m.Stop(ctx)
+	if err == nil || !strings.Contains(err.Error(), "timeout waiting for the monitor loop") {
+		t.Errorf("expected the timeout reported, got %v", err)
+	}
+	if err != nil && strings.Contains(err.Error(), "deregister") {
+		t.Errorf("expected the service deregistered after the timeout, got %v", err)
+	}
+
+	reports.lock.Lock()
+	defer reports.lock.Unlock()
+
+	if !reports.deregistered {
+		t.Errorf("expected the service deregistered")
+	}
+}
@@ -0,0 +1,254 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Nagios plugin states, also the exit codes of the plugin
+const (
+	NagiosOK       = 0
+	NagiosWarning  = 1
+	NagiosCritical = 2
+	NagiosUnknown  = 3
+)
+
+var nagiosStates = map[int]string{
+	NagiosOK:       "OK",
+	NagiosWarning:  "WARNING",
+	NagiosCritical: "CRITICAL",
+	NagiosUnknown:  "UNKNOWN",
+}
+
+// Severity of the states, unknown is worse than warning but better than
+// critical
+var nagiosSeverity = map[int]int{
+	NagiosOK:       0,
+	NagiosWarning:  1,
+	NagiosUnknown:  2,
+	NagiosCritical: 3,
+}
+
+// CheckOptions are the thresholds of the one-shot check. A zero threshold
+// is disabled.
+type CheckOptions struct {
+	// Max blocks behind the reference
+	WarnBehind int64
+	CritBehind int64
+
+	// Min peers
+	WarnPeers int64
+	CritPeers int64
+
+	// Max age of the last block of the node
+	WarnHeadAge time.Duration
+	CritHeadAge time.Duration
+
+	// Etherscan compatible api used as reference of the chain head.
+	// Defaults to the reference of the config.
+	ReferenceURL string
+}
+
+// CheckResult is the outcome of the one-shot check.
+type CheckResult struct {
+	Status int
+
+	// Results of each check, the problems first
+	problems []string
+	messages []string
+
+	perfdata []string
+}
+
+// add records the result of a check. The status of the result is the
+// worst of all the checks.
+func (r *CheckResult) add(status int, format string, args ...interface{}) {
+	msg := oneLine(fmt.Sprintf(format, args...))
+
+	if status == NagiosOK {
+		r.messages = append(r.messages, msg)
+	} else {
+		r.problems = append(r.problems, msg)
+	}
+
+	if nagiosSeverity[status] > nagiosSeverity[r.Status] {
+		r.Status = status
+	}
+}
+
+// perf adds a performance data value ('label'=value[uom];warn;crit;min;max).
+func (r *CheckResult) perf(label, value, warn, crit string) {
+	r.perfdata = append(r.perfdata, fmt.Sprintf("%s=%s;%s;%s;0;", label, value, warn, crit))
+}
+
+// String returns the status line of the plugin with the perfdata.
+func (r *CheckResult) String() string {
+	line := fmt.Sprintf("ETHEREUM %s - %s", nagiosStates[r.Status], strings.Join(append(r.problems, r.messages...), ", "))
+	if len(r.perfdata) != 0 {
+		line += " | " + strings.Join(r.perfdata, " ")
+	}
+	return line
+}
+
+// oneLine joins the lines of multiline errors, the plugin output is a
+// single line.
+func oneLine(str string) string {
+	lines := []string{}
+	for _, line := range strings.Split(str, "\n") {
+		if line = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "*")); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, " ")
+}
+
+// threshold formats a threshold for the perfdata, empty if disabled.
+func threshold(value int64, min bool) string {
+	switch {
+	case value == 0:
+		return ""
+	case min:
+		// Alert below the value
+		return fmt.Sprintf("%d:", value)
+	}
+	return fmt.Sprintf("%d", value)
+}
+
+// nagiosStatus returns the status code of a health verdict.
+func nagiosStatus(health string) int {
+	switch health {
+	case HealthPassing:
+		return NagiosOK
+	case HealthWarning:
+		return NagiosWarning
+	}
+	return NagiosCritical
+}
+
+// RunCheck runs one round of the checks of the monitor (connectivity,
+// blocks behind the reference, peers, age of the head and sync) against the
+// endpoints of the config.
+func RunCheck(ctx context.Context, config *Config, options *CheckOptions) *CheckResult {
+	r := &CheckResult{}
+
+	logger := log.New(ioutil.Discard, "", 0)
+
+	client, err := NewEthClient(logger, config.RPCEndpoints(), config.RPCConfig, NewMetrics(config.MetricLabels(), nil), nil)
+	if err != nil {
+		r.add(NagiosUnknown, "invalid rpc config: %v", err)
+		return r
+	}
+	defer client.Close()
+
+	// Connectivity, eth_blockNumber is answered by every client
+
+	blockNumber, err := client.BlockNumber(ctx)
+	if err != nil {
+		health, note := healthVerdict(false, false, 0, config.SyncThreshold, err)
+		r.add(nagiosStatus(health), "%s", note)
+		return r
+	}
+	r.perf("block", blockNumber.String(), "", "")
+
+	// Blocks behind
+
+	refURL := options.ReferenceURL
+	if refURL == "" {
+		refURL = config.ReferenceURL
+	}
+	if refURL == "" {
+		// parity_chain is only answered by parity
+		var chain string
+		if chain, err = client.Chain(ctx); err != nil {
+			err = fmt.Errorf("failed to get the chain: %v", err)
+		} else {
+			refURL, err = referenceURL(chain)
+		}
+	}
+	if err != nil {
+		r.add(NagiosUnknown, "no reference for the chain: %v", err)
+	} else {
+		reference, err := NewEtherscan(refURL, &http.Client{Timeout: client.timeout}, config.EtherscanConfig)
+		if err != nil {
+			r.add(NagiosUnknown, "invalid reference: %v", err)
+		} else if realBlockNumber, err := reference.BlockNumber(ctx); err != nil {
+			r.add(NagiosUnknown, "reference unavailable: %v", err)
+		} else {
+			behind := Sub(realBlockNumber, blockNumber).Int64()
+			diff := Abs(Sub(realBlockNumber, blockNumber)).Int64()
+
+			// The critical threshold is the sync threshold of the verdict
+			switch {
+			case options.CritBehind != 0 && !isSyncedWithin(behind, int(options.CritBehind)):
+				health, note := healthVerdict(true, false, behind, int(options.CritBehind), nil)
+				r.add(nagiosStatus(health), "%s", note)
+			case options.WarnBehind != 0 && diff > options.WarnBehind:
+				r.add(NagiosWarning, "%d blocks behind (> %d)", behind, options.WarnBehind)
+			default:
+				r.add(NagiosOK, "%d blocks behind", behind)
+			}
+			r.perf("blocks_behind", fmt.Sprintf("%d", behind), threshold(options.WarnBehind, false), threshold(options.CritBehind, false))
+		}
+	}
+
+	// Peers
+
+	if peers, err := client.PeerCount(ctx); err != nil {
+		r.add(NagiosUnknown, "failed to get the peers: %v", err)
+	} else {
+		switch {
+		case options.CritPeers != 0 && peers < options.CritPeers:
+			r.add(NagiosCritical, "%d peers (< %d)", peers, options.CritPeers)
+		case options.WarnPeers != 0 && peers < options.WarnPeers:
+			r.add(NagiosWarning, "%d peers (< %d)", peers, options.WarnPeers)
+		default:
+			r.add(NagiosOK, "%d peers", peers)
+		}
+		r.perf("peers", fmt.Sprintf("%d", peers), threshold(options.WarnPeers, true), threshold(options.CritPeers, true))
+	}
+
+	// Head age
+
+	if block, err := client.BlockByNumber(ctx, blockNumber); err != nil || block.Timestamp == nil {
+		r.add(NagiosUnknown, "failed to get the last block: %v", err)
+	} else {
+		age := time.Since(*block.Timestamp)
+		if age < 0 {
+			age = 0
+		}
+		age = age.Truncate(time.Second)
+
+		switch {
+		case options.CritHeadAge != 0 && age > options.CritHeadAge:
+			r.add(NagiosCritical, "head %s old (> %s)", age, options.CritHeadAge)
+		case options.WarnHeadAge != 0 && age > options.WarnHeadAge:
+			r.add(NagiosWarning, "head %s old (> %s)", age, options.WarnHeadAge)
+		default:
+			r.add(NagiosOK, "head %s old", age)
+		}
+
+		durationThreshold := func(d time.Duration) string {
+			return threshold(int64(d/time.Second), false)
+		}
+		r.perf("head_age", fmt.Sprintf("%ds", int64(age/time.Second)), durationThreshold(options.WarnHeadAge), durationThreshold(options.CritHeadAge))
+	}
+
+	// Sync
+
+	if sync, err := client.Syncing(ctx); err != nil {
+		r.add(NagiosUnknown, "failed to get the sync status: %v", err)
+	} else if sync != nil {
+		r.add(NagiosWarning, "syncing (block %s of %s)", sync.CurrentBlock, sync.HighestBlock)
+		r.perf("syncing", "1", "", "")
+	} else {
+		r.add(NagiosOK, "not syncing")
+		r.perf("syncing", "0", "", "")
+	}
+
+	return r
+}
@@ -0,0 +1,68 @@
+package monitor
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/melonproject/ethereum-exporter/monitor/ethtest"
+)
+
+func runTestCheck(t *testing.T, node *ethtest.Node, etherscan *ethtest.Etherscan) *CheckResult {
+	config := DefaultConfig()
+	config.Endpoint = node.URL()
+	config.RPCConfig.Retries = 0
+	if etherscan != nil {
+		config.ReferenceURL = etherscan.URL()
+	}
+
+	options := &CheckOptions{WarnBehind: 3, CritBehind: 10, CritPeers: 1, WarnHeadAge: time.Minute, CritHeadAge: 5 * time.Minute}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return RunCheck(ctx, config, options)
+}
+
+func TestRunCheck(t *testing.T) {
+	cases := []struct {
+		name     string
+		script   func(node *ethtest.Node, etherscan *ethtest.Etherscan)
+		status   int
+		contains string
+	}{
+		{"synced", func(node *ethtest.Node, etherscan *ethtest.Etherscan) {}, NagiosOK, "0 blocks behind"},
+		{"behind", func(node *ethtest.Node, etherscan *ethtest.Etherscan) { etherscan.SetAhead(20) }, NagiosCritical, "Node is not synced: 20 blocks behind (threshold 10)"},
+		{"no peers", func(node *ethtest.Node, etherscan *ethtest.Etherscan) { node.SetPeers(0) }, NagiosCritical, "0 peers (< 1)"},
+		{"syncing", func(node *ethtest.Node, etherscan *ethtest.Etherscan) { node.SetSyncing(2000) }, NagiosWarning, "syncing"},
+		{"reference down", func(node *ethtest.Node, etherscan *ethtest.Etherscan) { etherscan.SetHTTPStatus(500) }, NagiosUnknown, "reference unavailable"},
+		{"down", func(node *ethtest.Node, etherscan *ethtest.Etherscan) { node.SetDown(true) }, NagiosCritical, "Node unreachable"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			node, etherscan := startTestNode(t)
+			c.script(node, etherscan)
+
+			result := runTestCheck(t, node, etherscan)
+			if result.Status != c.status || !strings.Contains(result.String(), c.contains) {
+				t.Errorf("expected status %d with '%s', got %s", c.status, c.contains, result)
+			}
+		})
+	}
+}
+
+func TestRunCheckWithoutParityChain(t *testing.T) {
+	node, _ := startTestNode(t)
+	node.SetError("parity_chain", &ethtest.Error{Code: -32601, Message: "the method parity_chain does not exist/is not available"})
+
+	// Without reference url the chain is needed to find the reference
+	result := runTestCheck(t, node, nil)
+	if result.Status != NagiosUnknown {
+		t.Errorf("expected the node reachable and the reference unknown, got %s", result)
+	}
+	if !strings.Contains(result.String(), "failed to get the chain") || strings.Contains(result.String(), "Node unreachable") {
+		t.Errorf("expected the chain failure reported, got %s", result)
+	}
+}
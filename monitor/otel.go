@@ -0,0 +1,341 @@
+package monitor
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// otlpConfigFromEnv returns a copy of the config with the standard
+// OpenTelemetry environment variables applied on top. Only the http/json
+// protocol is implemented, the exporter falls back to it with a warning if
+// another one is set.
+func otlpConfigFromEnv(logger *log.Logger, config *OTLPConfig, getenv func(string) string) (*OTLPConfig, error) {
+	c := *config
+
+	c.Headers = map[string]string{}
+	for k, v := range config.Headers {
+		c.Headers[k] = v
+	}
+	c.ResourceAttributes = map[string]string{}
+	for k, v := range config.ResourceAttributes {
+		c.ResourceAttributes[k] = v
+	}
+
+	if v := getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); v != "" {
+		c.Endpoint = v
+	}
+	if v := getenv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT"); v != "" {
+		c.MetricsEndpoint = v
+	}
+	if v := getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); v != "" {
+		c.TracesEndpoint = v
+	}
+
+	for _, name := range []string{"OTEL_EXPORTER_OTLP_HEADERS", "OTEL_EXPORTER_OTLP_METRICS_HEADERS", "OTEL_EXPORTER_OTLP_TRACES_HEADERS"} {
+		headers, err := parseOTLPList(getenv(name))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", name, err)
+		}
+		for k, v := range headers {
+			c.Headers[k] = v
+		}
+	}
+
+	if v := getenv("OTEL_EXPORTER_OTLP_TIMEOUT"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_TIMEOUT '%s': %v", v, err)
+		}
+		c.Timeout = (time.Duration(ms) * time.Millisecond).String()
+	}
+
+	if v := getenv("OTEL_METRIC_EXPORT_INTERVAL"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OTEL_METRIC_EXPORT_INTERVAL '%s': %v", v, err)
+		}
+		c.MetricsInterval = (time.Duration(ms) * time.Millisecond).String()
+	}
+
+	attributes, err := parseOTLPList(getenv("OTEL_RESOURCE_ATTRIBUTES"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTEL_RESOURCE_ATTRIBUTES: %v", err)
+	}
+	for k, v := range attributes {
+		c.ResourceAttributes[k] = v
+	}
+
+	if v := getenv("OTEL_SERVICE_NAME"); v != "" {
+		c.ServiceName = v
+	}
+
+	if v := getenv("OTEL_METRICS_EXPORTER"); v != "" {
+		c.DisableMetrics = v == "none"
+	}
+	if v := getenv("OTEL_TRACES_EXPORTER"); v != "" {
+		c.DisableTraces = v == "none"
+	}
+	if getenv("OTEL_SDK_DISABLED") == "true" {
+		c.DisableMetrics = true
+		c.DisableTraces = true
+	}
+
+	for _, name := range []string{"OTEL_EXPORTER_OTLP_PROTOCOL", "OTEL_EXPORTER_OTLP_METRICS_PROTOCOL", "OTEL_EXPORTER_OTLP_TRACES_PROTOCOL"} {
+		if v := getenv(name); v != "" && v != "http/json" {
+			logger.Printf("OTLP protocol %s of %s not supported. Using http/json", v, name)
+		}
+	}
+
+	return &c, nil
+}
+
+// parseOTLPList parses a list of url encoded key=value pairs separated by
+// commas, the format of the OTEL_*_HEADERS and OTEL_RESOURCE_ATTRIBUTES
+// variables.
+func parseOTLPList(str string) (map[string]string, error) {
+	list := map[string]string{}
+
+	for _, pair := range strings.Split(str, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("'%s' is not a key=value pair", pair)
+		}
+
+		key, err := url.QueryUnescape(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return nil, err
+		}
+		value, err := url.QueryUnescape(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+
+		list[key] = value
+	}
+
+	return list, nil
+}
+
+// signalURL returns the url of a signal (metrics or traces).
+func (c *OTLPConfig) signalURL(endpoint, signal string) string {
+	if endpoint != "" {
+		return endpoint
+	}
+	if c.Endpoint == "" {
+		return ""
+	}
+	return strings.TrimSuffix(c.Endpoint, "/") + "/v1/" + signal
+}
+
+// pushConfig returns the config of the pusher of a signal.
+func (c *OTLPConfig) pushConfig(url string) *PushConfig {
+	config := DefaultPushConfig()
+	config.URL = url
+	config.Interval = c.MetricsInterval
+	config.Timeout = c.Timeout
+	config.Headers = c.Headers
+	config.MaxBuffered = 100
+	return config
+}
+
+// resource returns the attributes of the resource.
+func (c *OTLPConfig) resource() map[string]string {
+	resource := map[string]string{}
+	for k, v := range c.ResourceAttributes {
+		resource[k] = v
+	}
+	resource["service.name"] = c.ServiceName
+	return resource
+}
+
+func (m *Monitor) setupOTLP() error {
+	config, err := otlpConfigFromEnv(m.logger, m.config.OTLPConfig, os.Getenv)
+	if err != nil {
+		return err
+	}
+
+	if url := config.signalURL(config.MetricsEndpoint, "metrics"); url != "" && !config.DisableMetrics {
+		encoder := &otlpMetricsEncoder{resource: config.resource(), start: time.Now()}
+
+		pusher, err := NewPusher(m.logger, "otlp metrics", config.pushConfig(url), encoder, m.registry)
+		if err != nil {
+			return err
+		}
+		m.pushers = append(m.pushers, pusher)
+	}
+
+	if url := config.signalURL(config.TracesEndpoint, "traces"); url != "" && !config.DisableTraces {
+		pusher, err := NewPusher(m.logger, "otlp traces", config.pushConfig(url), &otlpTracesEncoder{}, nil)
+		if err != nil {
+			return err
+		}
+		m.tracer = NewTracer(m.logger, pusher, config.resource())
+	}
+
+	return nil
+}
+
+// Kinds of the spans
+const (
+	SpanKindInternal = 1
+	SpanKindClient   = 3
+)
+
+// Max spans waiting to be exported and spans per export request
+const (
+	maxQueuedSpans = 2048
+	maxSpanBatch   = 512
+)
+
+// Tracer records spans and exports them periodically to an OTLP/HTTP
+// collector. A nil Tracer records nothing.
+type Tracer struct {
+	logger   *log.Logger
+	pusher   *Pusher
+	resource map[string]string
+
+	lock  sync.Mutex
+	spans []*Span
+}
+
+func NewTracer(logger *log.Logger, pusher *Pusher, resource map[string]string) *Tracer {
+	return &Tracer{
+		logger:   logger,
+		pusher:   pusher,
+		resource: resource,
+	}
+}
+
+// Span is an operation of a trace.
+type Span struct {
+	tracer *Tracer
+
+	traceID  string
+	spanID   string
+	parentID string
+
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes map[string]string
+	err        error
+}
+
+type spanKey struct{}
+
+// Start starts a span, child of the span in ctx if any, and returns a
+// context with the new span.
+func (t *Tracer) Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		tracer:     t,
+		spanID:     randomID(8),
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: map[string]string{},
+	}
+
+	if parent, ok := ctx.Value(spanKey{}).(*Span); ok {
+		span.traceID = parent.traceID
+		span.parentID = parent.spanID
+	} else {
+		span.traceID = randomID(16)
+	}
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// SetAttribute sets an attribute of the span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.attributes[key] = value
+}
+
+// End ends the span, with an error status if err is not nil, and queues it
+// for export.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+
+	s.end = time.Now()
+	s.err = err
+
+	t := s.tracer
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// Drop the span if the collector is not keeping up
+	if len(t.spans) < maxQueuedSpans {
+		t.spans = append(t.spans, s)
+	}
+}
+
+func randomID(size int) string {
+	id := make([]byte, size)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Run exports the ended spans every interval until ctx is done.
+func (t *Tracer) Run(ctx context.Context) {
+	for {
+		select {
+		case <-time.After(5 * time.Second):
+		case <-ctx.Done():
+			return
+		}
+
+		if err := t.Flush(ctx); err != nil {
+			t.logger.Printf("Failed to export the spans: %v", err)
+		}
+	}
+}
+
+// Flush exports the ended spans.
+func (t *Tracer) Flush(ctx context.Context) error {
+	t.lock.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.lock.Unlock()
+
+	for len(spans) != 0 {
+		batch := spans
+		if len(batch) > maxSpanBatch {
+			batch = spans[:maxSpanBatch]
+		}
+		spans = spans[len(batch):]
+
+		data, err := json.Marshal(newOTLPTraces(t.resource, batch))
+		if err != nil {
+			return err
+		}
+		if err := t.pusher.queue.push(data); err != nil {
+			return err
+		}
+	}
+
+	return t.pusher.flush(ctx)
+}
@@ -0,0 +1,394 @@
+package monitor
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Messages of the OTLP/HTTP json encoding. Only the fields set by the
+// exporter are declared.
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+func otlpAttributes(attributes map[string]string) []otlpKeyValue {
+	keys := []string{}
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	kvs := []otlpKeyValue{}
+	for _, k := range keys {
+		kvs = append(kvs, otlpKeyValue{Key: k, Value: otlpAnyValue{StringValue: attributes[k]}})
+	}
+	return kvs
+}
+
+// otlpTime encodes the time as nanoseconds since epoch. 64 bit integers are
+// strings in the json encoding.
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// Metrics
+
+type otlpMetricsRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope     `json:"scope"`
+	Metrics []*otlpMetric `json:"metrics"`
+}
+
+type otlpMetric struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Gauge       *otlpGauge     `json:"gauge,omitempty"`
+	Sum         *otlpSum       `json:"sum,omitempty"`
+	Histogram   *otlpHistogram `json:"histogram,omitempty"`
+	Summary     *otlpSummary   `json:"summary,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []*otlpNumberDataPoint `json:"dataPoints"`
+}
+
+// Cumulative aggregation temporality
+const otlpCumulative = 2
+
+type otlpSum struct {
+	DataPoints             []*otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                    `json:"aggregationTemporality"`
+	IsMonotonic            bool                   `json:"isMonotonic"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	AsDouble          float64        `json:"asDouble"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []*otlpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                       `json:"aggregationTemporality"`
+}
+
+type otlpHistogramDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	Count             string         `json:"count"`
+	Sum               float64        `json:"sum"`
+	BucketCounts      []string       `json:"bucketCounts"`
+	ExplicitBounds    []float64      `json:"explicitBounds"`
+}
+
+type otlpSummary struct {
+	DataPoints []*otlpSummaryDataPoint `json:"dataPoints"`
+}
+
+type otlpSummaryDataPoint struct {
+	Attributes        []otlpKeyValue      `json:"attributes"`
+	StartTimeUnixNano string              `json:"startTimeUnixNano"`
+	TimeUnixNano      string              `json:"timeUnixNano"`
+	Count             string              `json:"count"`
+	Sum               float64             `json:"sum"`
+	QuantileValues    []otlpQuantileValue `json:"quantileValues"`
+}
+
+type otlpQuantileValue struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+// otlpMetricsEncoder encodes the metrics as OTLP/HTTP json export requests.
+// Counters are cumulative sums since the exporter started.
+type otlpMetricsEncoder struct {
+	resource map[string]string
+	start    time.Time
+}
+
+func (e *otlpMetricsEncoder) SetHeaders(header http.Header) {
+	header.Set("Content-Type", "application/json")
+}
+
+func (e *otlpMetricsEncoder) Encode(families []*dto.MetricFamily, now time.Time, batchSize int) ([][]byte, error) {
+	batches := [][]byte{}
+	metrics := []*otlpMetric{}
+	points := 0
+
+	flush := func() error {
+		req := &otlpMetricsRequest{
+			ResourceMetrics: []otlpResourceMetrics{{
+				Resource: otlpResource{Attributes: otlpAttributes(e.resource)},
+				ScopeMetrics: []otlpScopeMetrics{{
+					Scope:   otlpScope{Name: "ethereum-exporter"},
+					Metrics: metrics,
+				}},
+			}},
+		}
+
+		data, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+
+		batches = append(batches, data)
+		metrics = []*otlpMetric{}
+		points = 0
+		return nil
+	}
+
+	for _, family := range families {
+		metric := e.encodeFamily(family, now)
+		if metric == nil {
+			continue
+		}
+
+		metrics = append(metrics, metric)
+		points += len(family.GetMetric())
+
+		if points >= batchSize {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(metrics) != 0 {
+		if err := flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	return batches, nil
+}
+
+func (e *otlpMetricsEncoder) encodeFamily(family *dto.MetricFamily, now time.Time) *otlpMetric {
+	metric := &otlpMetric{
+		Name:        family.GetName(),
+		Description: family.GetHelp(),
+	}
+
+	start := otlpTime(e.start)
+
+	for _, m := range family.GetMetric() {
+		attributes := map[string]string{}
+		for _, label := range m.GetLabel() {
+			attributes[label.GetName()] = label.GetValue()
+		}
+
+		timestamp := now
+		if m.TimestampMs != nil {
+			timestamp = time.Unix(0, m.GetTimestampMs()*int64(time.Millisecond))
+		}
+
+		number := func(value float64) *otlpNumberDataPoint {
+			return &otlpNumberDataPoint{
+				Attributes:   otlpAttributes(attributes),
+				TimeUnixNano: otlpTime(timestamp),
+				AsDouble:     value,
+			}
+		}
+
+		switch family.GetType() {
+		case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+			value := m.GetGauge().GetValue()
+			if family.GetType() == dto.MetricType_UNTYPED {
+				value = m.GetUntyped().GetValue()
+			}
+			if !otlpValid(value) {
+				continue
+			}
+			if metric.Gauge == nil {
+				metric.Gauge = &otlpGauge{}
+			}
+			metric.Gauge.DataPoints = append(metric.Gauge.DataPoints, number(value))
+
+		case dto.MetricType_COUNTER:
+			value := m.GetCounter().GetValue()
+			if !otlpValid(value) {
+				continue
+			}
+			if metric.Sum == nil {
+				metric.Sum = &otlpSum{AggregationTemporality: otlpCumulative, IsMonotonic: true}
+			}
+			point := number(value)
+			point.StartTimeUnixNano = start
+			metric.Sum.DataPoints = append(metric.Sum.DataPoints, point)
+
+		case dto.MetricType_HISTOGRAM:
+			h := m.GetHistogram()
+			point := &otlpHistogramDataPoint{
+				Attributes:        otlpAttributes(attributes),
+				StartTimeUnixNano: start,
+				TimeUnixNano:      otlpTime(timestamp),
+				Count:             strconv.FormatUint(h.GetSampleCount(), 10),
+				Sum:               h.GetSampleSum(),
+				BucketCounts:      []string{},
+				ExplicitBounds:    []float64{},
+			}
+
+			// OTLP buckets are not cumulative and the last one is +Inf
+			var previous uint64
+			for _, b := range h.GetBucket() {
+				if math.IsInf(b.GetUpperBound(), +1) {
+					continue
+				}
+				point.ExplicitBounds = append(point.ExplicitBounds, b.GetUpperBound())
+				point.BucketCounts = append(point.BucketCounts, strconv.FormatUint(b.GetCumulativeCount()-previous, 10))
+				previous = b.GetCumulativeCount()
+			}
+			point.BucketCounts = append(point.BucketCounts, strconv.FormatUint(h.GetSampleCount()-previous, 10))
+
+			if metric.Histogram == nil {
+				metric.Histogram = &otlpHistogram{AggregationTemporality: otlpCumulative}
+			}
+			metric.Histogram.DataPoints = append(metric.Histogram.DataPoints, point)
+
+		case dto.MetricType_SUMMARY:
+			s := m.GetSummary()
+			point := &otlpSummaryDataPoint{
+				Attributes:        otlpAttributes(attributes),
+				StartTimeUnixNano: start,
+				TimeUnixNano:      otlpTime(timestamp),
+				Count:             strconv.FormatUint(s.GetSampleCount(), 10),
+				Sum:               s.GetSampleSum(),
+				QuantileValues:    []otlpQuantileValue{},
+			}
+			for _, q := range s.GetQuantile() {
+				if otlpValid(q.GetValue()) {
+					point.QuantileValues = append(point.QuantileValues, otlpQuantileValue{Quantile: q.GetQuantile(), Value: q.GetValue()})
+				}
+			}
+
+			if metric.Summary == nil {
+				metric.Summary = &otlpSummary{}
+			}
+			metric.Summary.DataPoints = append(metric.Summary.DataPoints, point)
+		}
+	}
+
+	if metric.Gauge == nil && metric.Sum == nil && metric.Histogram == nil && metric.Summary == nil {
+		return nil
+	}
+
+	return metric
+}
+
+// otlpValid returns false for the values json cannot encode.
+func otlpValid(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+// Traces
+
+type otlpTracesRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope   `json:"scope"`
+	Spans []*otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes"`
+	Status            otlpStatus     `json:"status"`
+}
+
+// Status codes of the spans
+const (
+	otlpStatusOk    = 1
+	otlpStatusError = 2
+)
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func newOTLPTraces(resource map[string]string, spans []*Span) *otlpTracesRequest {
+	otlpSpans := []*otlpSpan{}
+
+	for _, span := range spans {
+		s := &otlpSpan{
+			TraceID:           span.traceID,
+			SpanID:            span.spanID,
+			ParentSpanID:      span.parentID,
+			Name:              span.name,
+			Kind:              span.kind,
+			StartTimeUnixNano: otlpTime(span.start),
+			EndTimeUnixNano:   otlpTime(span.end),
+			Attributes:        otlpAttributes(span.attributes),
+			Status:            otlpStatus{Code: otlpStatusOk},
+		}
+		if span.err != nil {
+			s.Status = otlpStatus{Code: otlpStatusError, Message: span.err.Error()}
+		}
+
+		otlpSpans = append(otlpSpans, s)
+	}
+
+	return &otlpTracesRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{Attributes: otlpAttributes(resource)},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "ethereum-exporter"},
+				Spans: otlpSpans,
+			}},
+		}},
+	}
+}
+
+// otlpTracesEncoder sets the headers of the trace export requests. The
+// spans are not gathered but queued by the tracer.
+type otlpTracesEncoder struct{}
+
+func (e *otlpTracesEncoder) SetHeaders(header http.Header) {
+	header.Set("Content-Type", "application/json")
+}
+
+func (e *otlpTracesEncoder) Encode(families []*dto.MetricFamily, now time.Time, batchSize int) ([][]byte, error) {
+	return nil, nil
+}
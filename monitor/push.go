@@ -0,0 +1,369 @@
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// pushEncoder converts the gathered metrics into the bodies of the push
+// requests.
+type pushEncoder interface {
+	// Encode returns the bodies, split every batchSize samples or lines
+	Encode(families []*dto.MetricFamily, now time.Time, batchSize int) ([][]byte, error)
+
+	// SetHeaders sets the content headers of the requests
+	SetHeaders(header http.Header)
+}
+
+// Pusher periodically pushes the metrics of the registry to a remote. The
+// batches are buffered while the remote is unavailable and sent in order
+// once it is back.
+type Pusher struct {
+	logger   *log.Logger
+	name     string
+	config   *PushConfig
+	encoder  pushEncoder
+	gatherer prometheus.Gatherer
+	client   *http.Client
+	queue    *pushQueue
+
+	interval time.Duration
+	backoff  time.Duration
+}
+
+func NewPusher(logger *log.Logger, name string, config *PushConfig, encoder pushEncoder, gatherer prometheus.Gatherer) (*Pusher, error) {
+	interval, err := time.ParseDuration(config.Interval)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s interval '%s': %v", name, config.Interval, err)
+	}
+
+	timeout, err := time.ParseDuration(config.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s timeout '%s': %v", name, config.Timeout, err)
+	}
+
+	backoff, err := time.ParseDuration(config.RetryBackoff)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s retry backoff '%s': %v", name, config.RetryBackoff, err)
+	}
+
+	if config.BatchSize <= 0 {
+		return nil, fmt.Errorf("invalid %s batch size %d", name, config.BatchSize)
+	}
+
+	queue, err := newPushQueue(config.BufferDir, config.MaxBuffered)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the %s buffer: %v", name, err)
+	}
+
+	p := &Pusher{
+		logger:   logger,
+		name:     name,
+		config:   config,
+		encoder:  encoder,
+		gatherer: gatherer,
+		client:   &http.Client{Timeout: timeout},
+		queue:    queue,
+		interval: interval,
+		backoff:  backoff,
+	}
+
+	return p, nil
+}
+
+func (m *Monitor) setupPushers() ([]*Pusher, error) {
+	pushers := []*Pusher{}
+
+	if config := m.config.InfluxDBConfig; config != nil && config.URL != "" {
+		p, err := NewPusher(m.logger, "influxdb", config, &influxEncoder{}, m.registry)
+		if err != nil {
+			return nil, err
+		}
+		pushers = append(pushers, p)
+	}
+
+	if config := m.config.RemoteWriteConfig; config != nil && config.URL != "" {
+		p, err := NewPusher(m.logger, "remote write", config, &remoteWriteEncoder{}, m.registry)
+		if err != nil {
+			return nil, err
+		}
+		pushers = append(pushers, p)
+	}
+
+	return pushers, nil
+}
+
+// Run pushes the metrics every interval until ctx is done.
+func (p *Pusher) Run(ctx context.Context) {
+	for {
+		select {
+		case <-time.After(p.interval):
+		case <-ctx.Done():
+			return
+		}
+
+		if err := p.gather(); err != nil {
+			p.logger.Printf("Failed to gather the %s metrics: %v", p.name, err)
+		}
+
+		if err := p.flush(ctx); err != nil {
+			p.logger.Printf("Failed to push the metrics to %s (%d batches buffered): %v", p.name, p.queue.len(), err)
+		}
+	}
+}
+
+// gather encodes the current metrics and appends them to the queue.
+func (p *Pusher) gather() error {
+	families, err := p.gatherer.Gather()
+	if err != nil {
+		return err
+	}
+
+	batches, err := p.encoder.Encode(families, time.Now(), p.config.BatchSize)
+	if err != nil {
+		return err
+	}
+
+	for _, batch := range batches {
+		if err := p.queue.push(batch); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// flush sends the buffered batches, oldest first. It stops at the first
+// batch that cannot be sent so the order is kept.
+func (p *Pusher) flush(ctx context.Context) error {
+	for p.queue.len() != 0 {
+		batch, err := p.queue.peek()
+		if err != nil {
+			return err
+		}
+
+		if err := p.sendWithRetries(ctx, batch); err != nil {
+			if _, ok := err.(*pushRejectedError); !ok {
+				return err
+			}
+
+			// The remote will never accept it, drop it
+			p.logger.Printf("Dropping batch rejected by %s: %v", p.name, err)
+		}
+
+		if err := p.queue.pop(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *Pusher) sendWithRetries(ctx context.Context, batch []byte) error {
+	var err error
+
+	for attempt := 0; attempt <= p.config.Retries; attempt++ {
+		if attempt != 0 {
+			select {
+			case <-time.After(jitter(p.backoff << uint(attempt-1))):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		if err = p.send(ctx, batch); err == nil {
+			return nil
+		}
+		if _, ok := err.(*pushRejectedError); ok {
+			return err
+		}
+	}
+
+	return err
+}
+
+// pushRejectedError is a client error (4xx other than 429) returned by the
+// remote. Retrying the same batch would fail again.
+type pushRejectedError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *pushRejectedError) Error() string {
+	return fmt.Sprintf("status code %d: %s", e.StatusCode, e.Body)
+}
+
+func (p *Pusher) send(ctx context.Context, batch []byte) error {
+	req, err := http.NewRequest("POST", p.config.URL, bytes.NewReader(batch))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	p.encoder.SetHeaders(req.Header)
+	for k, v := range p.config.Headers {
+		req.Header.Set(k, v)
+	}
+	if p.config.Username != "" {
+		req.SetBasicAuth(p.config.Username, p.config.Password)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		return &pushRejectedError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+
+	return &StatusError{StatusCode: resp.StatusCode, Body: string(body)}
+}
+
+// pushQueue is a fifo of batches, kept in memory or, if dir is set, in
+// files so they survive restarts. It is only used by the pusher goroutine.
+type pushQueue struct {
+	dir string
+	max int
+
+	// Batches in memory or names of the batch files
+	batches [][]byte
+	files   []string
+
+	// Sequence number of the next batch file
+	seq uint64
+}
+
+const pushBatchExt = ".batch"
+
+func newPushQueue(dir string, max int) (*pushQueue, error) {
+	q := &pushQueue{
+		dir: dir,
+		max: max,
+	}
+
+	if dir == "" {
+		return q, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, pushBatchExt) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, pushBatchExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		if seq >= q.seq {
+			q.seq = seq + 1
+		}
+
+		q.files = append(q.files, name)
+	}
+
+	// The names are zero padded so they sort by sequence
+	sort.Strings(q.files)
+
+	return q, nil
+}
+
+func (q *pushQueue) len() int {
+	if q.dir == "" {
+		return len(q.batches)
+	}
+	return len(q.files)
+}
+
+func (q *pushQueue) push(batch []byte) error {
+	if q.dir == "" {
+		q.batches = append(q.batches, batch)
+	} else {
+		name := fmt.Sprintf("%020d%s", q.seq, pushBatchExt)
+		q.seq++
+
+		// Write to a temporary file first so a crash never leaves a
+		// partial batch
+		tmp, err := ioutil.TempFile(q.dir, "tmp")
+		if err != nil {
+			return err
+		}
+		if _, err := tmp.Write(batch); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+		if err := tmp.Close(); err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+		if err := os.Rename(tmp.Name(), filepath.Join(q.dir, name)); err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+
+		q.files = append(q.files, name)
+	}
+
+	for q.max > 0 && q.len() > q.max {
+		if err := q.pop(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// peek returns the oldest batch.
+func (q *pushQueue) peek() ([]byte, error) {
+	if q.dir == "" {
+		return q.batches[0], nil
+	}
+	return ioutil.ReadFile(filepath.Join(q.dir, q.files[0]))
+}
+
+// pop removes the oldest batch.
+func (q *pushQueue) pop() error {
+	if q.dir == "" {
+		q.batches = q.batches[1:]
+		return nil
+	}
+
+	if err := os.Remove(filepath.Join(q.dir, q.files[0])); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	q.files = q.files[1:]
+
+	return nil
+}
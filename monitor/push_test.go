@@ -0,0 +1,349 @@
+package monitor
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// pushServer is a stand-in of the push remotes. It answers with the
+// statuses in order, the last one is repeated.
+type pushServer struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newPushServer(t *testing.T, statuses ...int) *pushServer {
+	s := &pushServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		s.lock.Lock()
+		s.requests = append(s.requests, r)
+		s.bodies = append(s.bodies, body)
+		status := http.StatusNoContent
+		if len(s.statuses) != 0 {
+			status = s.statuses[0]
+			if len(s.statuses) > 1 {
+				s.statuses = s.statuses[1:]
+			}
+		}
+		s.lock.Unlock()
+
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *pushServer) calls() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.bodies)
+}
+
+func newPushRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+
+	blockNumber := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "eth_block_number", Help: "Block number"}, []string{"node", "chain"})
+	blockNumber.WithLabelValues("parity 1", "foundation").Set(42)
+
+	errors := prometheus.NewCounter(prometheus.CounterOpts{Name: "eth_rpc_errors_total", Help: "Rpc errors"})
+	errors.Add(3)
+
+	duration := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "eth_rpc_duration_seconds", Help: "Rpc duration", Buckets: []float64{0.1, 1}})
+	duration.Observe(0.05)
+	duration.Observe(0.5)
+
+	registry.MustRegister(blockNumber, errors, duration)
+	return registry
+}
+
+// testPushConfig is the config of a pusher to the url retried without
+// delay.
+func testPushConfig(url string) *PushConfig {
+	config := DefaultPushConfig()
+	config.URL = url
+	config.RetryBackoff = "1ms"
+	return config
+}
+
+func TestInfluxPush(t *testing.T) {
+	server := newPushServer(t)
+	config := testPushConfig(server.URL)
+	config.Username, config.Password = "user", "pass"
+	p, err := NewPusher(testLogger, "test", config, &influxEncoder{}, newPushRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.gather(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if server.calls() != 1 {
+		t.Fatalf("expected 1 request, got %d", server.calls())
+	}
+
+	req := server.requests[0]
+	if ct := req.Header.Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("unexpected content type %s", ct)
+	}
+	if user, pass, ok := req.BasicAuth(); !ok || user != "user" || pass != "pass" {
+		t.Errorf("expected basic auth user:pass, got %s:%s", user, pass)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(server.bodies[0])), "\n")
+	withoutTimestamp := []string{}
+	for _, line := range lines {
+		withoutTimestamp = append(withoutTimestamp, line[:strings.LastIndex(line, " ")])
+	}
+	sort.Strings(withoutTimestamp)
+
+	expected := []string{
+		`eth_block_number,chain=foundation,node=parity\ 1 value=42`,
+		`eth_rpc_duration_seconds count=2,sum=0.55,0.1=1,1=2`,
+		`eth_rpc_errors_total value=3`,
+	}
+	if strings.Join(withoutTimestamp, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected lines\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(withoutTimestamp, "\n"))
+	}
+}
+
+func TestInfluxBatches(t *testing.T) {
+	server := newPushServer(t)
+	config := testPushConfig(server.URL)
+	config.BatchSize = 2
+	p, err := NewPusher(testLogger, "test", config, &influxEncoder{}, newPushRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.gather(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if server.calls() != 2 {
+		t.Fatalf("expected 3 lines in 2 batches, got %d requests", server.calls())
+	}
+}
+
+func TestRemoteWritePush(t *testing.T) {
+	server := newPushServer(t)
+	p, err := NewPusher(testLogger, "test", testPushConfig(server.URL), &remoteWriteEncoder{}, newPushRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.gather(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if server.calls() != 1 {
+		t.Fatalf("expected 1 request, got %d", server.calls())
+	}
+
+	req := server.requests[0]
+	for header, value := range map[string]string{
+		"Content-Type":                      "application/x-protobuf",
+		"Content-Encoding":                  "snappy",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+	} {
+		if req.Header.Get(header) != value {
+			t.Errorf("expected header %s %s, got %s", header, value, req.Header.Get(header))
+		}
+	}
+
+	data, err := snappy.Decode(nil, server.bodies[0])
+	if err != nil {
+		t.Fatalf("body is not snappy: %v", err)
+	}
+	var write WriteRequest
+	if err := proto.Unmarshal(data, &write); err != nil {
+		t.Fatalf("body is not a write request: %v", err)
+	}
+
+	series := map[string]float64{}
+	for _, ts := range write.Timeseries {
+		labels := []string{}
+		for _, label := range ts.Labels {
+			labels = append(labels, label.Name+"="+label.Value)
+		}
+		if len(ts.Samples) != 1 {
+			t.Fatalf("expected 1 sample for %v, got %d", labels, len(ts.Samples))
+		}
+		series[strings.Join(labels, ",")] = ts.Samples[0].Value
+	}
+
+	expected := map[string]float64{
+		"__name__=eth_block_number,chain=foundation,node=parity 1": 42,
+		"__name__=eth_rpc_errors_total":                            3,
+		"__name__=eth_rpc_duration_seconds_bucket,le=0.1":          1,
+		"__name__=eth_rpc_duration_seconds_bucket,le=1":            2,
+		"__name__=eth_rpc_duration_seconds_bucket,le=+Inf":         2,
+		"__name__=eth_rpc_duration_seconds_count":                  2,
+		"__name__=eth_rpc_duration_seconds_sum":                    0.55,
+	}
+	if len(series) != len(expected) {
+		t.Errorf("expected %d series, got %v", len(expected), series)
+	}
+	for name, value := range expected {
+		if got, ok := series[name]; !ok || got != value {
+			t.Errorf("expected %s %v, got %v (found %v)", name, value, got, ok)
+		}
+	}
+}
+
+func TestPushRetries(t *testing.T) {
+	cases := []struct {
+		name     string
+		statuses []int
+		retries  int
+		calls    int
+		failed   bool
+		buffered int
+	}{
+		{"retried until accepted", []int{500, 429, 204}, 3, 3, false, 0},
+		{"rejected batches are dropped", []int{400}, 3, 1, false, 0},
+		{"kept after the retries", []int{503}, 2, 3, true, 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server := newPushServer(t, c.statuses...)
+			config := testPushConfig(server.URL)
+			config.Retries = c.retries
+			p, err := NewPusher(testLogger, "test", config, &influxEncoder{}, newPushRegistry())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := p.gather(); err != nil {
+				t.Fatal(err)
+			}
+			err = p.flush(context.Background())
+
+			if (err != nil) != c.failed {
+				t.Errorf("expected failed %v, got error %v", c.failed, err)
+			}
+			if server.calls() != c.calls {
+				t.Errorf("expected %d requests, got %d", c.calls, server.calls())
+			}
+			if p.queue.len() != c.buffered {
+				t.Errorf("expected %d batches buffered, got %d", c.buffered, p.queue.len())
+			}
+		})
+	}
+}
+
+func TestPushQueueDrainsAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	down := newPushServer(t, http.StatusServiceUnavailable)
+	config := testPushConfig(down.URL)
+	config.BufferDir = dir
+	config.BatchSize = 1
+	config.Retries = 0
+	p, err := NewPusher(testLogger, "test", config, &influxEncoder{}, newPushRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two gathers of 3 lines each, none sent
+	for i := 0; i < 2; i++ {
+		if err := p.gather(); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.flush(context.Background()); err == nil {
+			t.Fatal("expected the push to fail")
+		}
+	}
+	if p.queue.len() != 6 {
+		t.Fatalf("expected 6 batches buffered, got %d", p.queue.len())
+	}
+	pending := [][]byte{}
+	for _, name := range p.queue.files {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pending = append(pending, data)
+	}
+
+	// A new pusher on the same directory sends the batches in order
+	up := newPushServer(t)
+	config = testPushConfig(up.URL)
+	config.BufferDir = dir
+	p, err = NewPusher(testLogger, "test", config, &influxEncoder{}, newPushRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.queue.len() != 6 {
+		t.Fatalf("expected the 6 batches reloaded, got %d", p.queue.len())
+	}
+	if err := p.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if up.calls() != 6 {
+		t.Fatalf("expected 6 requests, got %d", up.calls())
+	}
+	for i, body := range up.bodies {
+		if string(body) != string(pending[i]) {
+			t.Errorf("batch %d sent out of order: %s", i, body)
+		}
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 0 {
+		t.Errorf("expected the buffer dir empty, found %d files", len(infos))
+	}
+}
+
+func TestPushQueueMaxBuffered(t *testing.T) {
+	q, err := newPushQueue(t.TempDir(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, batch := range []string{"a", "b", "c"} {
+		if err := q.push([]byte(batch)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if q.len() != 2 {
+		t.Fatalf("expected 2 batches, got %d", q.len())
+	}
+	if batch, err := q.peek(); err != nil || string(batch) != "b" {
+		t.Errorf("expected the oldest batch dropped, got %s %v", batch, err)
+	}
+}
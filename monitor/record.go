@@ -0,0 +1,326 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Exchange is a request to the node and its response, a line of a fixture
+// file.
+type Exchange struct {
+	Time time.Time `json:"time"`
+
+	// Endpoint without credentials
+	Endpoint string `json:"endpoint"`
+
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+
+	// Body of the response, kept as is so invalid responses are replayed
+	// too
+	Response string `json:"response,omitempty"`
+
+	// Error of the transport, if any
+	Error *ExchangeError `json:"error,omitempty"`
+
+	Duration Duration `json:"duration"`
+}
+
+// ExchangeError is a transport error recorded with enough detail to return
+// an error of the same class on replay.
+type ExchangeError struct {
+	// Error class (timeout, connection, http_status, decode or other)
+	Class   string `json:"class"`
+	Message string `json:"message"`
+
+	// Status code and body of http_status errors
+	StatusCode int    `json:"status_code,omitempty"`
+	Body       string `json:"body,omitempty"`
+}
+
+func newExchangeError(err error) *ExchangeError {
+	e := &ExchangeError{Class: errorClass(err), Message: err.Error()}
+	switch err := err.(type) {
+	case *StatusError:
+		e.StatusCode, e.Body = err.StatusCode, err.Body
+	case *DecodeError:
+		// The message is wrapped again on replay
+		e.Message = err.Err.Error()
+	}
+	return e
+}
+
+// err returns an error of the recorded class.
+func (e *ExchangeError) err() error {
+	switch e.Class {
+	case errorClassTimeout:
+		return &replayedNetError{e.Message, true}
+	case errorClassConnection:
+		return &replayedNetError{e.Message, false}
+	case errorClassHTTPStatus:
+		return &StatusError{e.StatusCode, e.Body}
+	case errorClassDecode:
+		return &DecodeError{fmt.Errorf("%s", e.Message)}
+	}
+	return fmt.Errorf("%s", e.Message)
+}
+
+// replayedNetError is a recorded timeout or connection error. It is a
+// net.Error so the client fails over and retries like with the original.
+type replayedNetError struct {
+	msg     string
+	timeout bool
+}
+
+func (e *replayedNetError) Error() string   { return e.msg }
+func (e *replayedNetError) Timeout() bool   { return e.timeout }
+func (e *replayedNetError) Temporary() bool { return true }
+
+// parseRequest returns the method and params of a json-rpc request.
+func parseRequest(reqData []byte) (string, json.RawMessage, error) {
+	var req struct {
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+	}
+	if err := json.Unmarshal(reqData, &req); err != nil {
+		return "", nil, err
+	}
+
+	// Compact the params so the same request always matches
+	var params bytes.Buffer
+	if len(req.Params) != 0 {
+		if err := json.Compact(&params, req.Params); err != nil {
+			return "", nil, err
+		}
+	}
+
+	return req.Method, params.Bytes(), nil
+}
+
+// Recorder is a transport that writes every request and response of the
+// transport it wraps as a line of a fixture file.
+type Recorder struct {
+	next RPCTransport
+
+	out  io.Writer
+	lock sync.Mutex
+}
+
+// NewRecorder records the calls to next in out.
+func NewRecorder(out io.Writer, next RPCTransport) *Recorder {
+	return &Recorder{next: next, out: out}
+}
+
+// Fixture files open for recording, shared by the clients recording to the
+// same file. They are kept open until the exporter exits.
+var (
+	recordFiles     = map[string]*os.File{}
+	recordFilesLock sync.Mutex
+)
+
+// openRecorder records the calls to next in the fixture file, appending to
+// it.
+func openRecorder(path string, next RPCTransport) (*Recorder, error) {
+	recordFilesLock.Lock()
+	defer recordFilesLock.Unlock()
+
+	file, ok := recordFiles[path]
+	if !ok {
+		var err error
+		if file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+			return nil, fmt.Errorf("failed to open the record file %s: %v", path, err)
+		}
+		recordFiles[path] = file
+	}
+
+	return &Recorder{next: next, out: &lockedWriter{w: file, lock: &recordFilesLock}}, nil
+}
+
+// lockedWriter serializes the writes of the recorders sharing a file.
+type lockedWriter struct {
+	w    io.Writer
+	lock *sync.Mutex
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.w.Write(p)
+}
+
+func (r *Recorder) Call(ctx context.Context, endpoint string, reqData []byte) ([]byte, error) {
+	start := time.Now()
+	data, err := r.next.Call(ctx, endpoint, reqData)
+
+	exchange := &Exchange{
+		Time:     start,
+		Endpoint: newRPCEndpoint(endpoint).label,
+		Response: string(data),
+		Duration: Duration(time.Since(start)),
+	}
+	if err != nil {
+		exchange.Error = newExchangeError(err)
+	}
+
+	method, params, parseErr := parseRequest(reqData)
+	if parseErr != nil {
+		// Not a request of the client, keep the response anyway
+		method, params = "", reqData
+	}
+	exchange.Method, exchange.Params = method, params
+
+	line, marshalErr := json.Marshal(exchange)
+	if marshalErr == nil {
+		r.lock.Lock()
+		_, marshalErr = r.out.Write(append(line, '\n'))
+		r.lock.Unlock()
+	}
+	if marshalErr != nil && err == nil {
+		// A response that is not recorded makes the fixture useless
+		return nil, fmt.Errorf("failed to record the response: %v", marshalErr)
+	}
+
+	return data, err
+}
+
+// Replayer is a transport that answers the requests with the responses of
+// a fixture instead of calling the node. The responses of the same request
+// (endpoint, method and params) are replayed in the order they were
+// recorded, the last one is repeated once all have been replayed. Requests
+// not recorded for the endpoint use the responses of any other endpoint.
+type Replayer struct {
+	lock sync.Mutex
+
+	// Recorded exchanges by request key and the next one to replay
+	exchanges map[string][]*Exchange
+	next      map[string]int
+
+	endpoints []string
+}
+
+// NewReplayer creates a replayer with the exchanges, in the order they were
+// recorded.
+func NewReplayer(exchanges []*Exchange) *Replayer {
+	r := &Replayer{
+		exchanges: map[string][]*Exchange{},
+		next:      map[string]int{},
+	}
+
+	seen := map[string]bool{}
+	for _, exchange := range exchanges {
+		for _, key := range []string{replayKey(exchange.Endpoint, exchange.Method, exchange.Params), replayKey("", exchange.Method, exchange.Params)} {
+			r.exchanges[key] = append(r.exchanges[key], exchange)
+		}
+
+		if !seen[exchange.Endpoint] {
+			seen[exchange.Endpoint] = true
+			r.endpoints = append(r.endpoints, exchange.Endpoint)
+		}
+	}
+
+	return r
+}
+
+// ReadFixture reads the exchanges of a fixture file.
+func ReadFixture(in io.Reader) ([]*Exchange, error) {
+	exchanges := []*Exchange{}
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		exchange := &Exchange{}
+		if err := json.Unmarshal(scanner.Bytes(), exchange); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		// Compact the params like the requests replayed
+		var params bytes.Buffer
+		if len(exchange.Params) != 0 {
+			if err := json.Compact(&params, exchange.Params); err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+		}
+		exchange.Params = params.Bytes()
+
+		exchanges = append(exchanges, exchange)
+	}
+
+	return exchanges, scanner.Err()
+}
+
+// LoadReplayer creates a replayer with the exchanges of the fixture file.
+func LoadReplayer(path string) (*Replayer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the replay file %s: %v", path, err)
+	}
+	defer file.Close()
+
+	exchanges, err := ReadFixture(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid replay file %s: %v", path, err)
+	}
+
+	return NewReplayer(exchanges), nil
+}
+
+func replayKey(endpoint, method string, params json.RawMessage) string {
+	return endpoint + " " + method + " " + string(params)
+}
+
+// Endpoints returns the endpoints of the fixture, in the order they were
+// first called.
+func (r *Replayer) Endpoints() []string {
+	return r.endpoints
+}
+
+func (r *Replayer) Call(ctx context.Context, endpoint string, reqData []byte) ([]byte, error) {
+	method, params, err := parseRequest(reqData)
+	if err != nil {
+		return nil, err
+	}
+
+	exchange := r.replay(replayKey(newRPCEndpoint(endpoint).label, method, params))
+	if exchange == nil {
+		exchange = r.replay(replayKey("", method, params))
+	}
+	if exchange == nil {
+		return nil, fmt.Errorf("no recorded response for %s %s", method, params)
+	}
+
+	if exchange.Error != nil {
+		return nil, exchange.Error.err()
+	}
+
+	return []byte(exchange.Response), nil
+}
+
+func (r *Replayer) replay(key string) *Exchange {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	exchanges := r.exchanges[key]
+	if len(exchanges) == 0 {
+		return nil
+	}
+
+	i := r.next[key]
+	if i < len(exchanges)-1 {
+		r.next[key] = i + 1
+	}
+
+	return exchanges[i]
+}
@@ -0,0 +1,278 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Registrar announces the node in a service discovery backend.
+type Registrar interface {
+	// Register creates the registration of the service or updates it if
+	// it is missing or outdated. It is called periodically.
+	Register(service *Service) error
+
+	// UpdateHealth reports the health verdict of the node.
+	UpdateHealth(status, note string) error
+
+	// Deregister removes the service from the backend.
+	Deregister() error
+}
+
+// Service describes the node to the service discovery backends.
+type Service struct {
+	ID      string
+	Name    string
+	Tags    []string
+	Meta    map[string]string
+	Address string
+
+	// Port of the rpc endpoint
+	Port int
+
+	// Address (host:port) where the exporter api is reachable
+	HealthAddr string
+}
+
+// Used if the register interval is not valid
+const defaultRegisterInterval = 30 * time.Second
+
+// Time given to the deregistration on shutdown, even if the other steps
+// used the whole shutdown timeout
+const deregisterTimeout = 5 * time.Second
+
+// Service discovery backends
+const (
+	DiscoveryConsul = "consul"
+	DiscoveryFile   = "file"
+	DiscoveryEtcd   = "etcd"
+	DiscoveryNone   = "none"
+)
+
+func (m *Monitor) setupRegistrar(config *Config) (Registrar, error) {
+	switch config.Discovery {
+	case DiscoveryConsul:
+		return NewConsulRegistrar(m.logger, config.ConsulConfig)
+	case DiscoveryFile:
+		return NewFileRegistrar(m.logger, config.FileSDConfig)
+	case DiscoveryEtcd:
+		return NewEtcdRegistrar(m.logger, config.EtcdConfig)
+	case DiscoveryNone:
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("Discovery %s not found. '%s', '%s', '%s' and '%s' are the only valid options", config.Discovery, DiscoveryConsul, DiscoveryFile, DiscoveryEtcd, DiscoveryNone)
+}
+
+// currentRegistrar returns the registrar of the current config, nil if the
+// discovery is disabled.
+func (m *Monitor) currentRegistrar() Registrar {
+	m.configLock.RLock()
+	defer m.configLock.RUnlock()
+
+	return m.registrar
+}
+
+// runRegistrar registers the service and keeps verifying the registration
+// every register interval or whenever the node state changes. If the backend
+// lost the service (i.e. the consul agent restarted) or the registration is
+// outdated it is registered again. The registrar and the interval are
+// read on every iteration so reloads apply without restarting the loop.
+func (m *Monitor) runRegistrar(ctx context.Context) {
+	defer m.wg.Done()
+
+	for {
+		config := m.currentConfig()
+
+		interval, err := time.ParseDuration(config.ServiceConfig.RegisterInterval)
+		if err != nil || interval <= 0 {
+			// Validate rejects it, keep the loop for the next reload
+			m.logger.Printf("Invalid register interval '%s', using %s", config.ServiceConfig.RegisterInterval, defaultRegisterInterval)
+			interval = defaultRegisterInterval
+		}
+
+		if registrar := m.currentRegistrar(); registrar != nil {
+			service, err := m.service()
+			if err == nil {
+				err = registrar.Register(service)
+			}
+			if err != nil {
+				m.logger.Printf("Failed to register the service: %v", err)
+			}
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-m.registerCh:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// triggerRegister asks the registrar loop to sync the registration
+// without waiting for the next interval.
+func (m *Monitor) triggerRegister() {
+	select {
+	case m.registerCh <- struct{}{}:
+	default:
+	}
+}
+
+func (m *Monitor) deregister(ctx context.Context) error {
+	return deregister(ctx, m.currentRegistrar())
+}
+
+// deregister removes the service from the backend of the registrar, if any.
+func deregister(ctx context.Context, registrar Registrar) error {
+	if registrar == nil {
+		return nil
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- registrar.Deregister()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("timeout deregistering the service")
+	}
+}
+
+func (m *Monitor) reportHealth(status, note string) {
+	registrar := m.currentRegistrar()
+	if registrar == nil {
+		return
+	}
+
+	if err := registrar.UpdateHealth(status, note); err != nil {
+		m.logger.Printf("Failed to update the service health: %v", err)
+	}
+}
+
+func (m *Monitor) service() (*Service, error) {
+	c := m.currentConfig()
+	config := c.ServiceConfig
+
+	port := config.Port
+	if port == 0 {
+		var err error
+		if port, err = endpointPort(c.HTTPEndpoint()); err != nil {
+			return nil, err
+		}
+	}
+
+	checkAddr := config.CheckAddress
+	if checkAddr == "" {
+		checkAddr = config.Address
+	}
+	if checkAddr == "" {
+		checkAddr = c.BindAddr
+		if ip := net.ParseIP(checkAddr); ip != nil && ip.IsUnspecified() {
+			checkAddr = "127.0.0.1"
+		}
+	}
+
+	service := &Service{
+		ID:         c.NodeName,
+		Name:       config.Name,
+		Tags:       m.serviceTags(),
+		Meta:       m.serviceMeta(),
+		Address:    config.Address,
+		Port:       port,
+		HealthAddr: net.JoinHostPort(checkAddr, strconv.Itoa(c.BindPort)),
+	}
+
+	return service, nil
+}
+
+func (m *Monitor) serviceTags() []string {
+	config := m.currentConfig().ServiceConfig
+
+	tags := append([]string{}, config.Tags...)
+
+	if !config.DynamicTags {
+		return tags
+	}
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return append(tags, m.dynamicTags...)
+}
+
+// updateDynamicTags computes the tags for the current state of the node and
+// triggers a registration sync if they changed.
+func (m *Monitor) updateDynamicTags() {
+	if !m.currentConfig().ServiceConfig.DynamicTags {
+		return
+	}
+
+	m.lock.Lock()
+
+	tags := []string{}
+	if m.connected {
+		if m.synced {
+			tags = append(tags, "synced")
+		} else {
+			tags = append(tags, "syncing")
+		}
+
+		if m.chain != "" {
+			tags = append(tags, m.chain)
+		}
+		if client := clientName(m.clientVersion); client != "" {
+			tags = append(tags, client)
+		}
+		if m.archive {
+			tags = append(tags, "archive")
+		} else {
+			tags = append(tags, "full")
+		}
+	}
+
+	changed := !reflect.DeepEqual(tags, m.dynamicTags)
+	m.dynamicTags = tags
+
+	m.lock.Unlock()
+
+	if changed {
+		m.triggerRegister()
+	}
+}
+
+// clientName returns the lowercase client name of a web3_clientVersion
+// string (i.e. Parity//v1.8.2-beta/x86_64-linux-gnu/rustc1.21.0 is parity).
+func clientName(version string) string {
+	name := strings.SplitN(version, "/", 2)[0]
+	return strings.ToLower(name)
+}
+
+func (m *Monitor) serviceMeta() map[string]string {
+	config := m.currentConfig()
+
+	meta := map[string]string{}
+	for name, value := range config.ServiceConfig.Meta {
+		meta[name] = value
+	}
+	meta["node_name"] = config.NodeName
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if m.chain != "" {
+		meta["chain"] = m.chain
+	}
+	if m.clientVersion != "" {
+		meta["client_version"] = m.clientVersion
+	}
+
+	return meta
+}
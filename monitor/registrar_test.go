@@ -0,0 +1,50 @@
+package monitor
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestServicePort(t *testing.T) {
+	cases := []struct {
+		name      string
+		endpoints []string
+		port      int
+		expected  int
+		err       string
+	}{
+		{"http endpoint", []string{"http://127.0.0.1:8545"}, 0, 8545, ""},
+		{"ipc first", []string{"/var/run/parity/jsonrpc.ipc", "https://node.example.com"}, 0, 443, ""},
+		{"service port", []string{"/var/run/parity/jsonrpc.ipc", "http://127.0.0.1:8545"}, 30303, 30303, ""},
+		{"ipc only with a port", []string{"/var/run/parity/jsonrpc.ipc"}, 30303, 30303, ""},
+		{"ipc only", []string{"/var/run/parity/jsonrpc.ipc"}, 0, 0, "service.port: missing port"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.LogOutput = ioutil.Discard
+			config.Endpoints = c.endpoints
+			config.ServiceConfig.Port = c.port
+
+			if err := config.Validate(); c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("expected the error '%s', got %v", c.err, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			m, _ := newTestMonitor(t, config)
+			service, err := m.service()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if service.Port != c.expected {
+				t.Errorf("expected the port %d, got %d", c.expected, service.Port)
+			}
+		})
+	}
+}
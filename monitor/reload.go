@@ -0,0 +1,283 @@
+package monitor
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// collectorGroup is the set of goroutines running the collectors of a
+// config. It is replaced when a reload changes the collectors.
+type collectorGroup struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func (m *Monitor) startCollectors(ctx context.Context, collectors []*scheduledCollector) *collectorGroup {
+	groupCtx, cancel := context.WithCancel(ctx)
+
+	g := &collectorGroup{cancel: cancel}
+	for _, collector := range collectors {
+		m.wg.Add(1)
+		g.wg.Add(1)
+		go func(s *scheduledCollector) {
+			defer g.wg.Done()
+			m.runCollector(groupCtx, s)
+		}(collector)
+	}
+
+	return g
+}
+
+// stop stops the collectors and waits for the running collections.
+func (g *collectorGroup) stop() {
+	g.cancel()
+	g.wg.Wait()
+}
+
+// Reload applies a new config in place. Endpoints, thresholds, intervals,
+// collectors and service discovery changes take effect without dropping
+// the metrics. The bind address, labels and push outputs only change on
+// restart, their current values are kept. If the config is not valid the
+// current one is kept and the errors are returned. load reads the config
+// from its sources, its failures count as failed reloads too.
+func (m *Monitor) Reload(load func() (*Config, error)) error {
+	m.reloadLock.Lock()
+	defer m.reloadLock.Unlock()
+
+	config, err := load()
+	if err == nil {
+		err = m.reload(config)
+	}
+	if err != nil {
+		m.metrics.setBool(m.metrics.configReloadSuccess, []string{"config", "reload_success"}, false)
+		return err
+	}
+
+	m.metrics.setBool(m.metrics.configReloadSuccess, []string{"config", "reload_success"}, true)
+	m.metrics.setGauge(m.metrics.configReloadTime, []string{"config", "last_reload_success_timestamp"}, float64(time.Now().Unix()))
+
+	return nil
+}
+
+func (m *Monitor) reload(config *Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	old := m.currentConfig()
+
+	// The new config is copied so the values kept do not modify the
+	// caller's config
+	c := *config
+	c.LogOutput = old.LogOutput
+
+	restart := func(key string, changed bool, keep func()) {
+		if changed {
+			m.logger.Printf("Config %s changed. Restart the exporter to apply it", key)
+			keep()
+		}
+	}
+	restart("bind", c.BindAddr != old.BindAddr, func() { c.BindAddr = old.BindAddr })
+	restart("port", c.BindPort != old.BindPort, func() { c.BindPort = old.BindPort })
+	restart("labels", !reflect.DeepEqual(c.MetricLabels(), old.MetricLabels()), func() { c.Labels = old.Labels })
+	restart("go_metrics", !reflect.DeepEqual(c.GoMetricsConfig, old.GoMetricsConfig), func() { c.GoMetricsConfig = old.GoMetricsConfig })
+	restart("influxdb", !reflect.DeepEqual(c.InfluxDBConfig, old.InfluxDBConfig), func() { c.InfluxDBConfig = old.InfluxDBConfig })
+	restart("remote_write", !reflect.DeepEqual(c.RemoteWriteConfig, old.RemoteWriteConfig), func() { c.RemoteWriteConfig = old.RemoteWriteConfig })
+	restart("otlp", !reflect.DeepEqual(c.OTLPConfig, old.OTLPConfig), func() { c.OTLPConfig = old.OTLPConfig })
+	restart("history", !reflect.DeepEqual(c.HistoryConfig, old.HistoryConfig), func() { c.HistoryConfig = old.HistoryConfig })
+
+	changes := configChanges(old, &c)
+	if len(changes) == 0 {
+		m.logger.Printf("Config reloaded without changes")
+		return nil
+	}
+
+	// Create the new components before replacing anything so a failure
+	// keeps the current config
+	var err error
+
+	endpointsChanged := !reflect.DeepEqual(c.RPCEndpoints(), old.RPCEndpoints()) || !reflect.DeepEqual(c.RPCConfig, old.RPCConfig)
+
+	var ethClient *EthClient
+	if endpointsChanged {
+		ethClient, err = NewEthClient(m.logger, c.RPCEndpoints(), c.RPCConfig, m.metrics, m.tracer)
+		if err != nil {
+			return err
+		}
+	}
+
+	cycleTimeout, err := time.ParseDuration(c.RPCConfig.CycleTimeout)
+	if err != nil {
+		return err
+	}
+
+	var collectors []*scheduledCollector
+	collectorsChanged := !reflect.DeepEqual(c.Collectors, old.Collectors) || c.RPCInterval != old.RPCInterval || c.RPCConfig.CycleTimeout != old.RPCConfig.CycleTimeout
+	if collectorsChanged {
+		collectors, err = m.setupCollectors(&c, cycleTimeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	var registrar Registrar
+	registrarChanged := c.Discovery != old.Discovery || c.NodeName != old.NodeName ||
+		!reflect.DeepEqual(c.ServiceConfig, old.ServiceConfig) ||
+		!reflect.DeepEqual(c.ConsulConfig, old.ConsulConfig) ||
+		!reflect.DeepEqual(c.FileSDConfig, old.FileSDConfig) ||
+		!reflect.DeepEqual(c.EtcdConfig, old.EtcdConfig)
+	if registrarChanged {
+		registrar, err = m.setupRegistrar(&c)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The collectors are stopped before the swap so none of them runs with
+	// the old config afterwards
+	m.configLock.RLock()
+	group := m.collectorGroup
+	m.configLock.RUnlock()
+
+	if collectorsChanged && group != nil {
+		group.stop()
+	}
+
+	m.configLock.Lock()
+
+	m.config = &c
+	m.cycleTimeout = cycleTimeout
+
+	oldClient := m.ethClient
+	if endpointsChanged {
+		m.metrics.resetEndpoints()
+
+		ethClient.lock.Lock()
+		ethClient.setActive(ethClient.active)
+		ethClient.lock.Unlock()
+
+		m.ethClient = ethClient
+	}
+
+	oldRegistrar := m.registrar
+	if registrarChanged {
+		// A registrar of the same service takes its registration
+		if consul, ok := registrar.(*ConsulRegistrar); ok && !serviceMoved(old, &c) {
+			if oldConsul, ok := oldRegistrar.(*ConsulRegistrar); ok {
+				consul.inherit(oldConsul)
+			}
+		}
+		m.registrar = registrar
+	}
+
+	if collectorsChanged {
+		m.collectors = collectors
+		if m.runCtx != nil {
+			m.collectorGroup = m.startCollectors(m.runCtx, collectors)
+		}
+	}
+
+	m.configLock.Unlock()
+
+	if endpointsChanged {
+		oldClient.Close()
+	}
+
+	// Detect the chain of the new endpoints and the reference again
+	if endpointsChanged || c.ReferenceURL != old.ReferenceURL || !reflect.DeepEqual(c.EtherscanConfig, old.EtherscanConfig) {
+		m.setConnected(false)
+	}
+
+	if registrarChanged {
+		if serviceMoved(old, &c) {
+			ctx, cancel := context.WithTimeout(context.Background(), c.ShutdownTimeout.Duration())
+			if err := deregister(ctx, oldRegistrar); err != nil {
+				m.logger.Printf("Failed to deregister the previous service: %v", err)
+			}
+			cancel()
+		}
+
+		m.triggerRegister()
+	}
+
+	m.logger.Printf("Config reloaded. Changed: %s", strings.Join(changes, ", "))
+
+	return nil
+}
+
+// configChanges returns the top level keys that differ between the configs.
+func configChanges(c1, c2 *Config) []string {
+	changes := []string{}
+
+	v1 := reflect.ValueOf(c1).Elem()
+	v2 := reflect.ValueOf(c2).Elem()
+
+	t := v1.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		if !reflect.DeepEqual(v1.Field(i).Interface(), v2.Field(i).Interface()) {
+			changes = append(changes, name)
+		}
+	}
+
+	return changes
+}
+
+// serviceMoved returns true if the service registered with the new config
+// is not the one registered with the old config, so the old one has to be
+// removed. Otherwise registering again updates it in place.
+func serviceMoved(old, config *Config) bool {
+	if old.Discovery != config.Discovery || old.NodeName != config.NodeName {
+		return true
+	}
+
+	switch config.Discovery {
+	case DiscoveryConsul:
+		return old.ConsulConfig.Address != config.ConsulConfig.Address
+	case DiscoveryFile:
+		return old.FileSDConfig.Path != config.FileSDConfig.Path
+	case DiscoveryEtcd:
+		return old.EtcdConfig.Address != config.EtcdConfig.Address || old.EtcdConfig.Prefix != config.EtcdConfig.Prefix
+	}
+
+	return false
+}
+
+// WatchFile calls onChange every time the modification time or the size of
+// the file changes, checking every interval until ctx is done.
+func WatchFile(ctx context.Context, path string, interval time.Duration, onChange func()) {
+	var modTime time.Time
+	var size int64
+
+	if info, err := os.Stat(path); err == nil {
+		modTime, size = info.ModTime(), info.Size()
+	}
+
+	for {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			// Editors may replace the file, wait for the new one
+			continue
+		}
+
+		if info.ModTime().Equal(modTime) && info.Size() == size {
+			continue
+		}
+		modTime, size = info.ModTime(), info.Size()
+
+		onChange()
+	}
+}
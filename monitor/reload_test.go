@@ -0,0 +1,67 @@
+package monitor
+
+import (
+	"testing"
+	"time"
+)
+
+func collectorIntervals(m *Monitor) map[string]time.Duration {
+	m.configLock.RLock()
+	defer m.configLock.RUnlock()
+
+	intervals := map[string]time.Duration{}
+	for _, s := range m.collectors {
+		intervals[s.collector.Name()] = s.interval
+	}
+	return intervals
+}
+
+func TestReloadRPCInterval(t *testing.T) {
+	node, etherscan := startTestNode(t)
+	m, _ := newTestMonitor(t, testConfig(node, etherscan))
+
+	config := *m.currentConfig()
+	config.RPCInterval = Duration(time.Minute)
+	config.Collectors = map[string]*CollectorConfig{"peers": {Interval: "2m"}}
+
+	if err := m.Reload(func() (*Config, error) { return &config, nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]time.Duration{"block": time.Minute, "peers": 2 * time.Minute, "syncing": time.Minute}
+	intervals := collectorIntervals(m)
+	for name, interval := range expected {
+		if intervals[name] != interval {
+			t.Errorf("expected the %s collector every %s, got %s", name, interval, intervals[name])
+		}
+	}
+
+	if got := gatherValue(t, m, "ethereum_config_reload_success", nil); got != 1 {
+		t.Errorf("expected the reload successful, got %v", got)
+	}
+}
+
+func TestReloadInvalidConfig(t *testing.T) {
+	node, etherscan := startTestNode(t)
+	m, _ := newTestMonitor(t, testConfig(node, etherscan))
+
+	config := *m.currentConfig()
+	config.RPCInterval = Duration(time.Minute)
+	config.SyncThreshold = -1
+
+	if err := m.Reload(func() (*Config, error) { return &config, nil }); err == nil {
+		t.Fatal("expected the invalid config rejected")
+	}
+
+	if m.currentConfig().RPCInterval != DefaultConfig().RPCInterval {
+		t.Errorf("expected the current config kept, got rpc_interval %s", m.currentConfig().RPCInterval.Duration())
+	}
+	for name, interval := range collectorIntervals(m) {
+		if interval != DefaultConfig().RPCInterval.Duration() {
+			t.Errorf("expected the %s collector kept, got %s", name, interval)
+		}
+	}
+	if got := gatherValue(t, m, "ethereum_config_reload_success", nil); got != 0 {
+		t.Errorf("expected the reload failed, got %v", got)
+	}
+}
@@ -0,0 +1,151 @@
+package monitor
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Messages of the prometheus remote write protocol (prompb/remote.proto and
+// prompb/types.proto).
+
+type WriteRequest struct {
+	Timeseries []*TimeSeries `protobuf:"bytes,1,rep,name=timeseries" json:"timeseries,omitempty"`
+}
+
+func (m *WriteRequest) Reset()         { *m = WriteRequest{} }
+func (m *WriteRequest) String() string { return proto.CompactTextString(m) }
+func (*WriteRequest) ProtoMessage()    {}
+
+type TimeSeries struct {
+	Labels  []*LabelPair `protobuf:"bytes,1,rep,name=labels" json:"labels,omitempty"`
+	Samples []*Sample    `protobuf:"bytes,2,rep,name=samples" json:"samples,omitempty"`
+}
+
+func (m *TimeSeries) Reset()         { *m = TimeSeries{} }
+func (m *TimeSeries) String() string { return proto.CompactTextString(m) }
+func (*TimeSeries) ProtoMessage()    {}
+
+type LabelPair struct {
+	Name  string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Value string `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+}
+
+func (m *LabelPair) Reset()         { *m = LabelPair{} }
+func (m *LabelPair) String() string { return proto.CompactTextString(m) }
+func (*LabelPair) ProtoMessage()    {}
+
+type Sample struct {
+	Value float64 `protobuf:"fixed64,1,opt,name=value,proto3" json:"value,omitempty"`
+
+	// Milliseconds since epoch
+	Timestamp int64 `protobuf:"varint,2,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+}
+
+func (m *Sample) Reset()         { *m = Sample{} }
+func (m *Sample) String() string { return proto.CompactTextString(m) }
+func (*Sample) ProtoMessage()    {}
+
+// remoteWriteEncoder encodes the metrics as snappy compressed remote write
+// requests. Histograms and summaries are expanded into their _bucket,
+// _count and _sum series like in the text exposition.
+type remoteWriteEncoder struct{}
+
+func (e *remoteWriteEncoder) SetHeaders(header http.Header) {
+	header.Set("Content-Type", "application/x-protobuf")
+	header.Set("Content-Encoding", "snappy")
+	header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+}
+
+func (e *remoteWriteEncoder) Encode(families []*dto.MetricFamily, now time.Time, batchSize int) ([][]byte, error) {
+	batches := [][]byte{}
+	req := &WriteRequest{}
+
+	flush := func() error {
+		data, err := proto.Marshal(req)
+		if err != nil {
+			return err
+		}
+		batches = append(batches, snappy.Encode(nil, data))
+		req = &WriteRequest{}
+		return nil
+	}
+
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			timestamp := now.UnixNano() / int64(time.Millisecond)
+			if metric.TimestampMs != nil {
+				timestamp = metric.GetTimestampMs()
+			}
+
+			add := func(name string, value float64, extraName, extraValue string) {
+				labels := []*LabelPair{{Name: "__name__", Value: name}}
+				for _, label := range metric.GetLabel() {
+					labels = append(labels, &LabelPair{Name: label.GetName(), Value: label.GetValue()})
+				}
+				if extraName != "" {
+					labels = append(labels, &LabelPair{Name: extraName, Value: extraValue})
+				}
+				sort.Slice(labels, func(i, j int) bool {
+					return labels[i].Name < labels[j].Name
+				})
+
+				req.Timeseries = append(req.Timeseries, &TimeSeries{
+					Labels:  labels,
+					Samples: []*Sample{{Value: value, Timestamp: timestamp}},
+				})
+			}
+
+			name := family.GetName()
+
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, metric.GetCounter().GetValue(), "", "")
+			case dto.MetricType_GAUGE:
+				add(name, metric.GetGauge().GetValue(), "", "")
+			case dto.MetricType_UNTYPED:
+				add(name, metric.GetUntyped().GetValue(), "", "")
+			case dto.MetricType_HISTOGRAM:
+				h := metric.GetHistogram()
+				infSeen := false
+				for _, b := range h.GetBucket() {
+					if math.IsInf(b.GetUpperBound(), +1) {
+						infSeen = true
+					}
+					add(name+"_bucket", float64(b.GetCumulativeCount()), "le", formatFloat(b.GetUpperBound()))
+				}
+				if !infSeen {
+					add(name+"_bucket", float64(h.GetSampleCount()), "le", "+Inf")
+				}
+				add(name+"_count", float64(h.GetSampleCount()), "", "")
+				add(name+"_sum", h.GetSampleSum(), "", "")
+			case dto.MetricType_SUMMARY:
+				s := metric.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add(name, q.GetValue(), "quantile", formatFloat(q.GetQuantile()))
+				}
+				add(name+"_count", float64(s.GetSampleCount()), "", "")
+				add(name+"_sum", s.GetSampleSum(), "", "")
+			}
+
+			if len(req.Timeseries) >= batchSize {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	if len(req.Timeseries) != 0 {
+		if err := flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	return batches, nil
+}
@@ -0,0 +1,51 @@
+package monitor
+
+import (
+	"encoding/json"
+	"net"
+	"net/url"
+)
+
+// Error classes of the rpc calls
+const (
+	errorClassTimeout    = "timeout"
+	errorClassConnection = "connection"
+	errorClassHTTPStatus = "http_status"
+	errorClassRPC        = "rpc"
+	errorClassDecode     = "decode"
+	errorClassOther      = "other"
+)
+
+func errorClass(err error) string {
+	if isTimeout(err) {
+		return errorClassTimeout
+	}
+
+	switch err.(type) {
+	case *RPCError:
+		return errorClassRPC
+	case *StatusError:
+		return errorClassHTTPStatus
+	case *DecodeError, *json.SyntaxError, *json.UnmarshalTypeError:
+		return errorClassDecode
+	case net.Error:
+		return errorClassConnection
+	}
+
+	return errorClassOther
+}
+
+// endpointLabel removes the credentials and the query of the endpoint url
+// so it can be used as a label.
+func endpointLabel(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return endpoint
+	}
+
+	u.User = nil
+	u.RawQuery = ""
+	u.Fragment = ""
+
+	return u.String()
+}
@@ -0,0 +1,248 @@
+package monitor
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+)
+
+// Max size of the packets. Datagrams on unix sockets can be larger than
+// the udp ones, which must fit in the MTU.
+const (
+	statsdMaxUDPPacket  = 1432
+	statsdMaxUnixPacket = 8192
+)
+
+// StatsdSink is a go-metrics sink that pushes the metrics to a statsd or
+// dogstatsd server over udp or a unix datagram socket. In dogstatsd mode
+// the labels are sent as tags instead of being appended to the key.
+type StatsdSink struct {
+	logger *log.Logger
+
+	network string
+	addr    string
+
+	// Send the labels as dogstatsd tags instead of appending them to the key
+	dogstatsd  bool
+	tagMapping map[string]string
+
+	maxPacket     int
+	flushInterval time.Duration
+
+	queue chan string
+
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+	stopOnce sync.Once
+}
+
+func NewStatsdSink(logger *log.Logger, config *StatsdConfig, dogstatsd bool) (*StatsdSink, error) {
+	network, addr, err := parseStatsdAddress(config.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	flushInterval, err := time.ParseDuration(config.FlushInterval)
+	if err != nil {
+		return nil, fmt.Errorf("invalid statsd flush interval '%s': %v", config.FlushInterval, err)
+	}
+
+	s := &StatsdSink{
+		logger:        logger,
+		network:       network,
+		addr:          addr,
+		dogstatsd:     dogstatsd,
+		tagMapping:    config.TagMapping,
+		maxPacket:     statsdMaxUDPPacket,
+		flushInterval: flushInterval,
+		queue:         make(chan string, 4096),
+		stopCh:        make(chan struct{}),
+		doneCh:        make(chan struct{}),
+	}
+
+	if network == "unixgram" {
+		s.maxPacket = statsdMaxUnixPacket
+	}
+
+	go s.run()
+
+	return s, nil
+}
+
+func parseStatsdAddress(addr string) (string, string, error) {
+	if !strings.Contains(addr, "://") {
+		return "udp", addr, nil
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid statsd address '%s': %v", addr, err)
+	}
+
+	switch u.Scheme {
+	case "udp":
+		return "udp", u.Host, nil
+	case "unixgram", "unix":
+		return "unixgram", u.Path, nil
+	}
+
+	return "", "", fmt.Errorf("Statsd scheme %s not found. 'udp' and 'unixgram' are the only valid options", u.Scheme)
+}
+
+func (s *StatsdSink) SetGauge(key []string, val float32) {
+	s.push(key, val, "g", nil)
+}
+
+func (s *StatsdSink) SetGaugeWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.push(key, val, "g", labels)
+}
+
+func (s *StatsdSink) EmitKey(key []string, val float32) {
+	// dogstatsd does not support key/value metrics
+	if s.dogstatsd {
+		s.push(key, val, "g", nil)
+	} else {
+		s.push(key, val, "kv", nil)
+	}
+}
+
+func (s *StatsdSink) IncrCounter(key []string, val float32) {
+	s.push(key, val, "c", nil)
+}
+
+func (s *StatsdSink) IncrCounterWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.push(key, val, "c", labels)
+}
+
+func (s *StatsdSink) AddSample(key []string, val float32) {
+	s.push(key, val, "ms", nil)
+}
+
+func (s *StatsdSink) AddSampleWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.push(key, val, "ms", labels)
+}
+
+// Shutdown flushes the buffered metrics and stops the sink.
+func (s *StatsdSink) Shutdown() {
+	s.stopOnce.Do(func() {
+		close(s.stopCh)
+	})
+	<-s.doneCh
+}
+
+// push formats the metric and queues it without blocking. Metrics are
+// dropped if the queue is full.
+func (s *StatsdSink) push(key []string, val float32, typ string, labels []metrics.Label) {
+	select {
+	case s.queue <- s.format(key, val, typ, labels):
+	default:
+	}
+}
+
+func (s *StatsdSink) format(key []string, val float32, typ string, labels []metrics.Label) string {
+	parts := append([]string{}, key...)
+	tags := []string{}
+
+	for _, label := range labels {
+		if s.dogstatsd {
+			tags = append(tags, s.tagName(label.Name)+":"+sanitizeStatsd(label.Value, ",|#"))
+		} else {
+			parts = append(parts, label.Value)
+		}
+	}
+
+	line := sanitizeStatsd(strings.Join(parts, "."), ":|@ ") + ":" + strconv.FormatFloat(float64(val), 'f', -1, 32) + "|" + typ
+	if len(tags) != 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+
+	return line + "\n"
+}
+
+func (s *StatsdSink) tagName(label string) string {
+	if tag, ok := s.tagMapping[label]; ok {
+		return tag
+	}
+	return label
+}
+
+// sanitizeStatsd replaces the characters reserved by the protocol.
+func sanitizeStatsd(str string, reserved string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(reserved, r) {
+			return '_'
+		}
+		return r
+	}, str)
+}
+
+// run buffers the queued metrics in packets of at most maxPacket bytes and
+// sends them when full or every flush interval.
+func (s *StatsdSink) run() {
+	defer close(s.doneCh)
+
+	var conn net.Conn
+	buf := bytes.NewBuffer(nil)
+
+	flush := func() {
+		if buf.Len() == 0 {
+			return
+		}
+		defer buf.Reset()
+
+		if conn == nil {
+			var err error
+			if conn, err = net.Dial(s.network, s.addr); err != nil {
+				s.logger.Printf("Failed to connect to statsd on %s: %v", s.addr, err)
+				return
+			}
+		}
+
+		if _, err := conn.Write(buf.Bytes()); err != nil {
+			s.logger.Printf("Failed to send metrics to statsd on %s: %v", s.addr, err)
+
+			// Dial again on the next flush (i.e. the socket was recreated)
+			conn.Close()
+			conn = nil
+		}
+	}
+
+	add := func(metric string) {
+		if buf.Len()+len(metric) > s.maxPacket {
+			flush()
+		}
+		buf.WriteString(metric)
+	}
+
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case metric := <-s.queue:
+			add(metric)
+
+		case <-ticker.C:
+			flush()
+
+		case <-s.stopCh:
+			for len(s.queue) > 0 {
+				add(<-s.queue)
+			}
+			flush()
+
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+	}
+}
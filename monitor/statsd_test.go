@@ -0,0 +1,151 @@
+package monitor
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+)
+
+// listenStatsd starts a udp listener and returns its address and a function
+// that reads the lines of the packets received until n lines arrive.
+func listenStatsd(t *testing.T) (string, func(n int) ([]string, int)) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	read := func(n int) ([]string, int) {
+		lines := []string{}
+		packets := 0
+		buf := make([]byte, 65536)
+
+		for len(lines) < n {
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			size, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				t.Fatalf("read %d of %d lines: %v", len(lines), n, err)
+			}
+			packets++
+			lines = append(lines, strings.Split(strings.TrimSuffix(string(buf[:size]), "\n"), "\n")...)
+		}
+
+		return lines, packets
+	}
+
+	return conn.LocalAddr().String(), read
+}
+
+func newTestStatsdSink(t *testing.T, addr string, dogstatsd bool, tagMapping map[string]string) *StatsdSink {
+	config := DefaultStatsdConfig()
+	config.Address = addr
+	config.FlushInterval = "1h"
+	config.TagMapping = tagMapping
+
+	sink, err := NewStatsdSink(testLogger, config, dogstatsd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sink
+}
+
+func TestStatsdSink(t *testing.T) {
+	cases := []struct {
+		name       string
+		dogstatsd  bool
+		tagMapping map[string]string
+		expected   []string
+	}{
+		{
+			name: "statsd",
+			expected: []string{
+				"eth.block_number.parity.foundation:42|g",
+				"eth.rpc_errors.parity:1|c",
+				"eth.rpc_duration:1.5|ms",
+				"eth.version:1|kv",
+			},
+		},
+		{
+			name:      "dogstatsd",
+			dogstatsd: true,
+			expected: []string{
+				"eth.block_number:42|g|#node:parity,chain:foundation",
+				"eth.rpc_errors:1|c|#node:parity",
+				"eth.rpc_duration:1.5|ms",
+				"eth.version:1|g",
+			},
+		},
+		{
+			name:       "dogstatsd tag mapping",
+			dogstatsd:  true,
+			tagMapping: map[string]string{"node": "host"},
+			expected: []string{
+				"eth.block_number:42|g|#host:parity,chain:foundation",
+				"eth.rpc_errors:1|c|#host:parity",
+				"eth.rpc_duration:1.5|ms",
+				"eth.version:1|g",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			addr, read := listenStatsd(t)
+			sink := newTestStatsdSink(t, addr, c.dogstatsd, c.tagMapping)
+
+			sink.SetGaugeWithLabels([]string{"eth", "block_number"}, 42, []metrics.Label{{Name: "node", Value: "parity"}, {Name: "chain", Value: "foundation"}})
+			sink.IncrCounterWithLabels([]string{"eth", "rpc_errors"}, 1, []metrics.Label{{Name: "node", Value: "parity"}})
+			sink.AddSample([]string{"eth", "rpc_duration"}, 1.5)
+			sink.EmitKey([]string{"eth", "version"}, 1)
+			sink.Shutdown()
+
+			lines, packets := read(len(c.expected))
+			if packets != 1 {
+				t.Errorf("expected the lines batched in 1 packet, got %d", packets)
+			}
+
+			sort.Strings(lines)
+			expected := append([]string{}, c.expected...)
+			sort.Strings(expected)
+			if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+				t.Errorf("expected lines\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+			}
+		})
+	}
+}
+
+func TestStatsdSinkSplitsPackets(t *testing.T) {
+	addr, read := listenStatsd(t)
+	sink := newTestStatsdSink(t, addr, false, nil)
+
+	count := 200
+	for i := 0; i < count; i++ {
+		sink.SetGauge([]string{"eth", "some_long_metric_name_to_fill_the_packet"}, float32(i))
+	}
+	sink.Shutdown()
+
+	lines, packets := read(count)
+	if len(lines) != count {
+		t.Fatalf("expected %d lines, got %d", count, len(lines))
+	}
+	if packets < 2 {
+		t.Errorf("expected the lines split in several packets, got %d", packets)
+	}
+}
+
+func TestStatsdSanitize(t *testing.T) {
+	addr, read := listenStatsd(t)
+	sink := newTestStatsdSink(t, addr, true, nil)
+
+	sink.SetGaugeWithLabels([]string{"eth", "peers:count"}, 3, []metrics.Label{{Name: "client", Value: "Parity|v1,#2"}})
+	sink.Shutdown()
+
+	lines, _ := read(1)
+	if expected := "eth.peers_count:3|g|#client:Parity_v1__2"; lines[0] != expected {
+		t.Errorf("expected %s, got %s", expected, lines[0])
+	}
+}
@@ -0,0 +1,322 @@
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// NodeStatus is a snapshot of the state of a node, as seen by its monitor.
+type NodeStatus struct {
+	ClientVersion string
+	Chain         string
+
+	// Head of the node, nil if the node was never reached
+	BlockNumber *big.Int
+
+	// Blocks behind the reference, nil if the last comparison failed
+	BlocksBehind *int64
+
+	Peers   int64
+	HeadAge time.Duration
+
+	// Sync progress, nil if the node is not syncing
+	Sync *RpcSync
+
+	// Mean latency of the rpc calls of the last probe
+	Latency time.Duration
+
+	// Health verdict and the note explaining it
+	Health     string
+	HealthNote string
+}
+
+// probe runs the cycle and every collector of the monitor once, like the
+// goroutines of a started monitor, and returns the state of the node.
+func (m *Monitor) probe(ctx context.Context) *NodeStatus {
+	sum, count := m.metrics.rpcDurationTotals()
+
+	err := m.runCycle(ctx)
+	if m.isConnected() {
+		for _, s := range m.collectors {
+			m.collect(ctx, s)
+		}
+		err = m.lastCollectorErrors()
+	}
+
+	s := m.status()
+	s.Health, s.HealthNote = m.evaluateHealth(err)
+	s.HealthNote = oneLine(s.HealthNote)
+
+	if sum1, count1 := m.metrics.rpcDurationTotals(); count1 > count {
+		s.Latency = time.Duration((sum1 - sum) / float64(count1-count) * float64(time.Second))
+	}
+
+	return s
+}
+
+// status returns the last state of the node recorded by the collectors.
+func (m *Monitor) status() *NodeStatus {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	s := &NodeStatus{
+		ClientVersion: m.clientVersion,
+		Chain:         m.chain,
+		Peers:         m.peers,
+		Sync:          m.sync,
+	}
+
+	if !m.connected || m.blockNumber == 0 {
+		return s
+	}
+
+	s.BlockNumber = new(big.Int).SetUint64(m.blockNumber)
+	if m.collectorErrors["block"] == nil {
+		behind := m.blocksBehind
+		s.BlocksBehind = &behind
+	}
+	if !m.headTime.IsZero() {
+		s.HeadAge = time.Since(m.headTime)
+	}
+
+	return s
+}
+
+// Top renders a refreshing table with the state of the nodes, using plain
+// ANSI escapes. Each node is probed by a monitor of its own, never started.
+type Top struct {
+	out      io.Writer
+	interval time.Duration
+
+	nodes []*topNode
+}
+
+type topNode struct {
+	label   string
+	monitor *Monitor
+	status  *NodeStatus
+}
+
+// NewTop creates the view of the endpoints, each one a different node.
+// referenceURL may be empty to use the reference of the config.
+func NewTop(config *Config, endpoints []string, out io.Writer, interval time.Duration, referenceURL string) (*Top, error) {
+	t := &Top{
+		out:      out,
+		interval: interval,
+	}
+
+	for _, endpoint := range endpoints {
+		m, err := NewMonitor(topConfig(config, endpoint, referenceURL))
+		if err != nil {
+			return nil, err
+		}
+		t.nodes = append(t.nodes, &topNode{label: newRPCEndpoint(endpoint).label, monitor: m})
+	}
+
+	return t, nil
+}
+
+// topConfig returns the config of the monitor of the endpoint. The outputs
+// of the monitor that open files or send data are disabled.
+func topConfig(config *Config, endpoint, referenceURL string) *Config {
+	c := *config
+
+	c.LogOutput = ioutil.Discard
+	c.Endpoint = endpoint
+	c.Endpoints = nil
+	if referenceURL != "" {
+		c.ReferenceURL = referenceURL
+	}
+
+	c.Discovery = DiscoveryNone
+	c.HistoryConfig = nil
+	c.GoMetricsConfig = &GoMetricsConfig{}
+	c.InfluxDBConfig = nil
+	c.RemoteWriteConfig = nil
+	c.OTLPConfig = &OTLPConfig{DisableMetrics: true, DisableTraces: true}
+
+	return &c
+}
+
+// ANSI escapes
+const (
+	ansiClear      = "\x1b[H\x1b[2J"
+	ansiAltScreen  = "\x1b[?1049h"
+	ansiMainScreen = "\x1b[?1049l"
+	ansiHideCursor = "\x1b[?25l"
+	ansiShowCursor = "\x1b[?25h"
+	ansiBold       = "\x1b[1m"
+	ansiReset      = "\x1b[0m"
+	ansiRed        = "\x1b[31m"
+	ansiGreen      = "\x1b[32m"
+	ansiYellow     = "\x1b[33m"
+)
+
+// Run refreshes the view every interval until ctx is done. The terminal is
+// restored on exit.
+func (t *Top) Run(ctx context.Context) {
+	fmt.Fprint(t.out, ansiAltScreen+ansiHideCursor)
+	defer fmt.Fprint(t.out, ansiShowCursor+ansiMainScreen)
+
+	for {
+		t.probe(ctx)
+
+		var buf bytes.Buffer
+		buf.WriteString(ansiClear)
+		t.render(&buf, true)
+		t.out.Write(buf.Bytes())
+
+		select {
+		case <-time.After(t.interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Once probes the nodes and prints the table once, without escapes.
+func (t *Top) Once(ctx context.Context) {
+	t.probe(ctx)
+	t.render(t.out, false)
+}
+
+// probe probes all the nodes concurrently.
+func (t *Top) probe(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	for _, node := range t.nodes {
+		wg.Add(1)
+		go func(n *topNode) {
+			defer wg.Done()
+
+			n.status = n.monitor.probe(ctx)
+		}(node)
+	}
+
+	wg.Wait()
+}
+
+var topColumns = []string{"NODE", "CLIENT", "HEIGHT", "BEHIND", "PEERS", "HEAD AGE", "SYNC", "LATENCY", "HEALTH"}
+
+func (t *Top) render(w io.Writer, color bool) {
+	rows := [][]string{}
+	for _, node := range t.nodes {
+		rows = append(rows, node.row())
+	}
+
+	widths := make([]int, len(topColumns))
+	for i, column := range topColumns {
+		widths[i] = len(column)
+	}
+	for _, row := range rows {
+		for i, cell := range row {
+			if n := utf8.RuneCountInString(cell); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+
+	// The cells are padded before the escapes are added so they do not
+	// count in the widths
+	line := func(cells []string, style func(i int, cell string) string) string {
+		parts := []string{}
+		for i, cell := range cells {
+			padded := cell + strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell))
+			if color {
+				padded = style(i, padded)
+			}
+			parts = append(parts, padded)
+		}
+		return strings.TrimRight(strings.Join(parts, "  "), " ")
+	}
+
+	if color {
+		fmt.Fprintf(w, "ethereum-exporter top - %s - refresh every %s\n\n", time.Now().Format("15:04:05"), t.interval)
+	}
+
+	fmt.Fprintln(w, line(topColumns, func(i int, cell string) string {
+		return ansiBold + cell + ansiReset
+	}))
+
+	for n, row := range rows {
+		status := t.nodes[n].status
+		fmt.Fprintln(w, line(row, func(i int, cell string) string {
+			if i != len(row)-1 {
+				return cell
+			}
+			return healthColor(status.Health) + cell + ansiReset
+		}))
+	}
+
+	// Notes of the nodes not passing
+	notes := []string{}
+	for _, node := range t.nodes {
+		if node.status.Health != HealthPassing {
+			notes = append(notes, fmt.Sprintf("%s: %s", node.label, node.status.HealthNote))
+		}
+	}
+	if len(notes) != 0 {
+		fmt.Fprintf(w, "\n%s\n", strings.Join(notes, "\n"))
+	}
+}
+
+func healthColor(health string) string {
+	switch health {
+	case HealthPassing:
+		return ansiGreen
+	case HealthWarning:
+		return ansiYellow
+	}
+	return ansiRed
+}
+
+func (n *topNode) row() []string {
+	s := n.status
+
+	row := []string{n.label, "-", "-", "-", "-", "-", "-", "-", s.Health}
+	if s.BlockNumber == nil {
+		return row
+	}
+
+	if s.ClientVersion != "" {
+		row[1] = clientSummary(s.ClientVersion)
+	}
+	row[2] = s.BlockNumber.String()
+	if s.BlocksBehind != nil {
+		row[3] = fmt.Sprintf("%d", *s.BlocksBehind)
+	}
+	row[4] = fmt.Sprintf("%d", s.Peers)
+	if s.HeadAge > 0 {
+		row[5] = s.HeadAge.Truncate(time.Second).String()
+	}
+	if s.Sync != nil && s.Sync.CurrentBlock != nil && s.Sync.HighestBlock != nil {
+		progress := 0.0
+		if highest := s.Sync.HighestBlock.Int64(); highest != 0 {
+			progress = 100 * float64(s.Sync.CurrentBlock.Int64()) / float64(highest)
+		}
+		row[6] = fmt.Sprintf("%s/%s (%.1f%%)", s.Sync.CurrentBlock, s.Sync.HighestBlock, progress)
+	}
+	row[7] = s.Latency.Truncate(time.Millisecond / 10).String()
+
+	return row
+}
+
+// clientSummary returns the name and version of a web3_clientVersion string
+// (i.e. Parity/v1.8.2-beta for Parity//v1.8.2-beta/x86_64-linux-gnu/rustc1.21.0).
+func clientSummary(version string) string {
+	parts := strings.Split(version, "/")
+	for _, part := range parts[1:] {
+		if strings.HasPrefix(part, "v") {
+			return parts[0] + "/" + part
+		}
+	}
+	return parts[0]
+}
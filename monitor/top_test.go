@@ -0,0 +1,87 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/melonproject/ethereum-exporter/monitor/ethtest"
+)
+
+func TestHealthVerdict(t *testing.T) {
+	err := fmt.Errorf("timeout")
+
+	cases := []struct {
+		connected bool
+		synced    bool
+		behind    int64
+		err       error
+		health    string
+		note      string
+	}{
+		{false, false, 0, nil, HealthCritical, "Node unreachable"},
+		{false, true, 0, err, HealthCritical, "Node unreachable: timeout"},
+		{true, false, 12, nil, HealthCritical, "Node is not synced: 12 blocks behind (threshold 5)"},
+		{true, false, 0, err, HealthCritical, "Node is not synced: 0 blocks behind (threshold 5) with errors: timeout"},
+		{true, true, 2, err, HealthWarning, "Node synced (2 blocks behind) with errors: timeout"},
+		{true, true, -1, nil, HealthPassing, "Node synced: -1 blocks behind"},
+	}
+
+	for _, c := range cases {
+		health, note := healthVerdict(c.connected, c.synced, c.behind, 5, c.err)
+		if health != c.health || note != c.note {
+			t.Errorf("healthVerdict(%v, %v, %d, %v): expected %s '%s', got %s '%s'", c.connected, c.synced, c.behind, c.err, c.health, c.note, health, note)
+		}
+	}
+}
+
+func TestTopProbe(t *testing.T) {
+	cases := []struct {
+		name   string
+		script func(node *ethtest.Node, etherscan *ethtest.Etherscan)
+		health string
+		note   string
+		behind string
+	}{
+		{"synced", func(node *ethtest.Node, etherscan *ethtest.Etherscan) {}, HealthPassing, "Node synced: 0 blocks behind", "0"},
+		{"behind", func(node *ethtest.Node, etherscan *ethtest.Etherscan) { etherscan.SetAhead(8) }, HealthCritical, "Node is not synced: 8 blocks behind (threshold 5)", "8"},
+		{"errors", func(node *ethtest.Node, etherscan *ethtest.Etherscan) {
+			node.SetError("net_peerCount", &ethtest.Error{Code: -32000, Message: "no peers api"})
+		}, HealthWarning, "Node synced (0 blocks behind) with errors", "0"},
+		{"reference unavailable", func(node *ethtest.Node, etherscan *ethtest.Etherscan) { etherscan.SetHTTPStatus(502) }, HealthCritical, "Node is not synced", "-"},
+		{"down", func(node *ethtest.Node, etherscan *ethtest.Etherscan) { node.SetDown(true) }, HealthCritical, "Node unreachable", "-"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			node, etherscan := startTestNode(t)
+			c.script(node, etherscan)
+
+			top, err := NewTop(testConfig(node, etherscan), []string{node.URL()}, ioutil.Discard, time.Second, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			top.probe(ctx)
+
+			n := top.nodes[0]
+			if n.status.Health != c.health || !strings.HasPrefix(n.status.HealthNote, c.note) {
+				t.Errorf("expected %s '%s', got %s '%s'", c.health, c.note, n.status.Health, n.status.HealthNote)
+			}
+			if row := n.row(); row[3] != c.behind {
+				t.Errorf("expected %s blocks behind, got %v", c.behind, row)
+			}
+			if n.status.Health != HealthCritical || c.behind != "-" {
+				if n.status.BlockNumber == nil || n.status.BlockNumber.Int64() != 1000 || n.status.Latency <= 0 {
+					t.Errorf("expected the head 1000 and the rpc latency, got %v %s", n.status.BlockNumber, n.status.Latency)
+				}
+			}
+		})
+	}
+}
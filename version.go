@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+)
+
+var (
+	// Git commit and release, set by the build with -ldflags
+	GitCommit string
+
+	Version           = "0.1.0"
+	VersionPrerelease = "dev"
+)
+
+func versionString() string {
+	version := "ethereum-exporter v" + Version
+	if VersionPrerelease != "" {
+		version += "-" + VersionPrerelease
+	}
+	if GitCommit != "" {
+		version += fmt.Sprintf(" (%s)", GitCommit)
+	}
+	return version
+}